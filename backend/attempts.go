@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// softDeclineCodes are provider failure codes that say nothing about the
+// payer, so the payment may be tried on another provider. Any other decline,
+// such as insufficient_funds, is final. A timeout is not one: the provider
+// may have authorized the payment anyway.
+var softDeclineCodes = map[string]bool{
+	"provider_error":        true,
+	"processing_error":      true,
+	"issuer_not_available":  true,
+	"try_again_later":       true,
+	"processor_unavailable": true,
+}
+
+// isSoftDecline reports whether result may be retried on another provider
+func isSoftDecline(result *ProviderResult) bool {
+	return result.Status == StatusFailed && softDeclineCodes[result.FailureCode]
+}
+
+// providerErrorCode classifies an error returned by a provider adapter
+func providerErrorCode(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "provider_timeout"
+	}
+	return "provider_error"
+}
+
+func insertPaymentAttempt(db *DatabaseConnection, attempt *PaymentAttempt) error {
+	if attempt.ID == "" {
+		attempt.ID = uuid.New().String()
+	}
+	query := `
+		INSERT INTO payment_attempts (id, transaction_id, provider, attempt_number, status, error_code, error_message, latency_ms, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9)
+	`
+	_, err := db.ExecuteQuery(query, attempt.ID, attempt.TransactionID, attempt.Provider, attempt.AttemptNumber, attempt.Status,
+		attempt.ErrorCode, attempt.ErrorMessage, attempt.LatencyMs, attempt.CreatedAt)
+	return err
+}
+
+func listPaymentAttempts(db *DatabaseConnection, txnID string) ([]PaymentAttempt, error) {
+	query := `
+		SELECT id, transaction_id, provider, attempt_number, status, COALESCE(error_code, ''), COALESCE(error_message, ''), latency_ms, created_at
+		FROM payment_attempts
+		WHERE transaction_id = $1
+		ORDER BY attempt_number ASC
+	`
+	rows, err := db.Query(query, txnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []PaymentAttempt{}
+	for rows.Next() {
+		var a PaymentAttempt
+		if err := rows.Scan(&a.ID, &a.TransactionID, &a.Provider, &a.AttemptNumber, &a.Status, &a.ErrorCode, &a.ErrorMessage, &a.LatencyMs, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// GetTransactionAttempts lists the provider calls made for one of the
+// caller's transactions
+func (th *TransactionHandler) GetTransactionAttempts(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	attempts, err := listPaymentAttempts(th.db, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch payment attempts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    attempts,
+	})
+}
+
+// recordAttempt stores one provider call; failures are logged, not returned,
+// so bookkeeping never changes the payment outcome
+func (pp *PaymentProcessor) recordAttempt(txn *Transaction, number int, result *ProviderResult, callErr error, latency time.Duration) {
+	attempt := &PaymentAttempt{
+		TransactionID: txn.ID,
+		Provider:      txn.Provider,
+		AttemptNumber: number,
+		Status:        result.Status,
+		ErrorCode:     result.FailureCode,
+		ErrorMessage:  result.FailureMessage,
+		LatencyMs:     latency.Milliseconds(),
+		CreatedAt:     time.Now(),
+	}
+	if callErr != nil {
+		attempt.ErrorMessage = callErr.Error()
+	}
+	if err := insertPaymentAttempt(pp.db, attempt); err != nil {
+		log.Printf("Failed to record payment attempt for %s: %v", txn.ID, err)
+	}
+}
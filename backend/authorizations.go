@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Capture methods
+const (
+	CaptureAutomatic = "automatic"
+	CaptureManual    = "manual"
+)
+
+var (
+	errNotAuthorized               = errors.New("transaction is not authorized")
+	errCaptureExceedsAuthorization = errors.New("capture amount exceeds the authorized amount")
+	errAuthorizationNotDue         = errors.New("authorization is not due for expiry handling")
+)
+
+// CaptureRequest is the body of POST /transactions/:id/capture. A zero
+// amount captures the full authorization.
+type CaptureRequest struct {
+	Amount DecimalAmount `json:"amount"`
+}
+
+// VoidRequest is the body of POST /transactions/:id/void
+type VoidRequest struct {
+	Reason string `json:"reason"`
+}
+
+// providerFor returns the adapter for the provider that authorized txn
+func (pp *PaymentProcessor) providerFor(txn *Transaction) (PaymentProvider, error) {
+	provider, ok := pp.registry.Get(txn.Provider)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", txn.Provider)
+	}
+	return provider, nil
+}
+
+// Capture collects amount from an authorized transaction. The row stays
+// locked during the provider call so a capture and a void cannot race. A
+// provider decline leaves the transaction authorized with the failure
+// recorded; the returned result says what the provider did.
+func (pp *PaymentProcessor) Capture(ctx context.Context, txnID string, requested DecimalAmount, source string) (*Transaction, *ProviderResult, error) {
+	var txn *Transaction
+	var result *ProviderResult
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		txn, err = getTransactionForUpdate(tx, txnID)
+		if err != nil {
+			return err
+		}
+		if txn.Status != StatusAuthorized {
+			return errNotAuthorized
+		}
+		amount, err := requested.Money(txn.Currency)
+		if err != nil {
+			return err
+		}
+		if amount.IsNegative() {
+			return errNegativeAmount
+		}
+		if amount.IsZero() {
+			amount = txn.Amount
+		}
+		if amount.Cmp(txn.Amount) > 0 {
+			return errCaptureExceedsAuthorization
+		}
+
+		provider, err := pp.providerFor(txn)
+		if err != nil {
+			return err
+		}
+		result, err = provider.Capture(ctx, txn, amount)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			UPDATE transactions
+			SET provider_txn_id = COALESCE(NULLIF($1, ''), provider_txn_id), failure_code = NULLIF($2, ''), failure_message = NULLIF($3, '')
+			WHERE id = $4
+		`
+		if _, err := tx.Exec(query, result.ProviderTxnID, result.FailureCode, result.FailureMessage, txn.ID); err != nil {
+			return err
+		}
+		if result.Status == StatusFailed || result.Status == StatusBlocked {
+			txn.FailureCode, txn.FailureMessage = result.FailureCode, result.FailureMessage
+			return nil
+		}
+
+		// A partial capture releases the rest of the authorization
+		query = `UPDATE transactions SET captured_amount = $1 WHERE id = $2`
+		if _, err := tx.Exec(query, amount, txn.ID); err != nil {
+			return err
+		}
+		txn, err = setTransactionStatus(tx, txn.ID, result.Status, source, "")
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pp.cache.Delete(txn.ID)
+	if txn.Status != StatusAuthorized {
+		pp.broker.PublishEvent("payment."+txn.Status, txn)
+	}
+	return txn, result, nil
+}
+
+// Void releases an authorized transaction without capturing it
+func (pp *PaymentProcessor) Void(ctx context.Context, txnID, source, reason string) (*Transaction, *ProviderResult, error) {
+	return pp.void(ctx, txnID, source, reason, nil)
+}
+
+// void is Void with an extra check on the locked transaction, which can
+// refuse the void by returning an error
+func (pp *PaymentProcessor) void(ctx context.Context, txnID, source, reason string, check func(*Transaction) error) (*Transaction, *ProviderResult, error) {
+	var txn *Transaction
+	var result *ProviderResult
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		txn, err = getTransactionForUpdate(tx, txnID)
+		if err != nil {
+			return err
+		}
+		if txn.Status != StatusAuthorized {
+			return errNotAuthorized
+		}
+		if check != nil {
+			if err := check(txn); err != nil {
+				return err
+			}
+		}
+
+		provider, err := pp.providerFor(txn)
+		if err != nil {
+			return err
+		}
+		result, err = provider.Void(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if result.Status != StatusVoided {
+			query := `UPDATE transactions SET failure_code = NULLIF($1, ''), failure_message = NULLIF($2, '') WHERE id = $3`
+			_, err := tx.Exec(query, result.FailureCode, result.FailureMessage, txn.ID)
+			txn.FailureCode, txn.FailureMessage = result.FailureCode, result.FailureMessage
+			return err
+		}
+
+		txn, err = setTransactionStatus(tx, txn.ID, StatusVoided, source, reason)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pp.cache.Delete(txn.ID)
+	if txn.Status == StatusVoided {
+		pp.broker.PublishEvent("payment.voided", txn)
+	}
+	return txn, result, nil
+}
+
+// authorizationErrorResponse maps capture and void errors onto responses
+func authorizationErrorResponse(c *gin.Context, txnID string, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Transaction not found"})
+	case err == errNotAuthorized || errors.Is(err, errIllegalTransition):
+		c.JSON(http.StatusConflict, APIResponse{Success: false, Error: err.Error(), Code: "not_authorized"})
+	case err == errCaptureExceedsAuthorization || isAmountError(err):
+		c.JSON(http.StatusUnprocessableEntity, APIResponse{Success: false, Error: err.Error(), Code: "invalid_capture_amount"})
+	default:
+		log.Printf("Provider call failed for %s: %v", txnID, err)
+		c.JSON(http.StatusBadGateway, APIResponse{Success: false, Error: "Payment provider request failed", Code: providerErrorCode(err)})
+	}
+}
+
+// CaptureTransaction captures all or part of one of the caller's
+// authorized transactions
+func (th *TransactionHandler) CaptureTransaction(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	var req CaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	txn, result, err := th.processor.Capture(c.Request.Context(), c.Param("id"), req.Amount, "capture:"+c.GetString("user_id"))
+	if err != nil {
+		authorizationErrorResponse(c, c.Param("id"), err)
+		return
+	}
+	if txn.Status == StatusAuthorized {
+		c.JSON(http.StatusPaymentRequired, APIResponse{
+			Success: false,
+			Data:    txn,
+			Error:   "Capture was declined by the provider",
+			Code:    result.FailureCode,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    txn,
+		Message: "Transaction captured",
+	})
+}
+
+// VoidTransaction releases one of the caller's authorized transactions
+func (th *TransactionHandler) VoidTransaction(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	var req VoidRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	txn, result, err := th.processor.Void(c.Request.Context(), c.Param("id"), "void:"+c.GetString("user_id"), req.Reason)
+	if err != nil {
+		authorizationErrorResponse(c, c.Param("id"), err)
+		return
+	}
+	if txn.Status != StatusVoided {
+		c.JSON(http.StatusPaymentRequired, APIResponse{
+			Success: false,
+			Data:    txn,
+			Error:   "Void was declined by the provider",
+			Code:    result.FailureCode,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    txn,
+		Message: "Authorization voided",
+	})
+}
+
+// AuthorizationExpiring is published as payment.authorization_expiring
+type AuthorizationExpiring struct {
+	TransactionID string    `json:"transaction_id"`
+	Provider      string    `json:"provider"`
+	Amount        Money     `json:"amount"`
+	Currency      string    `json:"currency"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// AuthorizationExpiryJob watches uncaptured authorizations. Those within
+// margin of their provider's expiry are voided or, by default, flagged once
+// with payment.authorization_expiring. Authorizations past expiry can no
+// longer be captured and are failed with authorization_expired.
+type AuthorizationExpiryJob struct {
+	db        *DatabaseConnection
+	broker    *MessageBroker
+	processor *PaymentProcessor
+	margin    time.Duration
+	autoVoid  bool
+}
+
+func NewAuthorizationExpiryJob(db *DatabaseConnection, broker *MessageBroker, processor *PaymentProcessor) *AuthorizationExpiryJob {
+	job := &AuthorizationExpiryJob{
+		db:        db,
+		broker:    broker,
+		processor: processor,
+		margin:    getEnvDuration("AUTH_EXPIRY_MARGIN", 24*time.Hour),
+		autoVoid:  getEnv("AUTH_EXPIRY_ACTION", "flag") == "void",
+	}
+
+	go job.run(getEnvDuration("AUTH_EXPIRY_CHECK_INTERVAL", 15*time.Minute))
+	return job
+}
+
+func (job *AuthorizationExpiryJob) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		job.CheckExpiring()
+	}
+}
+
+// expiringAuthorization is an authorized transaction due for attention
+type expiringAuthorization struct {
+	txn       Transaction
+	expiresAt time.Time
+}
+
+// authorizationExpiry returns when txn's authorization lapses. Authorizations
+// confirmed by webhook have no stored expiry, so theirs is worked out from
+// when they became authorized.
+func (job *AuthorizationExpiryJob) authorizationExpiry(txn *Transaction) (time.Time, bool) {
+	if txn.AuthorizationExpiresAt != nil {
+		return *txn.AuthorizationExpiresAt, true
+	}
+	if provider, ok := job.processor.registry.Get(txn.Provider); ok {
+		return txn.UpdatedAt.Add(provider.AuthorizationWindow()), true
+	}
+	return time.Time{}, false
+}
+
+// checkDue confirms that a transaction locked for expiry handling is still
+// authorized and within margin of expiry, or past it when expired is set. A
+// capture or void may have landed since the scan.
+func (job *AuthorizationExpiryJob) checkDue(txn *Transaction, expired bool) error {
+	if txn.Status != StatusAuthorized {
+		return errNotAuthorized
+	}
+	expiresAt, ok := job.authorizationExpiry(txn)
+	deadline := time.Now().Add(job.margin)
+	if expired {
+		deadline = time.Now()
+	}
+	if !ok || !deadline.After(expiresAt) {
+		return errAuthorizationNotDue
+	}
+	return nil
+}
+
+// CheckExpiring handles every authorization within margin of expiry
+func (job *AuthorizationExpiryJob) CheckExpiring() {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE status = $1`
+	rows, err := job.db.Query(query, StatusAuthorized)
+	if err != nil {
+		log.Printf("Failed to load authorized transactions: %v", err)
+		return
+	}
+
+	var due []expiringAuthorization
+	now := time.Now()
+	for rows.Next() {
+		var a expiringAuthorization
+		if err := scanTransaction(rows, &a.txn); err != nil {
+			log.Printf("Failed to scan authorized transaction: %v", err)
+			continue
+		}
+
+		var ok bool
+		if a.expiresAt, ok = job.authorizationExpiry(&a.txn); ok && now.Add(job.margin).After(a.expiresAt) {
+			due = append(due, a)
+		}
+	}
+	rows.Close()
+
+	for _, a := range due {
+		switch {
+		case now.After(a.expiresAt):
+			job.expire(&a.txn)
+		case job.autoVoid:
+			check := func(txn *Transaction) error { return job.checkDue(txn, false) }
+			_, _, err := job.processor.void(context.Background(), a.txn.ID, "auth-expiry", "authorization expires at "+a.expiresAt.Format(time.RFC3339), check)
+			if err != nil && err != errNotAuthorized && err != errAuthorizationNotDue {
+				log.Printf("Failed to void expiring authorization %s: %v", a.txn.ID, err)
+			}
+		default:
+			job.flag(&a.txn, a.expiresAt)
+		}
+	}
+}
+
+// flag publishes payment.authorization_expiring once per authorization
+func (job *AuthorizationExpiryJob) flag(txn *Transaction, expiresAt time.Time) {
+	query := `UPDATE transactions SET authorization_flagged_at = $1 WHERE id = $2 AND status = $3 AND authorization_flagged_at IS NULL`
+	result, err := job.db.ExecuteQuery(query, time.Now(), txn.ID, StatusAuthorized)
+	if err != nil {
+		log.Printf("Failed to flag expiring authorization %s: %v", txn.ID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		job.broker.PublishEvent("payment.authorization_expiring", AuthorizationExpiring{
+			TransactionID: txn.ID,
+			Provider:      txn.Provider,
+			Amount:        txn.Amount,
+			Currency:      txn.Currency,
+			ExpiresAt:     expiresAt,
+		})
+	}
+}
+
+// expire fails an authorization the provider has already released. It is
+// left alone if it was captured or voided since the scan.
+func (job *AuthorizationExpiryJob) expire(txn *Transaction) {
+	var updated *Transaction
+	err := job.db.WithTransaction(func(tx *sql.Tx) error {
+		locked, err := getTransactionForUpdate(tx, txn.ID)
+		if err != nil {
+			return err
+		}
+		if err := job.checkDue(locked, true); err != nil {
+			return err
+		}
+		updated, err = setTransactionStatus(tx, txn.ID, StatusFailed, "auth-expiry", "authorization_expired")
+		if err != nil {
+			return err
+		}
+		query := `UPDATE transactions SET failure_code = $1, failure_message = $2 WHERE id = $3`
+		_, err = tx.Exec(query, "authorization_expired", "Authorization expired before it was captured", txn.ID)
+		return err
+	})
+	if err == errNotAuthorized || err == errAuthorizationNotDue {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to expire authorization %s: %v", txn.ID, err)
+		return
+	}
+
+	job.processor.cache.Delete(txn.ID)
+	job.broker.PublishEvent("payment.failed", updated)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCaptureAndVoid(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	router := newTestRouter(th)
+
+	// Each step acts on the named transaction; all start authorized for 100.00
+	type step struct {
+		action       string // capture or void
+		userID       string
+		body         string
+		wantStatus   int
+		wantTxn      string
+		wantCaptured Money
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"full capture", []step{
+			{"capture", "user_001", `{}`, http.StatusOK, StatusCompleted, NewMoney(10000, "USD")},
+		}},
+		{"partial capture", []step{
+			{"capture", "user_001", `{"amount": 40.00}`, http.StatusOK, StatusCompleted, NewMoney(4000, "USD")},
+		}},
+		{"over-capture", []step{
+			{"capture", "user_001", `{"amount": 150.00}`, http.StatusUnprocessableEntity, StatusAuthorized, NewMoney(0, "USD")},
+			{"capture", "user_001", `{"amount": 100.00}`, http.StatusOK, StatusCompleted, NewMoney(10000, "USD")},
+		}},
+		{"negative capture", []step{
+			{"capture", "user_001", `{"amount": -1.00}`, http.StatusUnprocessableEntity, StatusAuthorized, NewMoney(0, "USD")},
+		}},
+		{"another user's capture", []step{
+			{"capture", "user_002", `{}`, http.StatusForbidden, StatusAuthorized, NewMoney(0, "USD")},
+		}},
+		{"void", []step{
+			{"void", "user_001", `{"reason": "Order cancelled"}`, http.StatusOK, StatusVoided, NewMoney(0, "USD")},
+			{"capture", "user_001", `{}`, http.StatusConflict, StatusVoided, NewMoney(0, "USD")},
+		}},
+		{"void after capture", []step{
+			{"capture", "user_001", `{"amount": 25.00}`, http.StatusOK, StatusCompleted, NewMoney(2500, "USD")},
+			{"void", "user_001", `{}`, http.StatusConflict, StatusCompleted, NewMoney(2500, "USD")},
+		}},
+		{"another user's void", []step{
+			{"void", "user_002", `{}`, http.StatusForbidden, StatusAuthorized, NewMoney(0, "USD")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureManual)
+			if txn.Status != StatusAuthorized {
+				t.Fatalf("status = %s, want %s", txn.Status, StatusAuthorized)
+			}
+			for i, s := range tt.steps {
+				w := serveTest(router, http.MethodPost, "/api/v1/transactions/"+txn.ID+"/"+s.action, s.userID, s.body)
+				if w.Code != s.wantStatus {
+					t.Fatalf("step %d: %s = %d, want %d: %s", i, s.action, w.Code, s.wantStatus, w.Body)
+				}
+				got := getTestTransaction(t, db, txn.ID)
+				if got.Status != s.wantTxn || got.CapturedAmount.Cmp(s.wantCaptured) != 0 {
+					t.Fatalf("step %d: transaction = %s, %s captured, want %s, %s", i, got.Status, got.CapturedAmount, s.wantTxn, s.wantCaptured)
+				}
+			}
+		})
+	}
+
+	w := serveTest(router, http.MethodPost, "/api/v1/transactions/missing/void", "user_001", `{}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("void of an unknown transaction = %d, want 404", w.Code)
+	}
+}
+
+func TestAuthorizationExpiry(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	job := &AuthorizationExpiryJob{db: db, broker: th.broker, processor: th.processor, margin: time.Hour, autoVoid: true}
+
+	tests := []struct {
+		name       string
+		expiresIn  time.Duration
+		capture    bool // captured after the job's scan
+		wantStatus string
+	}{
+		{name: "expired", expiresIn: -time.Minute, wantStatus: StatusFailed},
+		{name: "expiring is voided", expiresIn: 30 * time.Minute, wantStatus: StatusVoided},
+		{name: "not yet due", expiresIn: 2 * time.Hour, wantStatus: StatusAuthorized},
+		{name: "captured after the scan", expiresIn: -time.Minute, capture: true, wantStatus: StatusCompleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureManual)
+			expiresAt := time.Now().Add(tt.expiresIn)
+			if _, err := db.ExecuteQuery(`UPDATE transactions SET authorization_expires_at = $1 WHERE id = $2`, expiresAt, txn.ID); err != nil {
+				t.Fatal(err)
+			}
+			scanned := getTestTransaction(t, db, txn.ID)
+			if tt.capture {
+				if _, _, err := th.processor.Capture(context.Background(), txn.ID, "", "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Act on what the scan saw, as CheckExpiring does
+			if tt.expiresIn < 0 {
+				job.expire(scanned)
+			} else {
+				check := func(txn *Transaction) error { return job.checkDue(txn, false) }
+				if _, _, err := th.processor.void(context.Background(), txn.ID, "auth-expiry", "", check); err != nil && err != errAuthorizationNotDue {
+					t.Fatal(err)
+				}
+			}
+
+			if got := getTestTransaction(t, db, txn.ID); got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
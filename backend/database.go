@@ -65,6 +65,25 @@ func (dc *DatabaseConnection) Query(query string, args ...interface{}) (*sql.Row
 	return dc.db.Query(query, args...)
 }
 
+// WithTransaction runs fn inside a database transaction, committing on success
+// and rolling back if fn returns an error
+func (dc *DatabaseConnection) WithTransaction(fn func(tx *sql.Tx) error) error {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	tx, err := dc.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (dc *DatabaseConnection) GetDB() *sql.DB {
 	dc.mu.RLock()
 	defer dc.mu.RUnlock()
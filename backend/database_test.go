@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// openTestDB connects to TEST_DATABASE_URL and loads db/schema.sql into a
+// schema of its own, dropped when the test ends. Tests that need Postgres
+// are skipped when the variable is unset.
+func openTestDB(t *testing.T) *DatabaseConnection {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	schemaSQL, err := os.ReadFile(filepath.Join("..", "db", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Logf("Failed to drop schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	db, err := sql.Open("postgres", withSearchPath(url, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(string(schemaSQL)); err != nil {
+		t.Fatalf("Failed to load schema.sql: %v", err)
+	}
+	return &DatabaseConnection{db: db}
+}
+
+// withSearchPath adds a search_path runtime parameter to a URL or
+// key=value connection string
+func withSearchPath(conn, schema string) string {
+	if !strings.HasPrefix(conn, "postgres://") && !strings.HasPrefix(conn, "postgresql://") {
+		return conn + " search_path=" + schema
+	}
+	if strings.Contains(conn, "?") {
+		return conn + "&search_path=" + schema
+	}
+	return conn + "?search_path=" + schema
+}
+
+// newTestTransactionHandler wires a handler to the sandbox provider, with
+// events going to the in-memory broker
+func newTestTransactionHandler(t *testing.T, db *DatabaseConnection) *TransactionHandler {
+	t.Helper()
+	registry, err := NewProviderRegistry(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker, cache := &MessageBroker{}, NewCacheService()
+	processor := NewPaymentProcessor(db, broker, cache, registry)
+	return &TransactionHandler{db: db, broker: broker, cache: cache, processor: processor}
+}
+
+// createTestTransaction charges amount to userID through the sandbox. A
+// manual capture leaves the transaction authorized; otherwise it completes.
+func createTestTransaction(t *testing.T, th *TransactionHandler, userID string, amount Money, captureMethod string) *Transaction {
+	t.Helper()
+	now := time.Now()
+	txn := &Transaction{
+		ID:                 uuid.New().String(),
+		UserID:             userID,
+		Amount:             amount,
+		Currency:           amount.Currency,
+		Status:             StatusProcessing,
+		Provider:           "sandbox",
+		PaymentMethod:      "pm_test",
+		CaptureMethod:      captureMethod,
+		SettlementAmount:   amount,
+		SettlementCurrency: amount.Currency,
+		FXRate:             "1",
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	err := th.db.WithTransaction(func(tx *sql.Tx) error {
+		return insertTransaction(tx, txn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := th.processor.Submit(context.Background(), txn); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// getTestTransaction reads a transaction back from the database
+func getTestTransaction(t *testing.T, db *DatabaseConnection, txnID string) *Transaction {
+	t.Helper()
+	var txn Transaction
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1`
+	if err := scanTransaction(db.QueryRow(query, txnID), &txn); err != nil {
+		t.Fatal(err)
+	}
+	return &txn
+}
+
+func newTestRouter(th *TransactionHandler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes := router.Group("/api/v1/transactions", AuthenticationMiddleware(th.db))
+	routes.POST("/:id/capture", th.CaptureTransaction)
+	routes.POST("/:id/void", th.VoidTransaction)
+	routes.POST("/:id/refunds", th.CreateRefund)
+	routes.GET("/:id/refunds", th.ListRefunds)
+	routes.GET("/:id/attempts", th.GetTransactionAttempts)
+	routes.GET("/:id/history", th.GetTransactionHistory)
+	return router
+}
+
+// serveTest sends a JSON request as userID
+func serveTest(router http.Handler, method, path, userID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+userID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
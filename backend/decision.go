@@ -0,0 +1,64 @@
+package main
+
+import "log"
+
+// Transaction statuses
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusAuthorized = "authorized" // funds reserved, not yet captured
+	StatusCaptured   = "captured"   // funds captured, not yet settled
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusBlocked    = "blocked"
+	StatusHeld       = "held" // awaiting manual review
+	StatusRefunded   = "refunded"
+	StatusVoided     = "voided" // authorization released without capture
+	StatusDisputed   = "disputed"
+)
+
+// DecisionThresholds maps risk scores onto fraud actions. Scores at or above
+// BlockScore are blocked, scores at or above ReviewScore are held for review.
+type DecisionThresholds struct {
+	ReviewScore float64
+	BlockScore  float64
+}
+
+func LoadDecisionThresholds() DecisionThresholds {
+	dt := DecisionThresholds{
+		ReviewScore: getEnvFloat("FRAUD_REVIEW_THRESHOLD", 0.5),
+		BlockScore:  getEnvFloat("FRAUD_BLOCK_THRESHOLD", 0.7),
+	}
+	if dt.ReviewScore > dt.BlockScore {
+		log.Printf("FRAUD_REVIEW_THRESHOLD %.2f is above FRAUD_BLOCK_THRESHOLD %.2f, clamping", dt.ReviewScore, dt.BlockScore)
+		dt.ReviewScore = dt.BlockScore
+	}
+	return dt
+}
+
+// Decide returns the fraud action for a risk score and the model's fraud flag
+func (dt DecisionThresholds) Decide(riskScore float64, modelFlagged bool) string {
+	switch {
+	case riskScore >= dt.BlockScore:
+		return FraudActionBlocked
+	case riskScore >= dt.ReviewScore:
+		return FraudActionManualReview
+	case modelFlagged:
+		// The model flagged an anomaly but the score is low: let an analyst look
+		return FraudActionManualReview
+	default:
+		return FraudActionApproved
+	}
+}
+
+// statusForAction returns the initial transaction status for a fraud action
+func statusForAction(action string) string {
+	switch action {
+	case FraudActionBlocked:
+		return StatusBlocked
+	case FraudActionManualReview:
+		return StatusHeld
+	default:
+		return StatusProcessing
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	dt := DecisionThresholds{ReviewScore: 0.5, BlockScore: 0.7}
+
+	tests := []struct {
+		score   float64
+		flagged bool
+		want    string
+	}{
+		{0, false, FraudActionApproved},
+		{0.49, false, FraudActionApproved},
+		{0.49, true, FraudActionManualReview},
+		{0.5, false, FraudActionManualReview},
+		{0.69, false, FraudActionManualReview},
+		{0.7, false, FraudActionBlocked},
+		{0.7, true, FraudActionBlocked},
+		{1, false, FraudActionBlocked},
+	}
+	for _, tt := range tests {
+		if got := dt.Decide(tt.score, tt.flagged); got != tt.want {
+			t.Errorf("Decide(%v, %v) = %q, want %q", tt.score, tt.flagged, got, tt.want)
+		}
+	}
+}
+
+func TestStatusForAction(t *testing.T) {
+	tests := map[string]string{
+		FraudActionApproved:     StatusProcessing,
+		FraudActionManualReview: StatusHeld,
+		FraudActionBlocked:      StatusBlocked,
+	}
+	for action, want := range tests {
+		if got := statusForAction(action); got != want {
+			t.Errorf("statusForAction(%q) = %q, want %q", action, got, want)
+		}
+	}
+}
+
+func TestLoadDecisionThresholdsClamps(t *testing.T) {
+	os.Setenv("FRAUD_REVIEW_THRESHOLD", "0.9")
+	os.Setenv("FRAUD_BLOCK_THRESHOLD", "0.6")
+	defer os.Unsetenv("FRAUD_REVIEW_THRESHOLD")
+	defer os.Unsetenv("FRAUD_BLOCK_THRESHOLD")
+
+	dt := LoadDecisionThresholds()
+	if dt.ReviewScore != 0.6 || dt.BlockScore != 0.6 {
+		t.Errorf("LoadDecisionThresholds() = %+v, want review clamped to 0.6", dt)
+	}
+}
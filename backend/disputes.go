@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Dispute statuses
+const (
+	DisputeNeedsResponse = "needs_response"
+	DisputeUnderReview   = "under_review"
+	DisputeWon           = "won"
+	DisputeLost          = "lost"
+)
+
+var (
+	errDisputeClosed           = errors.New("dispute is already closed")
+	errDisputeCurrencyMismatch = errors.New("dispute currency does not match the transaction currency")
+)
+
+// disputeUpdate is the state of a provider dispute carried by a webhook
+type disputeUpdate struct {
+	ProviderDisputeID string
+	Status            string // empty when the provider status has no equivalent
+	Reason            string
+	Amount            Money
+	Currency          string
+	DueBy             *time.Time
+}
+
+// stripeDisputeStatuses maps Stripe dispute statuses onto ours. Inquiries
+// (warning_*) are treated like chargebacks; a closed inquiry is a win.
+var stripeDisputeStatuses = map[string]string{
+	"warning_needs_response": DisputeNeedsResponse,
+	"needs_response":         DisputeNeedsResponse,
+	"warning_under_review":   DisputeUnderReview,
+	"under_review":           DisputeUnderReview,
+	"warning_closed":         DisputeWon,
+	"won":                    DisputeWon,
+	"lost":                   DisputeLost,
+}
+
+// paypalDisputeStatus maps a PayPal dispute status and outcome onto ours
+func paypalDisputeStatus(status, outcome string) string {
+	switch status {
+	case "OPEN", "WAITING_FOR_SELLER_RESPONSE":
+		return DisputeNeedsResponse
+	case "WAITING_FOR_BUYER_RESPONSE", "UNDER_REVIEW":
+		return DisputeUnderReview
+	case "RESOLVED":
+		if outcome == "RESOLVED_BUYER_FAVOUR" {
+			return DisputeLost
+		}
+		return DisputeWon
+	}
+	return ""
+}
+
+func disputeClosed(status string) bool {
+	return status == DisputeWon || status == DisputeLost
+}
+
+const disputeColumns = `id, transaction_id, provider, provider_dispute_id, status, COALESCE(reason, ''), amount, currency, due_by, closed_at, created_at, updated_at`
+
+func scanDispute(row rowScanner, d *Dispute) error {
+	var dueBy, closedAt sql.NullTime
+	var amount moneyColumn
+	err := row.Scan(&d.ID, &d.TransactionID, &d.Provider, &d.ProviderDisputeID, &d.Status, &d.Reason, &amount, &d.Currency, &dueBy, &closedAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if dueBy.Valid {
+		d.DueBy = &dueBy.Time
+	}
+	if closedAt.Valid {
+		d.ClosedAt = &closedAt.Time
+	}
+	d.Amount, err = amount.money(d.Currency)
+	return err
+}
+
+// upsertDispute creates or updates the dispute an update describes and
+// returns it with whether it is new and its status before the update.
+// Closed disputes are left as they are.
+func upsertDispute(tx *sql.Tx, txnID, provider string, du *disputeUpdate) (*Dispute, bool, string, error) {
+	var d Dispute
+	query := `SELECT ` + disputeColumns + ` FROM disputes WHERE provider = $1 AND provider_dispute_id = $2 FOR UPDATE`
+	err := scanDispute(tx.QueryRow(query, provider, du.ProviderDisputeID), &d)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, "", err
+	}
+	now := time.Now()
+
+	if err == sql.ErrNoRows {
+		d = Dispute{
+			ID:                uuid.New().String(),
+			TransactionID:     txnID,
+			Provider:          provider,
+			ProviderDisputeID: du.ProviderDisputeID,
+			Status:            du.Status,
+			Reason:            du.Reason,
+			Amount:            du.Amount,
+			Currency:          du.Currency,
+			DueBy:             du.DueBy,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+		}
+		if d.Status == "" {
+			d.Status = DisputeNeedsResponse
+		}
+		if disputeClosed(d.Status) {
+			d.ClosedAt = &now
+		}
+		query = `
+			INSERT INTO disputes (id, transaction_id, provider, provider_dispute_id, status, reason, amount, currency, due_by, closed_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12)
+		`
+		_, err := tx.Exec(query, d.ID, d.TransactionID, d.Provider, d.ProviderDisputeID, d.Status, d.Reason, d.Amount, d.Currency, d.DueBy, d.ClosedAt, d.CreatedAt, d.UpdatedAt)
+		return &d, true, "", err
+	}
+
+	previous := d.Status
+	if disputeClosed(previous) {
+		return &d, false, previous, nil
+	}
+	if du.Status != "" {
+		d.Status = du.Status
+	}
+	if du.DueBy != nil {
+		d.DueBy = du.DueBy
+	}
+	if du.Reason != "" {
+		d.Reason = du.Reason
+	}
+	if disputeClosed(d.Status) {
+		d.ClosedAt = &now
+	}
+	d.UpdatedAt = now
+	query = `UPDATE disputes SET status = $1, reason = NULLIF($2, ''), due_by = $3, closed_at = $4, updated_at = $5 WHERE id = $6`
+	_, err = tx.Exec(query, d.Status, d.Reason, d.DueBy, d.ClosedAt, d.UpdatedAt, d.ID)
+	return &d, false, previous, err
+}
+
+// recordConfirmedFraud labels a transaction as fraud for the user's history
+// and for model training
+func recordConfirmedFraud(tx *sql.Tx, txn *Transaction, d *Dispute) error {
+	err := insertFraudLog(tx, &FraudLog{
+		TransactionID: txn.ID,
+		UserID:        txn.UserID,
+		RiskFactors:   []string{"chargeback_lost"},
+		RiskScore:     txn.RiskScore,
+		Action:        FraudActionConfirmedFraud,
+		ReviewedBy:    "dispute:" + d.Provider,
+		Reason:        "Lost dispute " + d.ProviderDisputeID + " (" + d.Reason + ")",
+		DetectedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO fraud_labels (id, transaction_id, user_id, label, source, source_id, risk_score, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = tx.Exec(query, uuid.New().String(), txn.ID, txn.UserID, "fraud", "dispute", d.ID, txn.RiskScore, time.Now())
+	return err
+}
+
+// FraudLabel is published as fraud.confirmed for the model training pipeline
+type FraudLabel struct {
+	TransactionID string  `json:"transaction_id"`
+	UserID        string  `json:"user_id"`
+	Label         string  `json:"label"`
+	Source        string  `json:"source"`
+	SourceID      string  `json:"source_id"`
+	RiskScore     float64 `json:"risk_score"`
+	Reason        string  `json:"reason"`
+}
+
+// RecordDispute applies a dispute webhook. A new dispute moves its
+// transaction to disputed and a win returns it to completed. A loss labels
+// it as confirmed fraud and moves it to refunded, or back to completed when
+// the dispute covered only part of what is outstanding.
+func (pp *PaymentProcessor) RecordDispute(update *webhookUpdate) error {
+	var dispute *Dispute
+	var txn *Transaction
+	var created, changed bool
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		txnID, err := resolveWebhookTransaction(tx, update)
+		if err != nil {
+			return err
+		}
+		txn, err = getTransactionForUpdate(tx, txnID)
+		if err != nil {
+			return err
+		}
+		if update.Dispute.Amount.Currency != txn.Currency {
+			return fmt.Errorf("%w: dispute in %s, transaction %s in %s", errDisputeCurrencyMismatch, update.Dispute.Amount.Currency, txn.ID, txn.Currency)
+		}
+
+		var previous string
+		dispute, created, previous, err = upsertDispute(tx, txn.ID, update.Provider, update.Dispute)
+		if err != nil {
+			return err
+		}
+		changed = created || (!disputeClosed(previous) && previous != dispute.Status)
+		if !changed {
+			return nil
+		}
+
+		source := "dispute:" + update.Provider
+		if created && canTransition(txn.Status, StatusDisputed) {
+			if txn, err = setTransactionStatus(tx, txn.ID, StatusDisputed, source, dispute.ID); err != nil {
+				return err
+			}
+		}
+		switch dispute.Status {
+		case DisputeWon:
+			if txn.Status == StatusDisputed {
+				txn, err = setTransactionStatus(tx, txn.ID, StatusCompleted, source, dispute.ID)
+			}
+		case DisputeLost:
+			if err := postUserPayback(tx, txn, AccountDisputeLosses, EntryDisputeLoss, dispute.ID, dispute.Amount); err != nil {
+				return err
+			}
+			if txn.Status == StatusDisputed {
+				outstanding, err := outstandingRevenue(tx, txn)
+				if err != nil {
+					return err
+				}
+				status := StatusRefunded
+				if outstanding.IsPositive() {
+					status = StatusCompleted
+				}
+				if txn, err = setTransactionStatus(tx, txn.ID, status, source, dispute.ID); err != nil {
+					return err
+				}
+			}
+			err = recordConfirmedFraud(tx, txn, dispute)
+		}
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return errUnknownWebhookTransaction
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	pp.cache.Delete(txn.ID)
+	if created {
+		pp.broker.PublishEvent("dispute.created", dispute)
+	}
+	if disputeClosed(dispute.Status) {
+		pp.broker.PublishEvent("dispute."+dispute.Status, dispute)
+	} else if !created {
+		pp.broker.PublishEvent("dispute.updated", dispute)
+	}
+	if dispute.Status == DisputeLost {
+		pp.broker.PublishEvent("fraud.confirmed", FraudLabel{
+			TransactionID: txn.ID,
+			UserID:        txn.UserID,
+			Label:         "fraud",
+			Source:        "dispute",
+			SourceID:      dispute.ID,
+			RiskScore:     txn.RiskScore,
+			Reason:        dispute.Reason,
+		})
+	}
+	return nil
+}
+
+func listDisputeEvidence(db *DatabaseConnection, disputeID string) ([]DisputeEvidence, error) {
+	query := `
+		SELECT id, dispute_id, type, filename, COALESCE(content_type, ''), COALESCE(size_bytes, 0), COALESCE(storage_url, ''), COALESCE(description, ''), uploaded_by, created_at
+		FROM dispute_evidence
+		WHERE dispute_id = $1
+		ORDER BY created_at ASC
+	`
+	rows, err := db.Query(query, disputeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evidence := []DisputeEvidence{}
+	for rows.Next() {
+		var e DisputeEvidence
+		if err := rows.Scan(&e.ID, &e.DisputeID, &e.Type, &e.Filename, &e.ContentType, &e.SizeBytes, &e.StorageURL, &e.Description, &e.UploadedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		evidence = append(evidence, e)
+	}
+	return evidence, rows.Err()
+}
+
+// ListDisputes lists disputes by evidence deadline, filtered by ?status=
+// and ?transaction_id=
+func (ah *AdminHandler) ListDisputes(c *gin.Context) {
+	query := `
+		SELECT ` + disputeColumns + `
+		FROM disputes
+		WHERE ($1::text = '' OR status = $1) AND ($2::text = '' OR transaction_id = $2)
+		ORDER BY due_by ASC NULLS LAST, created_at DESC
+		LIMIT 100
+	`
+	rows, err := ah.db.Query(query, c.Query("status"), c.Query("transaction_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch disputes",
+		})
+		return
+	}
+	defer rows.Close()
+
+	disputes := []Dispute{}
+	for rows.Next() {
+		var d Dispute
+		if err := scanDispute(rows, &d); err != nil {
+			continue
+		}
+		disputes = append(disputes, d)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    disputes,
+	})
+}
+
+// GetDispute returns a dispute with its evidence
+func (ah *AdminHandler) GetDispute(c *gin.Context) {
+	var d Dispute
+	query := `SELECT ` + disputeColumns + ` FROM disputes WHERE id = $1`
+	if err := scanDispute(ah.db.QueryRow(query, c.Param("id")), &d); err != nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Dispute not found",
+		})
+		return
+	}
+
+	evidence, err := listDisputeEvidence(ah.db, d.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch dispute evidence",
+		})
+		return
+	}
+	d.Evidence = evidence
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    d,
+	})
+}
+
+// AddDisputeEvidence attaches evidence metadata to an open dispute. The
+// file itself is uploaded to storage separately and referenced by URL.
+func (ah *AdminHandler) AddDisputeEvidence(c *gin.Context) {
+	analyst, ok := analystFromContext(c)
+	if !ok {
+		return
+	}
+
+	var e DisputeEvidence
+	if err := c.ShouldBindJSON(&e); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	e.ID = uuid.New().String()
+	e.DisputeID = c.Param("id")
+	e.UploadedBy = analyst
+	e.CreatedAt = time.Now()
+
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		var status string
+		query := `SELECT status FROM disputes WHERE id = $1 FOR UPDATE`
+		if err := tx.QueryRow(query, e.DisputeID).Scan(&status); err != nil {
+			return err
+		}
+		if disputeClosed(status) {
+			return errDisputeClosed
+		}
+
+		query = `
+			INSERT INTO dispute_evidence (id, dispute_id, type, filename, content_type, size_bytes, storage_url, description, uploaded_by, created_at)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, ''), $9, $10)
+		`
+		_, err := tx.Exec(query, e.ID, e.DisputeID, e.Type, e.Filename, e.ContentType, e.SizeBytes, e.StorageURL, e.Description, e.UploadedBy, e.CreatedAt)
+		return err
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Dispute not found"})
+		return
+	case err == errDisputeClosed:
+		c.JSON(http.StatusConflict, APIResponse{Success: false, Error: err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to add evidence to dispute %s: %v", e.DisputeID, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to add dispute evidence"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    e,
+	})
+}
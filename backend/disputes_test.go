@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRecordDisputeLost(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	router := newTestRouter(th)
+
+	tests := []struct {
+		name       string
+		refund     string // refunded before the dispute, if set
+		disputed   Money
+		wantErr    error
+		wantStatus string
+	}{
+		{name: "loss of the full amount", disputed: NewMoney(10000, "USD"), wantStatus: StatusRefunded},
+		{name: "partial loss", disputed: NewMoney(4000, "USD"), wantStatus: StatusCompleted},
+		{name: "loss covering the rest after a refund", refund: `{"amount": 60.00}`, disputed: NewMoney(4000, "USD"), wantStatus: StatusRefunded},
+		{name: "currency mismatch", disputed: NewMoney(10000, "EUR"), wantErr: errDisputeCurrencyMismatch, wantStatus: StatusCompleted},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureAutomatic)
+			if tt.refund != "" {
+				if w := serveTest(router, http.MethodPost, "/api/v1/transactions/"+txn.ID+"/refunds", "user_001", tt.refund); w.Code != http.StatusCreated {
+					t.Fatalf("refund = %d: %s", w.Code, w.Body)
+				}
+			}
+
+			for _, status := range []string{DisputeNeedsResponse, DisputeLost} {
+				err := th.processor.RecordDispute(&webhookUpdate{
+					Provider:    "sandbox",
+					EventID:     "evt_" + status,
+					TxnID:       txn.ID,
+					ProviderRef: txn.ProviderTxnID,
+					Dispute: &disputeUpdate{
+						ProviderDisputeID: fmt.Sprintf("dp_%d", i),
+						Status:            status,
+						Amount:            tt.disputed,
+						Currency:          tt.disputed.Currency,
+					},
+				})
+				if tt.wantErr != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("RecordDispute error = %v, want %v", err, tt.wantErr)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("RecordDispute(%s): %v", status, err)
+				}
+			}
+
+			if got := getTestTransaction(t, db, txn.ID); got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
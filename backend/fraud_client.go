@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the fraud service circuit breaker is open
+var ErrCircuitOpen = errors.New("fraud service circuit breaker is open")
+
+// FraudDetectionRequest mirrors TransactionData in the AI service
+type FraudDetectionRequest struct {
+	UserID                   string `json:"user_id"`
+	Amount                   Money  `json:"amount"`
+	Currency                 string `json:"currency"`
+	MerchantCategory         string `json:"merchant_category,omitempty"`
+	DeviceFingerprint        string `json:"device_fingerprint,omitempty"`
+	IPCountry                string `json:"ip_country,omitempty"`
+	PreviousTransactionCount int    `json:"previous_transaction_count"`
+	AccountAgeDays           int    `json:"account_age_days"`
+}
+
+// FraudDetectionResponse mirrors the /predict response of the AI service
+type FraudDetectionResponse struct {
+	TransactionID  string   `json:"transaction_id"`
+	RiskScore      float64  `json:"risk_score"`
+	IsFraud        bool     `json:"is_fraud"`
+	RiskFactors    []string `json:"risk_factors"`
+	Confidence     float64  `json:"confidence"`
+	Recommendation string   `json:"recommendation"` // APPROVE, MANUAL_REVIEW, BLOCK
+	Fallback       bool     `json:"fallback"`
+}
+
+// FraudClient is an HTTP client for the Python fraud detection service
+type FraudClient struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+	breaker    *CircuitBreaker
+}
+
+func NewFraudClient() *FraudClient {
+	return &FraudClient{
+		baseURL: strings.TrimRight(getEnv("AI_SERVICE_URL", "http://localhost:8001"), "/"),
+		httpClient: &http.Client{
+			Timeout: getEnvDuration("AI_SERVICE_TIMEOUT", 2*time.Second),
+		},
+		maxRetries: getEnvInt("AI_SERVICE_MAX_RETRIES", 2),
+		backoff:    getEnvDuration("AI_SERVICE_RETRY_BACKOFF", 100*time.Millisecond),
+		breaker: NewCircuitBreaker(
+			getEnvInt("AI_SERVICE_BREAKER_THRESHOLD", 5),
+			getEnvDuration("AI_SERVICE_BREAKER_COOLDOWN", 30*time.Second),
+		),
+	}
+}
+
+// Predict scores a transaction, retrying transient failures with exponential backoff
+func (fc *FraudClient) Predict(ctx context.Context, txnID string, data FraudDetectionRequest) (*FraudDetectionResponse, error) {
+	if !fc.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= fc.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(fc.backoff * time.Duration(1<<(attempt-1))):
+			case <-ctx.Done():
+				fc.breaker.RecordFailure()
+				return nil, ctx.Err()
+			}
+		}
+
+		resp, retryable, err := fc.doPredict(ctx, txnID, body)
+		if err == nil {
+			fc.breaker.RecordSuccess()
+			return resp, nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+
+	fc.breaker.RecordFailure()
+	return nil, lastErr
+}
+
+func (fc *FraudClient) doPredict(ctx context.Context, txnID string, body []byte) (*FraudDetectionResponse, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fc.baseURL+"/predict", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", txnID)
+
+	resp, err := fc.httpClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		// 5xx and 429 are worth retrying; other client errors are not
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, fmt.Errorf("fraud service returned status %d", resp.StatusCode)
+	}
+
+	var result FraudDetectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("decoding fraud service response: %w", err)
+	}
+	return &result, false, nil
+}
+
+// CircuitBreaker opens after a run of consecutive failures and lets a single
+// probe request through once the cooldown has elapsed
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+	mu        sync.Mutex
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if time.Now().Before(cb.openUntil) || cb.probing {
+		return false
+	}
+	// Half-open: allow one probe through
+	cb.probing = true
+	return true
+}
+
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures >= cb.threshold {
+		log.Printf("Fraud service circuit breaker closed")
+	}
+	cb.failures = 0
+	cb.probing = false
+}
+
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probing = false
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		log.Printf("Fraud service circuit breaker open for %s after %d failures", cb.cooldown, cb.failures)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+
+	// Each step is applied in order; "allow" and "deny" check Allow()
+	tests := []struct {
+		name  string
+		steps []string
+	}{
+		{"closed below threshold", []string{"fail", "fail", "allow", "allow"}},
+		{"opens at threshold", []string{"fail", "fail", "fail", "deny"}},
+		{"success resets the run", []string{"fail", "fail", "success", "fail", "fail", "allow"}},
+		{"single probe after cooldown", []string{"fail", "fail", "fail", "wait", "allow", "deny"}},
+		{"probe success closes", []string{"fail", "fail", "fail", "wait", "allow", "success", "allow", "allow"}},
+		{"probe failure reopens", []string{"fail", "fail", "fail", "wait", "allow", "fail", "deny", "wait", "allow"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker(3, cooldown)
+			for i, step := range tt.steps {
+				switch step {
+				case "fail":
+					cb.RecordFailure()
+				case "success":
+					cb.RecordSuccess()
+				case "wait":
+					time.Sleep(cooldown + 5*time.Millisecond)
+				case "allow", "deny":
+					if got := cb.Allow(); got != (step == "allow") {
+						t.Fatalf("step %d: Allow() = %v, want %v", i, got, step == "allow")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFraudClientPredict(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int // response status per call; the last repeats
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"success", []int{http.StatusOK}, false, 1},
+		{"retries server errors", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, false, 3},
+		{"retries rate limiting", []int{http.StatusTooManyRequests, http.StatusOK}, false, 2},
+		{"gives up after max retries", []int{http.StatusInternalServerError}, true, 3},
+		{"does not retry client errors", []int{http.StatusBadRequest}, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&calls, 1)) - 1
+				if n >= len(tt.statuses) {
+					n = len(tt.statuses) - 1
+				}
+				if r.Header.Get("X-Request-ID") != "txn_1" {
+					t.Errorf("X-Request-ID = %q, want txn_1", r.Header.Get("X-Request-ID"))
+				}
+				w.WriteHeader(tt.statuses[n])
+				if tt.statuses[n] == http.StatusOK {
+					json.NewEncoder(w).Encode(FraudDetectionResponse{TransactionID: "txn_1", RiskScore: 0.42})
+				}
+			}))
+			defer server.Close()
+
+			fc := &FraudClient{
+				baseURL:    server.URL,
+				httpClient: server.Client(),
+				maxRetries: 2,
+				backoff:    time.Millisecond,
+				breaker:    NewCircuitBreaker(5, time.Minute),
+			}
+			resp, err := fc.Predict(context.Background(), "txn_1", FraudDetectionRequest{UserID: "user_001"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Predict error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && resp.RiskScore != 0.42 {
+				t.Errorf("RiskScore = %v, want 0.42", resp.RiskScore)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFraudClientOpenCircuit(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	fc := &FraudClient{
+		baseURL:    server.URL,
+		httpClient: server.Client(),
+		backoff:    time.Millisecond,
+		breaker:    NewCircuitBreaker(2, time.Minute),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := fc.Predict(context.Background(), "txn_1", FraudDetectionRequest{}); err == nil {
+			t.Fatal("Predict succeeded against a failing service")
+		}
+	}
+	if _, err := fc.Predict(context.Background(), "txn_1", FraudDetectionRequest{}); err != ErrCircuitOpen {
+		t.Fatalf("Predict error = %v, want ErrCircuitOpen", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("calls = %d, want 2: an open circuit must not reach the service", got)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// insertFraudLog writes a fraud evaluation inside an existing database transaction
+func insertFraudLog(tx *sql.Tx, entry *FraudLog) error {
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	if entry.DetectedAt.IsZero() {
+		entry.DetectedAt = time.Now()
+	}
+	if entry.RiskFactors == nil {
+		entry.RiskFactors = []string{}
+	}
+
+	query := `
+		INSERT INTO fraud_logs (id, transaction_id, user_id, risk_factors, risk_score, action, reviewed_by, reason, detected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9)
+	`
+	_, err := tx.Exec(query, entry.ID, entry.TransactionID, entry.UserID, pq.Array(entry.RiskFactors), entry.RiskScore, entry.Action, entry.ReviewedBy, entry.Reason, entry.DetectedAt)
+	return err
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// FX rate sources. seed rates ship with db/schema.sql so a new install can
+// take payments in common currencies; replace them with real ones.
+const (
+	FXSourceSeed  = "seed"
+	FXSourceFile  = "file"
+	FXSourceAdmin = "admin"
+)
+
+// fxRateScale is the number of decimal places fx_rates.rate keeps
+const fxRateScale = 12
+
+var (
+	errFXRateUnavailable = errors.New("no exchange rate")
+	errInvalidFXRate     = errors.New("rate must be a decimal greater than 0 with at most 12 decimal places")
+)
+
+// parseFXRate parses a rate such as "0.9215" exactly
+func parseFXRate(s string) (*big.Rat, error) {
+	neg, _, frac, err := splitDecimal(s)
+	if err != nil || neg || len(frac) > fxRateScale {
+		return nil, errInvalidFXRate
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || r.Sign() <= 0 {
+		return nil, errInvalidFXRate
+	}
+	return r, nil
+}
+
+// formatFXRate writes a rate rounded to fxRateScale places, without
+// trailing zeros
+func formatFXRate(r *big.Rat) json.Number {
+	s := strings.TrimRight(r.FloatString(fxRateScale), "0")
+	return json.Number(strings.TrimSuffix(s, "."))
+}
+
+// fxRates holds the current rate for every pair in fx_rates, keyed by base
+// and then quote currency
+type fxRates map[string]map[string]*big.Rat
+
+// queryer is satisfied by *DatabaseConnection, *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func loadFXRates(db queryer, at time.Time) (fxRates, error) {
+	query := `
+		SELECT DISTINCT ON (base_currency, quote_currency) base_currency, quote_currency, rate
+		FROM fx_rates
+		WHERE effective_at <= $1
+		ORDER BY base_currency, quote_currency, effective_at DESC
+	`
+	rows, err := db.Query(query, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := fxRates{}
+	for rows.Next() {
+		var base, quote, value string
+		if err := rows.Scan(&base, &quote, &value); err != nil {
+			return nil, err
+		}
+		r, err := parseFXRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("fx rate %s/%s: %w", base, quote, err)
+		}
+		if rates[base] == nil {
+			rates[base] = map[string]*big.Rat{}
+		}
+		rates[base][quote] = r
+	}
+	return rates, rows.Err()
+}
+
+// direct returns the rate between two currencies when fx_rates quotes that
+// pair either way round
+func (rates fxRates) direct(from, to string) (*big.Rat, bool) {
+	if r, ok := rates[from][to]; ok {
+		return r, true
+	}
+	if r, ok := rates[to][from]; ok {
+		return new(big.Rat).Inv(r), true
+	}
+	return nil, false
+}
+
+// rate returns the number of units of to that one unit of from buys. A pair
+// with no quote of its own is crossed through a currency both are quoted
+// against, such as EUR to GBP through USD.
+func (rates fxRates) rate(from, to string) (*big.Rat, bool) {
+	if from == to {
+		return big.NewRat(1, 1), true
+	}
+	if r, ok := rates.direct(from, to); ok {
+		return r, true
+	}
+
+	seen := map[string]bool{}
+	for base, quotes := range rates {
+		seen[base] = true
+		for quote := range quotes {
+			seen[quote] = true
+		}
+	}
+	pivots := make([]string, 0, len(seen))
+	for currency := range seen {
+		pivots = append(pivots, currency)
+	}
+	sort.Strings(pivots)
+
+	for _, pivot := range pivots {
+		first, ok := rates.direct(from, pivot)
+		if !ok {
+			continue
+		}
+		if second, ok := rates.direct(pivot, to); ok {
+			return new(big.Rat).Mul(first, second), true
+		}
+	}
+	return nil, false
+}
+
+// convert converts an amount into currency at the current rate
+func (rates fxRates) convert(m Money, currency string) (Money, error) {
+	r, ok := rates.rate(m.Currency, currency)
+	if !ok {
+		return Money{}, fmt.Errorf("%w from %s to %s", errFXRateUnavailable, m.Currency, currency)
+	}
+	return m.Convert(r, currency), nil
+}
+
+// Settlement is a payment amount converted into the settlement currency,
+// with the rate that was used
+type Settlement struct {
+	Amount Money
+	Rate   json.Number
+}
+
+// FXService converts payments into the settlement currency and maintains
+// the fx_rates table
+type FXService struct {
+	db                 *DatabaseConnection
+	settlementCurrency string
+}
+
+// NewFXService loads FX_RATES_FILE into fx_rates when it is set
+func NewFXService(db *DatabaseConnection) (*FXService, error) {
+	currency, err := normalizeCurrency(getEnv("SETTLEMENT_CURRENCY", "USD"))
+	if err != nil {
+		return nil, fmt.Errorf("SETTLEMENT_CURRENCY: %w", err)
+	}
+	fx := &FXService{db: db, settlementCurrency: currency}
+
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		saved, err := fx.LoadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("FX_RATES_FILE: %w", err)
+		}
+		log.Printf("Loaded %d new FX rates from %s", saved, path)
+	}
+
+	rates, err := fx.CurrentRates()
+	if err != nil {
+		return nil, fmt.Errorf("loading FX rates: %w", err)
+	}
+	if len(rates) == 0 {
+		log.Printf("WARNING: fx_rates is empty; payments not in %s will be rejected until rates are loaded", currency)
+	}
+	return fx, nil
+}
+
+// CurrentRates returns the rates in effect now
+func (fx *FXService) CurrentRates() (fxRates, error) {
+	return loadFXRates(fx.db, time.Now())
+}
+
+// Settle converts a payment amount into the settlement currency. The rate is
+// rounded to the precision fx_rates keeps before it is applied, so the
+// stored amount can be reproduced from the stored rate.
+func (fx *FXService) Settle(amount Money) (Settlement, error) {
+	rates, err := fx.CurrentRates()
+	if err != nil {
+		return Settlement{}, err
+	}
+	r, ok := rates.rate(amount.Currency, fx.settlementCurrency)
+	if !ok {
+		return Settlement{}, fmt.Errorf("%w from %s to %s", errFXRateUnavailable, amount.Currency, fx.settlementCurrency)
+	}
+	rate := formatFXRate(r)
+	exact, err := parseFXRate(string(rate))
+	if err != nil {
+		return Settlement{}, fmt.Errorf("%w from %s to %s", errFXRateUnavailable, amount.Currency, fx.settlementCurrency)
+	}
+	return Settlement{Amount: amount.Convert(exact, fx.settlementCurrency), Rate: rate}, nil
+}
+
+// FXRateSet is a batch of rates against one base currency, as posted to the
+// admin API or listed in FX_RATES_FILE. Each rate is the number of units of
+// the quote currency one unit of the base currency buys.
+type FXRateSet struct {
+	BaseCurrency string                 `json:"base_currency" binding:"required"`
+	Rates        map[string]json.Number `json:"rates" binding:"required"`
+	EffectiveAt  *time.Time             `json:"effective_at"` // default now
+}
+
+// validate normalizes the currency codes and checks every rate
+func (set *FXRateSet) validate() error {
+	base, err := normalizeCurrency(set.BaseCurrency)
+	if err != nil {
+		return fmt.Errorf("base_currency %q: %w", set.BaseCurrency, err)
+	}
+	if len(set.Rates) == 0 {
+		return errors.New("rates must not be empty")
+	}
+	rates := make(map[string]json.Number, len(set.Rates))
+	for quote, rate := range set.Rates {
+		code, err := normalizeCurrency(quote)
+		if err != nil {
+			return fmt.Errorf("rates %q: %w", quote, err)
+		}
+		if code == base {
+			return fmt.Errorf("rates %q: quote currency must differ from base_currency", quote)
+		}
+		if _, err := parseFXRate(string(rate)); err != nil {
+			return fmt.Errorf("rates %q: %w", quote, err)
+		}
+		rates[code] = rate
+	}
+	set.BaseCurrency, set.Rates = base, rates
+	return nil
+}
+
+// SaveRates inserts a validated rate set into fx_rates. A pair that already
+// has a rate at the same effective_at keeps it, so loading the same file
+// twice changes nothing. It returns the rates that were inserted.
+func (fx *FXService) SaveRates(set FXRateSet, source, createdBy string) ([]FXRate, error) {
+	now := time.Now()
+	effectiveAt := now
+	if set.EffectiveAt != nil {
+		effectiveAt = *set.EffectiveAt
+	}
+
+	quotes := make([]string, 0, len(set.Rates))
+	for quote := range set.Rates {
+		quotes = append(quotes, quote)
+	}
+	sort.Strings(quotes)
+
+	saved := []FXRate{}
+	err := fx.db.WithTransaction(func(tx *sql.Tx) error {
+		query := `
+			INSERT INTO fx_rates (id, base_currency, quote_currency, rate, source, effective_at, created_by, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+			ON CONFLICT (base_currency, quote_currency, effective_at) DO NOTHING
+		`
+		for _, quote := range quotes {
+			r, _ := parseFXRate(string(set.Rates[quote]))
+			rate := FXRate{
+				ID:            uuid.New().String(),
+				BaseCurrency:  set.BaseCurrency,
+				QuoteCurrency: quote,
+				Rate:          formatFXRate(r),
+				Source:        source,
+				EffectiveAt:   effectiveAt,
+				CreatedBy:     createdBy,
+				CreatedAt:     now,
+			}
+			result, err := tx.Exec(query, rate.ID, rate.BaseCurrency, rate.QuoteCurrency, string(rate.Rate), rate.Source, rate.EffectiveAt, rate.CreatedBy, rate.CreatedAt)
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				saved = append(saved, rate)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// LoadFile saves the rate sets in a JSON file holding an array of
+// FXRateSet. Sets without effective_at take the file's modification time,
+// so reloading an unchanged file adds nothing.
+func (fx *FXService) LoadFile(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var sets []FXRateSet
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return 0, err
+	}
+
+	modified := info.ModTime().Truncate(time.Second)
+	total := 0
+	for i := range sets {
+		set := sets[i]
+		if err := set.validate(); err != nil {
+			return total, fmt.Errorf("rate set %d: %w", i, err)
+		}
+		if set.EffectiveAt == nil {
+			set.EffectiveAt = &modified
+		}
+		saved, err := fx.SaveRates(set, FXSourceFile, "")
+		if err != nil {
+			return total, err
+		}
+		total += len(saved)
+	}
+	return total, nil
+}
+
+// ListFXRates lists the rate in effect now for every pair, optionally for
+// one ?base= currency
+func (ah *AdminHandler) ListFXRates(c *gin.Context) {
+	query := `
+		SELECT DISTINCT ON (base_currency, quote_currency) id, base_currency, quote_currency, rate, source, effective_at, COALESCE(created_by, ''), created_at
+		FROM fx_rates
+		WHERE effective_at <= $1 AND ($2::text = '' OR base_currency = $2)
+		ORDER BY base_currency, quote_currency, effective_at DESC
+	`
+	rows, err := ah.db.Query(query, time.Now(), strings.ToUpper(c.Query("base")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch FX rates",
+		})
+		return
+	}
+	defer rows.Close()
+
+	rates := []FXRate{}
+	for rows.Next() {
+		var rate FXRate
+		var value string
+		if err := rows.Scan(&rate.ID, &rate.BaseCurrency, &rate.QuoteCurrency, &value, &rate.Source, &rate.EffectiveAt, &rate.CreatedBy, &rate.CreatedAt); err != nil {
+			continue
+		}
+		if r, err := parseFXRate(value); err == nil {
+			rate.Rate = formatFXRate(r)
+		}
+		rates = append(rates, rate)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rates,
+	})
+}
+
+// CreateFXRates adds a set of rates against one base currency
+func (ah *AdminHandler) CreateFXRates(c *gin.Context) {
+	var set FXRateSet
+	if err := c.ShouldBindJSON(&set); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := set.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	saved, err := ah.fx.SaveRates(set, FXSourceAdmin, c.GetString("admin_user"))
+	if err != nil {
+		log.Printf("Failed to save FX rates for %s: %v", set.BaseCurrency, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to save FX rates",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    saved,
+		Message: fmt.Sprintf("%d FX rates saved", len(saved)),
+	})
+}
+
+// revenue reports revenue in currency, converting other currencies at the
+// rates in effect now
+func (ah *AdminHandler) revenue(currency string) (*RevenueMetrics, error) {
+	rates, err := ah.fx.CurrentRates()
+	if err != nil {
+		return nil, err
+	}
+	return revenueFromLedger(ah.db, rates, currency)
+}
+
+// fxRateUnavailable responds to a conversion with no rate to use
+func fxRateUnavailable(c *gin.Context, err error) {
+	c.JSON(http.StatusUnprocessableEntity, APIResponse{
+		Success: false,
+		Error:   err.Error(),
+		Code:    "fx_rate_unavailable",
+	})
+}
@@ -1,23 +1,30 @@
 package main
 
 import (
-	"fmt"
+	"database/sql"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type TransactionHandler struct {
-	db     *DatabaseConnection
-	broker *MessageBroker
-	cache  *CacheService
+	db        *DatabaseConnection
+	broker    *MessageBroker
+	cache     *CacheService
+	rules     *RulesEngine
+	router    *PaymentRouter
+	processor *PaymentProcessor
+	fx        *FXService
 }
 
-func NewTransactionHandler(db *DatabaseConnection, broker *MessageBroker, cache *CacheService) *TransactionHandler {
-	return &TransactionHandler{db: db, broker: broker, cache: cache}
+func NewTransactionHandler(db *DatabaseConnection, broker *MessageBroker, cache *CacheService, rules *RulesEngine, router *PaymentRouter, processor *PaymentProcessor, fx *FXService) *TransactionHandler {
+	return &TransactionHandler{db: db, broker: broker, cache: cache, rules: rules, router: router, processor: processor, fx: fx}
 }
 
 func (th *TransactionHandler) CreateTransaction(c *gin.Context) {
@@ -29,38 +36,103 @@ func (th *TransactionHandler) CreateTransaction(c *gin.Context) {
 		})
 		return
 	}
+	req.IPAddress = c.ClientIP()
 
 	txnID := uuid.New().String()
 	now := time.Now()
 
-	// Call AI service for fraud detection
-	riskScore, fraudDetected := CallFraudDetectionService(req)
+	// Convert into the settlement currency before anything is stored
+	settlement, err := th.fx.Settle(req.Amount)
+	if errors.Is(err, errFXRateUnavailable) {
+		fxRateUnavailable(c, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to convert %s for transaction %s: %v", req.Currency, txnID, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to create transaction",
+		})
+		return
+	}
+
+	user, err := getUser(th.db, req.UserID)
+	if err == errUserNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "User not found",
+			Code:    "user_not_found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load user %s: %v", req.UserID, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to create transaction",
+		})
+		return
+	}
+
+	if code, reason := userRejection(user); code != "" {
+		th.rejectUser(c, txnID, req, settlement, code, reason, now)
+		return
+	}
 
-	// Determine provider based on routing logic
-	provider := SelectPaymentProvider(req.Amount)
+	// Evaluate fraud rules and the AI service score
+	assessment := th.rules.Evaluate(c.Request.Context(), txnID, req, settlement.Amount, user)
+	action := assessment.Action
 
 	// Prepare transaction data
 	txn := Transaction{
-		ID:            txnID,
-		UserID:        req.UserID,
-		Amount:        req.Amount,
-		Currency:      req.Currency,
-		Status:        "processing",
-		RiskScore:     riskScore,
-		FraudDetected: fraudDetected,
-		Provider:      provider,
-		Description:   req.Description,
-		Metadata:      req.Metadata,
-		CreatedAt:     now,
-		UpdatedAt:     now,
-	}
-
-	// Save to database
-	query := `
-		INSERT INTO transactions (id, user_id, amount, currency, status, risk_score, fraud_detected, provider, description, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-	`
-	if _, err := th.db.ExecuteQuery(query, txn.ID, txn.UserID, txn.Amount, txn.Currency, txn.Status, txn.RiskScore, txn.FraudDetected, txn.Provider, txn.Description, txn.CreatedAt, txn.UpdatedAt); err != nil {
+		ID:                 txnID,
+		UserID:             req.UserID,
+		Amount:             req.Amount,
+		Currency:           req.Currency,
+		Status:             statusForAction(action),
+		RiskScore:          assessment.RiskScore,
+		FraudDetected:      assessment.IsFraud || action == FraudActionBlocked,
+		RiskFactors:        assessment.RiskFactors,
+		MerchantCategory:   req.MerchantCategory,
+		PaymentMethod:      req.PaymentMethod,
+		CaptureMethod:      req.CaptureMethod,
+		SettlementAmount:   settlement.Amount,
+		SettlementCurrency: settlement.Amount.Currency,
+		FXRate:             settlement.Rate,
+		Description:        req.Description,
+		Metadata:           req.Metadata,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+
+	// Only approved transactions are routed to a provider
+	if action == FraudActionApproved {
+		routeTransaction(th.router, &txn)
+	}
+
+	fraudLog := &FraudLog{
+		TransactionID: txn.ID,
+		UserID:        txn.UserID,
+		RiskFactors:   assessment.RiskFactors,
+		RiskScore:     assessment.RiskScore,
+		Action:        action,
+		DetectedAt:    now,
+	}
+
+	// Save transaction and fraud decision atomically
+	err = th.db.WithTransaction(func(tx *sql.Tx) error {
+		if err := insertTransaction(tx, &txn); err != nil {
+			return err
+		}
+		if action == FraudActionManualReview {
+			if err := insertManualReview(tx, txn.ID, now); err != nil {
+				return err
+			}
+		}
+		return insertFraudLog(tx, fraudLog)
+	})
+	if err != nil {
+		log.Printf("Failed to create transaction %s: %v", txnID, err)
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Error:   "Failed to create transaction",
@@ -68,17 +140,65 @@ func (th *TransactionHandler) CreateTransaction(c *gin.Context) {
 		return
 	}
 
-	// Publish to queue for async processing
-	th.broker.PublishEvent("payment.created", txn)
+	// A retry with the same Idempotency-Key must not create a second payment
+	markIdempotentEffects(c)
 
 	// Cache the transaction
 	th.cache.Set(txnID, txn, 5*time.Minute)
 
-	c.JSON(http.StatusCreated, APIResponse{
-		Success: true,
-		Data:    txn,
-		Message: "Transaction created successfully",
-	})
+	switch action {
+	case FraudActionBlocked:
+		th.broker.PublishEvent("payment.blocked", txn)
+		c.JSON(http.StatusCreated, APIResponse{
+			Success: true,
+			Data:    txn,
+			Message: "Transaction blocked by fraud detection",
+		})
+	case FraudActionManualReview:
+		th.broker.PublishEvent("payment.held", txn)
+		c.JSON(http.StatusCreated, APIResponse{
+			Success: true,
+			Data:    txn,
+			Message: "Transaction held for manual review",
+		})
+	default:
+		if txn.Provider == "" {
+			th.broker.PublishEvent("payment.failed", txn)
+			c.JSON(http.StatusServiceUnavailable, APIResponse{
+				Success: false,
+				Data:    txn,
+				Error:   "No payment provider is available for this payment",
+				Code:    txn.FailureCode,
+			})
+			return
+		}
+		if err := th.processor.Submit(c.Request.Context(), &txn); err != nil {
+			// The provider may have charged; the webhook or a later read
+			// of the transaction tells the client how it ended
+			log.Printf("Failed to process transaction %s: %v", txnID, err)
+			c.JSON(http.StatusAccepted, APIResponse{
+				Success: true,
+				Data:    txn,
+				Message: "Payment submitted but its outcome is not recorded yet; fetch the transaction for its status",
+				Code:    "payment_pending",
+			})
+			return
+		}
+		if txn.Status == StatusFailed || txn.Status == StatusBlocked {
+			c.JSON(http.StatusPaymentRequired, APIResponse{
+				Success: false,
+				Data:    txn,
+				Error:   "Payment was declined by the provider",
+				Code:    txn.FailureCode,
+			})
+			return
+		}
+		c.JSON(http.StatusCreated, APIResponse{
+			Success: true,
+			Data:    txn,
+			Message: "Transaction created successfully",
+		})
+	}
 }
 
 func (th *TransactionHandler) GetTransaction(c *gin.Context) {
@@ -93,11 +213,11 @@ func (th *TransactionHandler) GetTransaction(c *gin.Context) {
 		return
 	}
 
-	query := `SELECT id, user_id, amount, currency, status, risk_score, fraud_detected, provider, provider_txn_id, description, created_at, updated_at FROM transactions WHERE id = $1`
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1`
 	row := th.db.QueryRow(query, txnID)
 
 	var txn Transaction
-	err := row.Scan(&txn.ID, &txn.UserID, &txn.Amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.ProviderTxnID, &txn.Description, &txn.CreatedAt, &txn.UpdatedAt)
+	err := scanTransaction(row, &txn)
 	if err != nil {
 		c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
@@ -113,6 +233,26 @@ func (th *TransactionHandler) GetTransaction(c *gin.Context) {
 	})
 }
 
+// requireTransactionOwner reports whether the caller owns the transaction
+// in the path, writing a 404 or 403 response when they do not
+func (th *TransactionHandler) requireTransactionOwner(c *gin.Context) bool {
+	var userID string
+	err := th.db.QueryRow(`SELECT user_id FROM transactions WHERE id = $1`, c.Param("id")).Scan(&userID)
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Transaction not found"})
+		return false
+	case err != nil:
+		log.Printf("Failed to load transaction %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to load transaction"})
+		return false
+	case userID != c.GetString("user_id"):
+		c.JSON(http.StatusForbidden, APIResponse{Success: false, Error: "Unauthorized access"})
+		return false
+	}
+	return true
+}
+
 func (th *TransactionHandler) ListTransactions(c *gin.Context) {
 	limit := 20
 	offset := 0
@@ -129,7 +269,7 @@ func (th *TransactionHandler) ListTransactions(c *gin.Context) {
 		}
 	}
 
-	query := `SELECT id, user_id, amount, currency, status, risk_score, fraud_detected, provider, provider_txn_id, description, created_at, updated_at FROM transactions ORDER BY created_at DESC LIMIT $1 OFFSET $2`
+	query := `SELECT ` + transactionColumns + ` FROM transactions ORDER BY created_at DESC LIMIT $1 OFFSET $2`
 	rows, err := th.db.Query(query, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
@@ -143,7 +283,7 @@ func (th *TransactionHandler) ListTransactions(c *gin.Context) {
 	var transactions []Transaction
 	for rows.Next() {
 		var txn Transaction
-		if err := rows.Scan(&txn.ID, &txn.UserID, &txn.Amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.ProviderTxnID, &txn.Description, &txn.CreatedAt, &txn.UpdatedAt); err != nil {
+		if err := scanTransaction(rows, &txn); err != nil {
 			continue
 		}
 		transactions = append(transactions, txn)
@@ -177,16 +317,16 @@ func (th *TransactionHandler) GetTransactionStatus(c *gin.Context) {
 }
 
 type PaymentProviderHandler struct {
-	db *DatabaseConnection
+	db       *DatabaseConnection
+	registry *ProviderRegistry
 }
 
-func NewPaymentProviderHandler(db *DatabaseConnection) *PaymentProviderHandler {
-	return &PaymentProviderHandler{db: db}
+func NewPaymentProviderHandler(db *DatabaseConnection, registry *ProviderRegistry) *PaymentProviderHandler {
+	return &PaymentProviderHandler{db: db, registry: registry}
 }
 
 func (ph *PaymentProviderHandler) ListProviders(c *gin.Context) {
-	query := `SELECT id, name, fee, status, last_checked FROM payment_providers ORDER BY name`
-	rows, err := ph.db.Query(query)
+	providers, err := listProviderConfigs(ph.db)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -194,16 +334,6 @@ func (ph *PaymentProviderHandler) ListProviders(c *gin.Context) {
 		})
 		return
 	}
-	defer rows.Close()
-
-	var providers []PaymentProvider
-	for rows.Next() {
-		var p PaymentProvider
-		if err := rows.Scan(&p.ID, &p.Name, &p.Fee, &p.Status, &p.LastChecked); err != nil {
-			continue
-		}
-		providers = append(providers, p)
-	}
 
 	c.JSON(http.StatusOK, APIResponse{
 		Success: true,
@@ -211,10 +341,45 @@ func (ph *PaymentProviderHandler) ListProviders(c *gin.Context) {
 	})
 }
 
+// GetProviderRates returns each provider's fees. With ?amount= it also
+// quotes the fee for that amount.
 func (ph *PaymentProviderHandler) GetProviderRates(c *gin.Context) {
-	rates := gin.H{
-		"stripe": gin.H{"fee": 0.029, "fixed": 0.30, "status": "active"},
-		"paypal": gin.H{"fee": 0.034, "fixed": 0.30, "status": "active"},
+	currency, err := normalizeCurrency(c.DefaultQuery("currency", "USD"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "invalid_currency",
+		})
+		return
+	}
+	amount, _ := ParseMoney(c.Query("amount"), currency)
+
+	// Fixed fees are quoted in the payment currency at the current FX rates
+	var current fxRates
+	if amount.IsPositive() {
+		if current, err = loadFXRates(ph.db, time.Now()); err != nil {
+			log.Printf("Failed to load FX rates: %v", err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Error:   "Failed to quote provider fees",
+			})
+			return
+		}
+	}
+
+	rates := gin.H{}
+	for _, cfg := range ph.registry.Configs() {
+		rate := gin.H{"fee": cfg.Fee, "fixed": cfg.FixedFee, "fixed_currency": cfg.FixedFeeCurrency, "status": cfg.Status}
+		if provider, ok := ph.registry.Get(cfg.Code); ok && amount.IsPositive() {
+			quote, err := provider.FeeQuote(amount, current)
+			if err != nil {
+				fxRateUnavailable(c, err)
+				return
+			}
+			rate["quote"] = quote
+		}
+		rates[cfg.Code] = rate
 	}
 
 	c.JSON(http.StatusOK, APIResponse{
@@ -224,15 +389,52 @@ func (ph *PaymentProviderHandler) GetProviderRates(c *gin.Context) {
 }
 
 type AdminHandler struct {
-	db *DatabaseConnection
+	db         *DatabaseConnection
+	broker     *MessageBroker
+	cache      *CacheService
+	processor  *PaymentProcessor
+	rules      *RulesEngine
+	router     *PaymentRouter
+	webhooks   *WebhookProcessor
+	fx         *FXService
+	reconciler *Reconciler
+
+	// reportingCurrency is the currency revenue is reported in by default
+	reportingCurrency string
+}
+
+func NewAdminHandler(db *DatabaseConnection, broker *MessageBroker, cache *CacheService, processor *PaymentProcessor, rules *RulesEngine, router *PaymentRouter, webhooks *WebhookProcessor, fx *FXService, reconciler *Reconciler) *AdminHandler {
+	reportingCurrency, err := normalizeCurrency(getEnv("REPORTING_CURRENCY", fx.settlementCurrency))
+	if err != nil {
+		log.Printf("Ignoring REPORTING_CURRENCY: %v", err)
+		reportingCurrency = fx.settlementCurrency
+	}
+	return &AdminHandler{db: db, broker: broker, cache: cache, processor: processor, rules: rules, router: router, webhooks: webhooks, fx: fx, reconciler: reconciler,
+		reportingCurrency: reportingCurrency}
 }
 
-func NewAdminHandler(db *DatabaseConnection) *AdminHandler {
-	return &AdminHandler{db: db}
+// baseCurrency reads the ?currency= figures are reported in, defaulting to
+// REPORTING_CURRENCY. It responds with 400 and returns false when the
+// currency is not an ISO 4217 code.
+func (ah *AdminHandler) baseCurrency(c *gin.Context) (string, bool) {
+	currency, err := normalizeCurrency(c.DefaultQuery("currency", ah.reportingCurrency))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "invalid_currency",
+		})
+		return "", false
+	}
+	return currency, true
 }
 
 func (ah *AdminHandler) GetDashboardStats(c *gin.Context) {
-	stats := &DashboardStats{}
+	currency, ok := ah.baseCurrency(c)
+	if !ok {
+		return
+	}
+	stats := &DashboardStats{Currency: currency}
 
 	// Get total transactions
 	query := `SELECT COUNT(*) FROM transactions`
@@ -242,9 +444,17 @@ func (ah *AdminHandler) GetDashboardStats(c *gin.Context) {
 	query = `SELECT COUNT(*) FROM transactions WHERE status = 'blocked'`
 	ah.db.QueryRow(query).Scan(&stats.BlockedTransactions)
 
-	// Get total revenue
-	query = `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE status = 'completed'`
-	ah.db.QueryRow(query).Scan(&stats.TotalRevenue)
+	// Get transactions held for manual review
+	query = `SELECT COUNT(*) FROM transactions WHERE status = 'held'`
+	ah.db.QueryRow(query).Scan(&stats.HeldTransactions)
+
+	// Get total revenue, net of refunds, dispute losses and fees
+	stats.TotalRevenue = NewMoney(0, currency)
+	if revenue, err := ah.revenue(currency); err == nil {
+		stats.TotalRevenue = revenue.TotalRevenue
+	} else {
+		log.Printf("Failed to compute revenue in %s: %v", currency, err)
+	}
 
 	// Get average risk score
 	query = `SELECT COALESCE(AVG(risk_score), 0) FROM transactions`
@@ -252,7 +462,7 @@ func (ah *AdminHandler) GetDashboardStats(c *gin.Context) {
 
 	if stats.TotalTransactions > 0 {
 		stats.FraudPreventionRate = (float64(stats.BlockedTransactions) / float64(stats.TotalTransactions)) * 100
-		successCount := stats.TotalTransactions - stats.BlockedTransactions
+		successCount := stats.TotalTransactions - stats.BlockedTransactions - stats.HeldTransactions
 		stats.TransactionSuccessRate = (float64(successCount) / float64(stats.TotalTransactions)) * 100
 	}
 
@@ -263,7 +473,7 @@ func (ah *AdminHandler) GetDashboardStats(c *gin.Context) {
 }
 
 func (ah *AdminHandler) GetBlockedTransactions(c *gin.Context) {
-	query := `SELECT id, user_id, amount, currency, status, risk_score, fraud_detected, provider, created_at FROM transactions WHERE status = 'blocked' ORDER BY created_at DESC LIMIT 50`
+	query := `SELECT id, user_id, amount, currency, status, risk_score, fraud_detected, COALESCE(provider, ''), created_at FROM transactions WHERE status = 'blocked' ORDER BY created_at DESC LIMIT 50`
 	rows, err := ah.db.Query(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
@@ -277,9 +487,11 @@ func (ah *AdminHandler) GetBlockedTransactions(c *gin.Context) {
 	var transactions []Transaction
 	for rows.Next() {
 		var txn Transaction
-		if err := rows.Scan(&txn.ID, &txn.UserID, &txn.Amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.CreatedAt); err != nil {
+		var amount moneyColumn
+		if err := rows.Scan(&txn.ID, &txn.UserID, &amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.CreatedAt); err != nil {
 			continue
 		}
+		txn.Amount, _ = amount.money(txn.Currency)
 		transactions = append(transactions, txn)
 	}
 
@@ -290,17 +502,21 @@ func (ah *AdminHandler) GetBlockedTransactions(c *gin.Context) {
 }
 
 func (ah *AdminHandler) GetRevenueMetrics(c *gin.Context) {
-	metrics := &RevenueMetrics{}
-
-	query := `SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transactions WHERE provider = 'stripe' AND status = 'completed'`
-	ah.db.QueryRow(query).Scan(&metrics.StripeRevenue, &metrics.TransactionCount)
-
-	query = `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE provider = 'paypal' AND status = 'completed'`
-	ah.db.QueryRow(query).Scan(&metrics.PayPalRevenue)
-
-	metrics.TotalRevenue = metrics.StripeRevenue + metrics.PayPalRevenue
-	if metrics.TransactionCount > 0 {
-		metrics.AveragePerTxn = metrics.TotalRevenue / float64(metrics.TransactionCount)
+	currency, ok := ah.baseCurrency(c)
+	if !ok {
+		return
+	}
+	metrics, err := ah.revenue(currency)
+	if errors.Is(err, errFXRateUnavailable) {
+		fxRateUnavailable(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch revenue metrics",
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, APIResponse{
@@ -310,7 +526,7 @@ func (ah *AdminHandler) GetRevenueMetrics(c *gin.Context) {
 }
 
 func (ah *AdminHandler) GetFraudLogs(c *gin.Context) {
-	query := `SELECT id, transaction_id, user_id, risk_score, action, detected_at FROM fraud_logs ORDER BY detected_at DESC LIMIT 100`
+	query := `SELECT id, transaction_id, user_id, risk_factors, risk_score, action, COALESCE(reviewed_by, ''), COALESCE(reason, ''), detected_at FROM fraud_logs ORDER BY detected_at DESC LIMIT 100`
 	rows, err := ah.db.Query(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
@@ -324,7 +540,7 @@ func (ah *AdminHandler) GetFraudLogs(c *gin.Context) {
 	var logs []FraudLog
 	for rows.Next() {
 		var log FraudLog
-		if err := rows.Scan(&log.ID, &log.TransactionID, &log.UserID, &log.RiskScore, &log.Action, &log.DetectedAt); err != nil {
+		if err := rows.Scan(&log.ID, &log.TransactionID, &log.UserID, pq.Array(&log.RiskFactors), &log.RiskScore, &log.Action, &log.ReviewedBy, &log.Reason, &log.DetectedAt); err != nil {
 			continue
 		}
 		logs = append(logs, log)
@@ -335,44 +551,3 @@ func (ah *AdminHandler) GetFraudLogs(c *gin.Context) {
 		Data:    logs,
 	})
 }
-
-type WebhookHandler struct {
-	db     *DatabaseConnection
-	broker *MessageBroker
-}
-
-func NewWebhookHandler(db *DatabaseConnection, broker *MessageBroker) *WebhookHandler {
-	return &WebhookHandler{db: db, broker: broker}
-}
-
-func (wh *WebhookHandler) HandleStripeWebhook(c *gin.Context) {
-	var payload map[string]interface{}
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
-		return
-	}
-
-	txnID := fmt.Sprintf("%v", payload["metadata"].(map[string]interface{})["txn_id"])
-	status := fmt.Sprintf("%v", payload["status"])
-
-	query := `UPDATE transactions SET status = $1, updated_at = $2 WHERE id = $3`
-	wh.db.ExecuteQuery(query, status, time.Now(), txnID)
-
-	c.JSON(http.StatusOK, APIResponse{Success: true})
-}
-
-func (wh *WebhookHandler) HandlePayPalWebhook(c *gin.Context) {
-	var payload map[string]interface{}
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
-		return
-	}
-
-	txnID := fmt.Sprintf("%v", payload["txn_id"])
-	status := fmt.Sprintf("%v", payload["status"])
-
-	query := `UPDATE transactions SET status = $1, updated_at = $2 WHERE id = $3`
-	wh.db.ExecuteQuery(query, status, time.Now(), txnID)
-
-	c.JSON(http.StatusOK, APIResponse{Success: true})
-}
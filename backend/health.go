@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ProviderStatusChange is published as provider.status_changed
+type ProviderStatusChange struct {
+	Provider       string    `json:"provider"`
+	PreviousStatus string    `json:"previous_status"`
+	Status         string    `json:"status"`
+	Reason         string    `json:"reason"`
+	CheckedAt      time.Time `json:"checked_at"`
+}
+
+// ProviderHealthChecker periodically probes every provider and records the
+// result in payment_providers.status and last_checked. A provider whose
+// health check fails is degraded, and down after repeated failures. A
+// healthy provider is degraded while its recent payment_attempts show a
+// high rate of provider errors.
+type ProviderHealthChecker struct {
+	db              *DatabaseConnection
+	broker          *MessageBroker
+	registry        *ProviderRegistry
+	timeout         time.Duration
+	downAfter       int
+	errorWindow     time.Duration
+	errorMinSamples int
+	degradedRate    float64
+	failures        map[string]int
+}
+
+func NewProviderHealthChecker(db *DatabaseConnection, broker *MessageBroker, registry *ProviderRegistry) *ProviderHealthChecker {
+	hc := &ProviderHealthChecker{
+		db:              db,
+		broker:          broker,
+		registry:        registry,
+		timeout:         getEnvDuration("PROVIDER_HEALTH_TIMEOUT", 5*time.Second),
+		downAfter:       getEnvInt("PROVIDER_DOWN_AFTER", 3),
+		errorWindow:     getEnvDuration("PROVIDER_ERROR_WINDOW", 5*time.Minute),
+		errorMinSamples: getEnvInt("PROVIDER_ERROR_MIN_SAMPLES", 10),
+		degradedRate:    getEnvFloat("PROVIDER_DEGRADED_ERROR_RATE", 0.2),
+		failures:        make(map[string]int),
+	}
+
+	go hc.run(getEnvDuration("PROVIDER_HEALTH_INTERVAL", 30*time.Second))
+	return hc
+}
+
+func (hc *ProviderHealthChecker) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hc.CheckAll()
+	for range ticker.C {
+		hc.CheckAll()
+	}
+}
+
+// CheckAll probes every configured provider once
+func (hc *ProviderHealthChecker) CheckAll() {
+	for _, cfg := range hc.registry.Configs() {
+		if cfg.Status == ProviderDisabled {
+			continue
+		}
+		provider, ok := hc.registry.Get(cfg.Code)
+		if !ok {
+			continue
+		}
+
+		status, reason := hc.check(cfg.Code, provider)
+		if err := hc.record(cfg, status, reason); err != nil {
+			log.Printf("Failed to record health of provider %s: %v", cfg.Code, err)
+		}
+	}
+
+	// Routing sees the new statuses without waiting for its own refresh
+	if err := hc.registry.Load(); err != nil {
+		log.Printf("Failed to reload payment providers: %v", err)
+	}
+}
+
+// check returns the status a provider should have and why
+func (hc *ProviderHealthChecker) check(code string, provider PaymentProvider) (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+
+	if err := provider.HealthCheck(ctx); err != nil {
+		hc.failures[code]++
+		if hc.failures[code] >= hc.downAfter {
+			return ProviderDown, fmt.Sprintf("health check failed %d times: %v", hc.failures[code], err)
+		}
+		return ProviderDegraded, fmt.Sprintf("health check failed: %v", err)
+	}
+	hc.failures[code] = 0
+
+	failed, total, err := hc.recentErrors(code)
+	if err != nil {
+		log.Printf("Failed to read recent attempts for provider %s: %v", code, err)
+		return ProviderActive, "health check passed"
+	}
+	if total >= hc.errorMinSamples {
+		rate := float64(failed) / float64(total)
+		if rate >= hc.degradedRate {
+			return ProviderDegraded, fmt.Sprintf("%.0f%% of %d recent attempts hit provider errors", rate*100, total)
+		}
+	}
+	return ProviderActive, "health check passed"
+}
+
+// recentErrors counts provider errors and timeouts among recent attempts
+func (hc *ProviderHealthChecker) recentErrors(code string) (int, int, error) {
+	var failed, total int
+	query := `
+		SELECT COUNT(*) FILTER (WHERE error_code IN ('provider_error', 'provider_timeout')), COUNT(*)
+		FROM payment_attempts
+		WHERE provider = $1 AND created_at > $2
+	`
+	err := hc.db.QueryRow(query, code, time.Now().Add(-hc.errorWindow)).Scan(&failed, &total)
+	return failed, total, err
+}
+
+// record writes the check result and publishes provider.status_changed
+// when the status moved. The status update is conditional on the previous
+// value so only one replica publishes each change.
+func (hc *ProviderHealthChecker) record(cfg ProviderConfig, status, reason string) error {
+	now := time.Now()
+
+	if status != cfg.Status {
+		query := `UPDATE payment_providers SET status = $1, last_checked = $2 WHERE id = $3 AND status = $4`
+		result, err := hc.db.ExecuteQuery(query, status, now, cfg.ID, cfg.Status)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			log.Printf("Provider %s is now %s (was %s): %s", cfg.Code, status, cfg.Status, reason)
+			hc.broker.PublishEvent("provider.status_changed", ProviderStatusChange{
+				Provider:       cfg.Code,
+				PreviousStatus: cfg.Status,
+				Status:         status,
+				Reason:         reason,
+				CheckedAt:      now,
+			})
+			return nil
+		}
+	}
+
+	query := `UPDATE payment_providers SET last_checked = $1 WHERE id = $2 AND status <> $3`
+	_, err := hc.db.ExecuteQuery(query, now, cfg.ID, ProviderDisabled)
+	return err
+}
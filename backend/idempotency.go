@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idempotency key states
+const (
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+)
+
+// idempotencyEffectsKey is set on a request once it has changed state, such
+// as storing a transaction or calling a provider. Its response is then kept
+// even on a server error, so a retry cannot repeat the change.
+const idempotencyEffectsKey = "idempotency_effects"
+
+// markIdempotentEffects records that the request can no longer be retried
+// from scratch
+func markIdempotentEffects(c *gin.Context) {
+	c.Set(idempotencyEffectsKey, true)
+}
+
+// IdempotencyStore persists Idempotency-Key results in Postgres so retries
+// are answered consistently across restarts and replicas
+type IdempotencyStore struct {
+	db          *DatabaseConnection
+	ttl         time.Duration
+	lockTimeout time.Duration
+}
+
+func NewIdempotencyStore(db *DatabaseConnection) *IdempotencyStore {
+	is := &IdempotencyStore{
+		db:  db,
+		ttl: getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		// A request that crashed mid-flight releases its key after this long
+		lockTimeout: getEnvDuration("IDEMPOTENCY_LOCK_TIMEOUT", 1*time.Minute),
+	}
+
+	go is.cleanupExpired()
+	return is
+}
+
+type idempotencyRecord struct {
+	requestHash  string
+	status       string
+	responseCode int
+	responseBody []byte
+	createdAt    time.Time
+	expiresAt    time.Time
+}
+
+// acquire claims key for a new request. It returns the existing record, or
+// nil when the caller now owns the key and should process the request.
+func (is *IdempotencyStore) acquire(scope, key, requestHash string) (*idempotencyRecord, error) {
+	now := time.Now()
+	query := `
+		INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, status, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (scope, idempotency_key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = EXCLUDED.status, response_code = NULL, response_body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < $5
+			OR (idempotency_keys.status = $4 AND idempotency_keys.created_at < $7)
+	`
+	result, err := is.db.ExecuteQuery(query, scope, key, requestHash, idempotencyInProgress, now, now.Add(is.ttl), now.Add(-is.lockTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	var rec idempotencyRecord
+	var code sql.NullInt64
+	query = `SELECT request_hash, status, response_code, response_body, created_at, expires_at FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`
+	if err := is.db.QueryRow(query, scope, key).Scan(&rec.requestHash, &rec.status, &code, &rec.responseBody, &rec.createdAt, &rec.expiresAt); err != nil {
+		return nil, err
+	}
+	rec.responseCode = int(code.Int64)
+	return &rec, nil
+}
+
+func (is *IdempotencyStore) complete(scope, key string, code int, body []byte) error {
+	query := `UPDATE idempotency_keys SET status = $1, response_code = $2, response_body = $3 WHERE scope = $4 AND idempotency_key = $5`
+	_, err := is.db.ExecuteQuery(query, idempotencyCompleted, code, body, scope, key)
+	return err
+}
+
+func (is *IdempotencyStore) release(scope, key string) error {
+	_, err := is.db.ExecuteQuery(`DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`, scope, key)
+	return err
+}
+
+func (is *IdempotencyStore) cleanupExpired() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := is.db.ExecuteQuery(`DELETE FROM idempotency_keys WHERE expires_at < $1`, time.Now()); err != nil {
+			log.Printf("Failed to clean up idempotency keys: %v", err)
+		}
+	}
+}
+
+// responseRecorder tees the response body so it can be stored for replay
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware honours the Idempotency-Key header. Replaying a key
+// with the same body returns the original response; reusing it with a
+// different body is rejected with 422. Keys are scoped to the caller.
+func IdempotencyMiddleware(store *IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Idempotency-Key must be at most 255 characters",
+			})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Failed to read request body",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+		scope := c.GetString("user_id")
+
+		existing, err := store.acquire(scope, key, requestHash)
+		if err != nil {
+			log.Printf("Failed to acquire idempotency key: %v", err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Error:   "Failed to process idempotency key",
+			})
+			c.Abort()
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.requestHash != requestHash:
+				c.JSON(http.StatusUnprocessableEntity, APIResponse{
+					Success: false,
+					Error:   "Idempotency-Key was already used with a different request body",
+					Code:    "idempotency_key_reused",
+				})
+			case existing.status != idempotencyCompleted:
+				c.JSON(http.StatusConflict, APIResponse{
+					Success: false,
+					Error:   "A request with this Idempotency-Key is still in progress",
+					Code:    "idempotency_key_in_progress",
+				})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.responseCode, "application/json; charset=utf-8", existing.responseBody)
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = recorder
+		c.Next()
+
+		// Server errors are not stored so the client can retry them, unless
+		// the request already changed something a retry would repeat
+		if c.Writer.Status() >= http.StatusInternalServerError && !c.GetBool(idempotencyEffectsKey) {
+			if err := store.release(scope, key); err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+			return
+		}
+		if err := store.complete(scope, key, c.Writer.Status(), recorder.body.Bytes()); err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Ledger account codes. Provider receivables are per provider, for example
+// provider_receivable:stripe, and hold what the provider owes us until payout.
+const (
+	AccountProviderReceivable = "provider_receivable"
+	AccountRevenue            = "revenue"
+	AccountRefunds            = "refunds"
+	AccountProviderFees       = "provider_fees"
+	AccountDisputeLosses      = "dispute_losses"
+)
+
+// Journal entry reference types
+const (
+	EntryCapture         = "capture"
+	EntryCaptureReversal = "capture_reversal"
+	EntryRefund          = "refund"
+	EntryDisputeLoss     = "dispute_loss"
+)
+
+var errUnbalancedEntry = errors.New("journal entry does not balance")
+
+// ledgerAccountTypes gives the name and type of each fixed account. Refunds
+// is a contra-revenue account, so it carries a debit balance.
+var ledgerAccountTypes = map[string][2]string{
+	AccountRevenue:       {"Revenue", "revenue"},
+	AccountRefunds:       {"Refunds", "revenue"},
+	AccountProviderFees:  {"Provider fees", "expense"},
+	AccountDisputeLosses: {"Dispute losses", "expense"},
+}
+
+func receivableAccount(provider string) string {
+	return AccountProviderReceivable + ":" + provider
+}
+
+// ledgerAccountID returns the ID of an account in a currency, creating the
+// account the first time it is used
+func ledgerAccountID(tx *sql.Tx, code, currency string) (string, error) {
+	name, accountType := "Receivable from "+strings.TrimPrefix(code, AccountProviderReceivable+":"), "asset"
+	if t, ok := ledgerAccountTypes[code]; ok {
+		name, accountType = t[0], t[1]
+	}
+
+	query := `
+		INSERT INTO ledger_accounts (id, code, name, type, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (code, currency) DO NOTHING
+	`
+	if _, err := tx.Exec(query, uuid.New().String(), code, name, accountType, currency, time.Now()); err != nil {
+		return "", err
+	}
+	var id string
+	err := tx.QueryRow(`SELECT id FROM ledger_accounts WHERE code = $1 AND currency = $2`, code, currency).Scan(&id)
+	return id, err
+}
+
+// ledgerLine is one posting of an entry about to be written
+type ledgerLine struct {
+	Account string
+	Amount  Money
+}
+
+// postJournalEntry writes an entry and its postings. Entries are keyed by
+// their reference, so posting the same movement twice is a no-op; it reports
+// whether the entry was written. Zero lines are dropped.
+func postJournalEntry(tx *sql.Tx, entry *JournalEntry, lines []ledgerLine) (bool, error) {
+	sum := NewMoney(0, entry.Currency)
+	for _, l := range lines {
+		sum = sum.Add(l.Amount)
+	}
+	if !sum.IsZero() {
+		return false, errUnbalancedEntry
+	}
+
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now()
+	query := `
+		INSERT INTO journal_entries (id, transaction_id, provider, reference_type, reference_id, currency, description, created_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, NULLIF($7, ''), $8)
+		ON CONFLICT (reference_type, reference_id) DO NOTHING
+	`
+	result, err := tx.Exec(query, entry.ID, entry.TransactionID, entry.Provider, entry.ReferenceType, entry.ReferenceID,
+		entry.Currency, entry.Description, entry.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	for _, l := range lines {
+		if l.Amount.IsZero() {
+			continue
+		}
+		accountID, err := ledgerAccountID(tx, l.Account, entry.Currency)
+		if err != nil {
+			return false, err
+		}
+		query = `INSERT INTO ledger_postings (id, entry_id, account_id, amount, created_at) VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.Exec(query, uuid.New().String(), entry.ID, accountID, l.Amount, entry.CreatedAt); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// providerFee returns what the provider charges for capturing amount, from
+// the fees configured in payment_providers and the current FX rates
+func providerFee(tx *sql.Tx, provider string, amount Money) (Money, error) {
+	var fees FeeSchedule
+	var fixed moneyColumn
+	var fixedCurrency string
+	query := `SELECT fee, fixed_fee, fixed_fee_currency FROM payment_providers WHERE code = $1`
+	err := tx.QueryRow(query, provider).Scan(&fees.Percentage, &fixed, &fixedCurrency)
+	if err == sql.ErrNoRows {
+		return NewMoney(0, amount.Currency), nil
+	}
+	if err != nil {
+		return Money{}, err
+	}
+	if fees.Fixed, err = fixed.money(fixedCurrency); err != nil {
+		return Money{}, err
+	}
+	rates, err := loadFXRates(tx, time.Now())
+	if err != nil {
+		return Money{}, err
+	}
+	quote, err := fees.FeeQuote(amount, rates)
+	if err != nil {
+		return Money{}, err
+	}
+	return quote.Total, nil
+}
+
+// postCapture records the captured amount as revenue owed by the provider,
+// less the provider's fee
+func postCapture(tx *sql.Tx, txn *Transaction) error {
+	if !txn.CapturedAmount.IsPositive() || txn.Provider == "" {
+		return nil
+	}
+	fee, err := providerFee(tx, txn.Provider, txn.CapturedAmount)
+	if err != nil {
+		return err
+	}
+	_, err = postJournalEntry(tx, &JournalEntry{
+		TransactionID: txn.ID,
+		Provider:      txn.Provider,
+		ReferenceType: EntryCapture,
+		ReferenceID:   txn.ID,
+		Currency:      txn.Currency,
+		Description:   "Capture of " + txn.ID,
+	}, []ledgerLine{
+		{receivableAccount(txn.Provider), txn.CapturedAmount.Sub(fee)},
+		{AccountProviderFees, fee},
+		{AccountRevenue, txn.CapturedAmount.Neg()},
+	})
+	return err
+}
+
+// reverseCapture undoes the capture entry of a transaction whose capture
+// later failed
+func reverseCapture(tx *sql.Tx, txn *Transaction) error {
+	query := `
+		SELECT a.code, p.amount
+		FROM ledger_postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE e.reference_type = $1 AND e.reference_id = $2
+	`
+	rows, err := tx.Query(query, EntryCapture, txn.ID)
+	if err != nil {
+		return err
+	}
+	lines := []ledgerLine{}
+	for rows.Next() {
+		var account string
+		var amount moneyColumn
+		if err := rows.Scan(&account, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		m, err := amount.money(txn.Currency)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		lines = append(lines, ledgerLine{account, m.Neg()})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(lines) == 0 {
+		return err
+	}
+
+	_, err = postJournalEntry(tx, &JournalEntry{
+		TransactionID: txn.ID,
+		Provider:      txn.Provider,
+		ReferenceType: EntryCaptureReversal,
+		ReferenceID:   txn.ID,
+		Currency:      txn.Currency,
+		Description:   "Reversal of failed capture of " + txn.ID,
+	}, lines)
+	return err
+}
+
+// outstandingRevenue is the revenue recorded for a transaction that has not
+// yet been given back through a refund or a lost dispute
+func outstandingRevenue(tx *sql.Tx, txn *Transaction) (Money, error) {
+	var outstanding moneyColumn
+	query := `
+		SELECT COALESCE(-SUM(p.amount), 0)
+		FROM ledger_postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE e.transaction_id = $1 AND a.code IN ($2, $3, $4)
+	`
+	if err := tx.QueryRow(query, txn.ID, AccountRevenue, AccountRefunds, AccountDisputeLosses).Scan(&outstanding); err != nil {
+		return Money{}, err
+	}
+	return outstanding.money(txn.Currency)
+}
+
+// postPayback records money going back to the payer, through a refund or a
+// lost dispute, as owed to the provider. It never gives back more than the
+// transaction's outstanding revenue. Provider fees are not returned.
+func postPayback(tx *sql.Tx, txn *Transaction, account, referenceType, referenceID string, amount Money) error {
+	outstanding, err := outstandingRevenue(tx, txn)
+	if err != nil {
+		return err
+	}
+	amount = amount.Min(outstanding)
+	if !amount.IsPositive() {
+		return nil
+	}
+
+	_, err = postJournalEntry(tx, &JournalEntry{
+		TransactionID: txn.ID,
+		Provider:      txn.Provider,
+		ReferenceType: referenceType,
+		ReferenceID:   referenceID,
+		Currency:      txn.Currency,
+		Description:   strings.Replace(referenceType, "_", " ", -1) + " " + referenceID + " on " + txn.ID,
+	}, []ledgerLine{
+		{account, amount},
+		{receivableAccount(txn.Provider), amount.Neg()},
+	})
+	return err
+}
+
+// postStatusChange keeps the ledger in step with a status change made by
+// setTransactionStatus. A transaction refunded outside our refunds API, for
+// example from the provider dashboard, gives back whatever is outstanding.
+func postStatusChange(tx *sql.Tx, txn *Transaction, previous string) error {
+	switch txn.Status {
+	case StatusCaptured, StatusCompleted:
+		return postCapture(tx, txn)
+	case StatusFailed:
+		if previous == StatusCaptured {
+			return reverseCapture(tx, txn)
+		}
+	case StatusRefunded:
+		return postPayback(tx, txn, AccountRefunds, EntryRefund, txn.ID, txn.CapturedAmount)
+	}
+	return nil
+}
+
+// revenueFromLedger sums the revenue and expense accounts per provider,
+// converting each currency's totals into currency at rates
+func revenueFromLedger(db *DatabaseConnection, rates fxRates, currency string) (*RevenueMetrics, error) {
+	zero := NewMoney(0, currency)
+	metrics := &RevenueMetrics{
+		Currency:      zero.Currency,
+		GrossRevenue:  zero,
+		Refunds:       zero,
+		DisputeLosses: zero,
+		ProviderFees:  zero,
+		StripeRevenue: zero,
+		PayPalRevenue: zero,
+		TotalRevenue:  zero,
+		AveragePerTxn: zero,
+	}
+	query := `
+		SELECT e.currency, COALESCE(e.provider, ''), a.code, SUM(p.amount)
+		FROM ledger_postings p
+		JOIN journal_entries e ON e.id = p.entry_id
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE a.type IN ('revenue', 'expense')
+		GROUP BY e.currency, e.provider, a.code
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entryCurrency, provider, code string
+		var total moneyColumn
+		if err := rows.Scan(&entryCurrency, &provider, &code, &total); err != nil {
+			return nil, err
+		}
+		original, err := total.money(entryCurrency)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := rates.convert(original, metrics.Currency)
+		if err != nil {
+			return nil, err
+		}
+		// Income is credit-normal and expenses debit-normal, so each
+		// account adds the negation of its balance to net revenue
+		net := sum.Neg()
+		switch code {
+		case AccountRevenue:
+			metrics.GrossRevenue = metrics.GrossRevenue.Add(net)
+		case AccountRefunds:
+			metrics.Refunds = metrics.Refunds.Add(sum)
+		case AccountDisputeLosses:
+			metrics.DisputeLosses = metrics.DisputeLosses.Add(sum)
+		case AccountProviderFees:
+			metrics.ProviderFees = metrics.ProviderFees.Add(sum)
+		}
+		switch provider {
+		case "stripe":
+			metrics.StripeRevenue = metrics.StripeRevenue.Add(net)
+		case "paypal":
+			metrics.PayPalRevenue = metrics.PayPalRevenue.Add(net)
+		}
+		metrics.TotalRevenue = metrics.TotalRevenue.Add(net)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT COUNT(*) FILTER (WHERE reference_type = $1) - COUNT(*) FILTER (WHERE reference_type = $2)
+		FROM journal_entries
+	`
+	if err := db.QueryRow(query, EntryCapture, EntryCaptureReversal).Scan(&metrics.TransactionCount); err != nil {
+		return nil, err
+	}
+	if metrics.TransactionCount > 0 {
+		metrics.AveragePerTxn = metrics.TotalRevenue.Div(metrics.TransactionCount)
+	}
+	return metrics, nil
+}
+
+func listJournalEntries(db *DatabaseConnection, txnID string, limit int) ([]JournalEntry, error) {
+	query := `
+		SELECT e.id, COALESCE(e.transaction_id, ''), COALESCE(e.provider, ''), e.reference_type, e.reference_id, e.currency, COALESCE(e.description, ''), e.created_at,
+			p.id, a.code, p.amount
+		FROM (
+			SELECT * FROM journal_entries
+			WHERE $1::text = '' OR transaction_id = $1
+			ORDER BY created_at DESC
+			LIMIT $2
+		) e
+		JOIN ledger_postings p ON p.entry_id = e.id
+		JOIN ledger_accounts a ON a.id = p.account_id
+		ORDER BY e.created_at DESC, e.id, p.amount DESC
+	`
+	rows, err := db.Query(query, txnID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []JournalEntry{}
+	for rows.Next() {
+		var e JournalEntry
+		var p LedgerPosting
+		var amount moneyColumn
+		if err := rows.Scan(&e.ID, &e.TransactionID, &e.Provider, &e.ReferenceType, &e.ReferenceID, &e.Currency, &e.Description, &e.CreatedAt,
+			&p.ID, &p.AccountCode, &amount); err != nil {
+			return nil, err
+		}
+		var err error
+		if p.Amount, err = amount.money(e.Currency); err != nil {
+			return nil, err
+		}
+		if n := len(entries); n == 0 || entries[n-1].ID != e.ID {
+			e.Postings = []LedgerPosting{}
+			entries = append(entries, e)
+		}
+		last := &entries[len(entries)-1]
+		last.Postings = append(last.Postings, p)
+	}
+	return entries, rows.Err()
+}
+
+// ListLedgerAccounts lists every ledger account with its balance
+func (ah *AdminHandler) ListLedgerAccounts(c *gin.Context) {
+	query := `
+		SELECT a.id, a.code, a.name, a.type, a.currency, COALESCE(SUM(p.amount), 0), a.created_at
+		FROM ledger_accounts a
+		LEFT JOIN ledger_postings p ON p.account_id = a.id
+		WHERE $1::text = '' OR a.currency = $1
+		GROUP BY a.id
+		ORDER BY a.currency, a.code
+	`
+	rows, err := ah.db.Query(query, strings.ToUpper(c.Query("currency")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch ledger accounts",
+		})
+		return
+	}
+	defer rows.Close()
+
+	accounts := []LedgerAccount{}
+	for rows.Next() {
+		var a LedgerAccount
+		var balance moneyColumn
+		if err := rows.Scan(&a.ID, &a.Code, &a.Name, &a.Type, &a.Currency, &balance, &a.CreatedAt); err != nil {
+			continue
+		}
+		a.Balance, _ = balance.money(a.Currency)
+		accounts = append(accounts, a)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    accounts,
+	})
+}
+
+// ListJournalEntries lists journal entries with their postings, newest
+// first, optionally for one ?transaction_id=
+func (ah *AdminHandler) ListJournalEntries(c *gin.Context) {
+	entries, err := listJournalEntries(ah.db, c.Query("transaction_id"), 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch journal entries",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    entries,
+	})
+}
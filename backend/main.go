@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"log"
 	"net/http"
 	"os"
@@ -12,11 +11,19 @@ import (
 )
 
 type Application struct {
-	server   *http.Server
-	router   *gin.Engine
-	db       *DatabaseConnection
-	broker   *MessageBroker
-	cache    *CacheService
+	server        *http.Server
+	router        *gin.Engine
+	db            *DatabaseConnection
+	broker        *MessageBroker
+	cache         *CacheService
+	fraudClient   *FraudClient
+	rules         *RulesEngine
+	providers     *ProviderRegistry
+	paymentRouter *PaymentRouter
+	processor     *PaymentProcessor
+	webhooks      *WebhookProcessor
+	fx            *FXService
+	reconciler    *Reconciler
 }
 
 func init() {
@@ -47,6 +54,32 @@ func main() {
 	// Initialize cache service
 	app.cache = NewCacheService()
 
+	// Initialize fraud detection client
+	app.fraudClient = NewFraudClient()
+
+	// Initialize FX rates, loading FX_RATES_FILE when it is set
+	app.fx, err = NewFXService(app.db)
+	if err != nil {
+		log.Fatalf("Failed to initialize FX rates: %v", err)
+	}
+
+	// Initialize fraud rules engine with velocity checks in the settlement currency
+	velocity := NewVelocityChecker(NewVelocityStore(), app.fx.settlementCurrency)
+	app.rules = NewRulesEngine(app.db, app.fraudClient, velocity)
+
+	// Initialize payment provider adapters from payment_providers
+	app.providers, err = NewProviderRegistry(app.db)
+	if err != nil {
+		log.Fatalf("Failed to load payment providers: %v", err)
+	}
+	app.paymentRouter = NewPaymentRouter(app.db, app.providers)
+
+	NewProviderHealthChecker(app.db, app.broker, app.providers)
+	app.processor = NewPaymentProcessor(app.db, app.broker, app.cache, app.providers)
+	app.webhooks = NewWebhookProcessor(app.db, app.processor)
+	NewAuthorizationExpiryJob(app.db, app.broker, app.processor)
+	app.reconciler = NewReconciler(app.db, app.broker)
+
 	// Setup router
 	app.router = gin.New()
 	app.setupRoutes()
@@ -75,7 +108,9 @@ func (app *Application) setupRoutes() {
 	// Middleware
 	app.router.Use(gin.Logger())
 	app.router.Use(CORSMiddleware())
-	app.router.Use(AuthenticationMiddleware(app.db))
+
+	// Webhooks authenticate by provider signature instead of a bearer token
+	authenticated := AuthenticationMiddleware(app.db)
 
 	// Health check
 	app.router.GET("/health", func(c *gin.Context) {
@@ -83,36 +118,80 @@ func (app *Application) setupRoutes() {
 	})
 
 	// Transaction routes
-	transactionHandler := NewTransactionHandler(app.db, app.broker, app.cache)
-	transactionRoutes := app.router.Group("/api/v1/transactions")
+	idempotency := NewIdempotencyStore(app.db)
+	transactionHandler := NewTransactionHandler(app.db, app.broker, app.cache, app.rules, app.paymentRouter, app.processor, app.fx)
+	transactionRoutes := app.router.Group("/api/v1/transactions", authenticated)
 	{
-		transactionRoutes.POST("", transactionHandler.CreateTransaction)
+		transactionRoutes.POST("", IdempotencyMiddleware(idempotency), transactionHandler.CreateTransaction)
 		transactionRoutes.GET("/:id", transactionHandler.GetTransaction)
 		transactionRoutes.GET("", transactionHandler.ListTransactions)
 		transactionRoutes.GET("/:id/status", transactionHandler.GetTransactionStatus)
+		transactionRoutes.GET("/:id/attempts", transactionHandler.GetTransactionAttempts)
+		transactionRoutes.GET("/:id/history", transactionHandler.GetTransactionHistory)
+		transactionRoutes.POST("/:id/capture", IdempotencyMiddleware(idempotency), transactionHandler.CaptureTransaction)
+		transactionRoutes.POST("/:id/void", IdempotencyMiddleware(idempotency), transactionHandler.VoidTransaction)
+		transactionRoutes.POST("/:id/refunds", IdempotencyMiddleware(idempotency), transactionHandler.CreateRefund)
+		transactionRoutes.GET("/:id/refunds", transactionHandler.ListRefunds)
+	}
+
+	// User routes
+	userHandler := NewUserHandler(app.db)
+	userRoutes := app.router.Group("/api/v1/users", authenticated)
+	{
+		userRoutes.GET("/:id", userHandler.GetUserProfile)
 	}
 
 	// Provider routes
-	providerHandler := NewPaymentProviderHandler(app.db)
-	providerRoutes := app.router.Group("/api/v1/providers")
+	providerHandler := NewPaymentProviderHandler(app.db, app.providers)
+	providerRoutes := app.router.Group("/api/v1/providers", authenticated)
 	{
 		providerRoutes.GET("", providerHandler.ListProviders)
 		providerRoutes.GET("/rates", providerHandler.GetProviderRates)
 	}
 
 	// Admin routes
-	adminHandler := NewAdminHandler(app.db)
-	adminRoutes := app.router.Group("/api/v1/admin")
+	adminHandler := NewAdminHandler(app.db, app.broker, app.cache, app.processor, app.rules, app.paymentRouter, app.webhooks, app.fx, app.reconciler)
+	adminRoutes := app.router.Group("/api/v1/admin", authenticated)
 	adminRoutes.Use(AdminMiddleware())
 	{
 		adminRoutes.GET("/stats", adminHandler.GetDashboardStats)
 		adminRoutes.GET("/transactions/blocked", adminHandler.GetBlockedTransactions)
+		adminRoutes.POST("/transactions/:id/status", adminHandler.SetTransactionStatus)
 		adminRoutes.GET("/revenue", adminHandler.GetRevenueMetrics)
 		adminRoutes.GET("/fraud-logs", adminHandler.GetFraudLogs)
+		adminRoutes.GET("/reviews", adminHandler.ListReviews)
+		adminRoutes.POST("/reviews/:id/claim", adminHandler.ClaimReview)
+		adminRoutes.POST("/reviews/:id/approve", adminHandler.ApproveReview)
+		adminRoutes.POST("/reviews/:id/reject", adminHandler.RejectReview)
+		adminRoutes.POST("/users/:id/blacklist", adminHandler.BlacklistUser)
+		adminRoutes.POST("/users/:id/unblacklist", adminHandler.UnblacklistUser)
+		adminRoutes.GET("/users/:id/audit", adminHandler.GetUserAuditLog)
+		adminRoutes.GET("/rules", adminHandler.ListFraudRules)
+		adminRoutes.POST("/rules", adminHandler.CreateFraudRule)
+		adminRoutes.PUT("/rules/:id", adminHandler.UpdateFraudRule)
+		adminRoutes.DELETE("/rules/:id", adminHandler.DeleteFraudRule)
+		adminRoutes.GET("/routing-rules", adminHandler.ListRoutingRules)
+		adminRoutes.POST("/routing-rules", adminHandler.CreateRoutingRule)
+		adminRoutes.DELETE("/routing-rules/:id", adminHandler.DeleteRoutingRule)
+		adminRoutes.POST("/routing/preview", adminHandler.PreviewRouting)
+		adminRoutes.GET("/webhook-events", adminHandler.ListWebhookEvents)
+		adminRoutes.POST("/webhook-events/replay", adminHandler.ReplayWebhookEvents)
+		adminRoutes.GET("/disputes", adminHandler.ListDisputes)
+		adminRoutes.GET("/disputes/:id", adminHandler.GetDispute)
+		adminRoutes.POST("/disputes/:id/evidence", adminHandler.AddDisputeEvidence)
+		adminRoutes.GET("/ledger/accounts", adminHandler.ListLedgerAccounts)
+		adminRoutes.GET("/ledger/entries", adminHandler.ListJournalEntries)
+		adminRoutes.GET("/fx-rates", adminHandler.ListFXRates)
+		adminRoutes.POST("/fx-rates", adminHandler.CreateFXRates)
+		adminRoutes.POST("/settlements/reports", adminHandler.ImportSettlementReport)
+		adminRoutes.GET("/settlements/reports", adminHandler.ListSettlementReports)
+		adminRoutes.GET("/settlements/reports/:id", adminHandler.GetSettlementReport)
+		adminRoutes.GET("/settlements/mismatches", adminHandler.ListReconciliationMismatches)
+		adminRoutes.POST("/settlements/mismatches/:id/resolve", adminHandler.ResolveReconciliationMismatch)
 	}
 
 	// Webhook routes
-	webhookHandler := NewWebhookHandler(app.db, app.broker)
+	webhookHandler := NewWebhookHandler(app.webhooks)
 	webhookRoutes := app.router.Group("/api/v1/webhooks")
 	{
 		webhookRoutes.POST("/stripe", webhookHandler.HandleStripeWebhook)
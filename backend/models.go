@@ -1,55 +1,344 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
 
 // Transaction represents a payment transaction
 type Transaction struct {
-	ID              string    `json:"id"`
-	UserID          string    `json:"user_id"`
-	Amount          float64   `json:"amount"`
-	Currency        string    `json:"currency"`
-	Status          string    `json:"status"` // pending, processing, completed, failed, blocked
-	RiskScore       float64   `json:"risk_score"`
-	FraudDetected   bool      `json:"fraud_detected"`
-	Provider        string    `json:"provider"` // stripe or paypal
-	ProviderTxnID   string    `json:"provider_txn_id"`
-	Description     string    `json:"description"`
-	Metadata        map[string]interface{} `json:"metadata"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
+	ID                     string                 `json:"id"`
+	UserID                 string                 `json:"user_id"`
+	Amount                 Money                  `json:"amount"`
+	Currency               string                 `json:"currency"`
+	Status                 string                 `json:"status"` // see transactionTransitions
+	RiskScore              float64                `json:"risk_score"`
+	FraudDetected          bool                   `json:"fraud_detected"`
+	RiskFactors            []string               `json:"risk_factors"`
+	Provider               string                 `json:"provider"` // stripe or paypal
+	ProviderTxnID          string                 `json:"provider_txn_id"`
+	PaymentMethod          string                 `json:"-"` // provider payment method token
+	FailureCode            string                 `json:"failure_code,omitempty"`
+	FailureMessage         string                 `json:"failure_message,omitempty"`
+	NextActionURL          string                 `json:"next_action_url,omitempty"` // payer approval link for pending payments
+	MerchantCategory       string                 `json:"merchant_category,omitempty"`
+	RoutingReason          string                 `json:"routing_reason,omitempty"` // why the provider was chosen
+	RetryPlan              []string               `json:"retry_plan,omitempty"`     // providers to try in order on soft declines
+	CaptureMethod          string                 `json:"capture_method"`           // automatic, or manual to authorize only
+	AuthorizationExpiresAt *time.Time             `json:"authorization_expires_at,omitempty"`
+	CapturedAmount         Money                  `json:"captured_amount"`
+	RefundedAmount         Money                  `json:"refunded_amount"`   // pending and succeeded refunds
+	SettlementAmount       Money                  `json:"settlement_amount"` // amount converted into SETTLEMENT_CURRENCY at FXRate
+	SettlementCurrency     string                 `json:"settlement_currency"`
+	FXRate                 json.Number            `json:"fx_rate"`
+	Description            string                 `json:"description"`
+	Metadata               map[string]interface{} `json:"metadata"`
+	CreatedAt              time.Time              `json:"created_at"`
+	UpdatedAt              time.Time              `json:"updated_at"`
+}
+
+// PaymentAttempt is one call to a provider while charging a transaction
+type PaymentAttempt struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id"`
+	Provider      string    `json:"provider"`
+	AttemptNumber int       `json:"attempt_number"`
+	Status        string    `json:"status"`
+	ErrorCode     string    `json:"error_code,omitempty"`
+	ErrorMessage  string    `json:"error_message,omitempty"`
+	LatencyMs     int64     `json:"latency_ms"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Refund is a full or partial refund of a captured transaction
+type Refund struct {
+	ID               string    `json:"id"`
+	TransactionID    string    `json:"transaction_id"`
+	Amount           Money     `json:"amount"`
+	Currency         string    `json:"currency"`
+	Status           string    `json:"status"` // pending, succeeded, failed
+	Provider         string    `json:"provider"`
+	ProviderRefundID string    `json:"provider_refund_id,omitempty"`
+	Reason           string    `json:"reason,omitempty"`
+	FailureCode      string    `json:"failure_code,omitempty"`
+	FailureMessage   string    `json:"failure_message,omitempty"`
+	RequestedBy      string    `json:"requested_by,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Dispute is a chargeback or payer dispute against a transaction
+type Dispute struct {
+	ID                string            `json:"id"`
+	TransactionID     string            `json:"transaction_id"`
+	Provider          string            `json:"provider"`
+	ProviderDisputeID string            `json:"provider_dispute_id"`
+	Status            string            `json:"status"` // needs_response, under_review, won, lost
+	Reason            string            `json:"reason,omitempty"`
+	Amount            Money             `json:"amount"`
+	Currency          string            `json:"currency"`
+	DueBy             *time.Time        `json:"due_by,omitempty"` // evidence deadline
+	ClosedAt          *time.Time        `json:"closed_at,omitempty"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	Evidence          []DisputeEvidence `json:"evidence,omitempty"`
+}
+
+// DisputeEvidence describes a file submitted in response to a dispute
+type DisputeEvidence struct {
+	ID          string    `json:"id"`
+	DisputeID   string    `json:"dispute_id"`
+	Type        string    `json:"type" binding:"required"`
+	Filename    string    `json:"filename" binding:"required"`
+	ContentType string    `json:"content_type,omitempty"`
+	SizeBytes   int64     `json:"size_bytes,omitempty"`
+	StorageURL  string    `json:"storage_url,omitempty"`
+	Description string    `json:"description,omitempty"`
+	UploadedBy  string    `json:"uploaded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LedgerAccount is an account in the double-entry ledger. Balance is the
+// sum of its postings, debits positive.
+type LedgerAccount struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"` // asset, liability, revenue, expense
+	Currency  string    `json:"currency"`
+	Balance   Money     `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// JournalEntry is one balanced money movement
+type JournalEntry struct {
+	ID            string          `json:"id"`
+	TransactionID string          `json:"transaction_id,omitempty"`
+	Provider      string          `json:"provider,omitempty"`
+	ReferenceType string          `json:"reference_type"` // capture, capture_reversal, refund, dispute_loss
+	ReferenceID   string          `json:"reference_id"`
+	Currency      string          `json:"currency"`
+	Description   string          `json:"description,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Postings      []LedgerPosting `json:"postings"`
+}
+
+// LedgerPosting is one line of a journal entry; debits are positive and
+// credits negative
+type LedgerPosting struct {
+	ID          string `json:"id"`
+	AccountCode string `json:"account_code"`
+	Amount      Money  `json:"amount"`
+}
+
+// FXRate is the number of units of QuoteCurrency one unit of BaseCurrency
+// buys from EffectiveAt on
+type FXRate struct {
+	ID            string      `json:"id"`
+	BaseCurrency  string      `json:"base_currency"`
+	QuoteCurrency string      `json:"quote_currency"`
+	Rate          json.Number `json:"rate"`
+	Source        string      `json:"source"` // file or admin
+	EffectiveAt   time.Time   `json:"effective_at"`
+	CreatedBy     string      `json:"created_by,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// SettlementReport is a provider settlement or payout report imported for
+// reconciliation
+type SettlementReport struct {
+	ID             string          `json:"id"`
+	Provider       string          `json:"provider"`
+	Filename       string          `json:"filename"`
+	Checksum       string          `json:"checksum"`     // SHA-256 of the file
+	RowCount       int             `json:"row_count"`    // rows stored
+	SkippedRows    int             `json:"skipped_rows"` // rows already imported with an earlier report
+	PeriodStart    *time.Time      `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time      `json:"period_end,omitempty"`
+	ImportedBy     string          `json:"imported_by,omitempty"`
+	ReconciledAt   *time.Time      `json:"reconciled_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	OpenMismatches map[string]int  `json:"open_mismatches"` // by mismatch type
+	Rows           []SettlementRow `json:"rows,omitempty"`
+}
+
+// SettlementRow is one line of a settlement report. Gross is signed as the
+// provider reports it, so refunds are negative; Fee is what the provider
+// charged.
+type SettlementRow struct {
+	ID                string    `json:"id"`
+	ReportID          string    `json:"report_id"`
+	Provider          string    `json:"provider"`
+	RowID             string    `json:"row_id"` // the provider's ID for the line
+	Kind              string    `json:"kind"`   // payment, refund or other
+	Type              string    `json:"type"`   // the provider's own row type or event code
+	ProviderReference string    `json:"provider_reference,omitempty"`
+	Gross             Money     `json:"gross"`
+	Fee               Money     `json:"fee"`
+	Net               Money     `json:"net"`
+	Currency          string    `json:"currency"`
+	OccurredAt        time.Time `json:"occurred_at"`
+	Description       string    `json:"description,omitempty"`
+}
+
+// ReconciliationMismatch is a difference between our records and a
+// provider's settlement report
+type ReconciliationMismatch struct {
+	ID                string     `json:"id"`
+	ReportID          string     `json:"report_id"`
+	Provider          string     `json:"provider"`
+	Type              string     `json:"type"` // missing_internal, missing_at_provider, amount_mismatch
+	Kind              string     `json:"kind"` // payment or refund
+	ProviderReference string     `json:"provider_reference"`
+	TransactionID     string     `json:"transaction_id,omitempty"`
+	InternalAmount    *Money     `json:"internal_amount,omitempty"`
+	InternalCurrency  string     `json:"internal_currency,omitempty"`
+	ProviderAmount    *Money     `json:"provider_amount,omitempty"`
+	ProviderCurrency  string     `json:"provider_currency,omitempty"`
+	Status            string     `json:"status"` // open or resolved
+	ResolvedBy        string     `json:"resolved_by,omitempty"`
+	Resolution        string     `json:"resolution,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	ResolvedAt        *time.Time `json:"resolved_at,omitempty"`
+}
+
+// StatusChange is one row of a transaction's status history
+type StatusChange struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id"`
+	FromStatus    string    `json:"from_status,omitempty"`
+	ToStatus      string    `json:"to_status"`
+	Source        string    `json:"source"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// WebhookEvent is a provider webhook as it was received
+type WebhookEvent struct {
+	ID          string          `json:"id"`
+	Provider    string          `json:"provider"`
+	EventID     string          `json:"event_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
 }
 
 // User represents a user in the system
 type User struct {
-	ID              string    `json:"id"`
-	Email           string    `json:"email"`
-	Name            string    `json:"name"`
-	Status          string    `json:"status"`
-	TransactionCount int      `json:"transaction_count"`
-	TotalSpent      float64   `json:"total_spent"`
-	IsBlacklisted   bool      `json:"is_blacklisted"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
+	ID                 string    `json:"id"`
+	Email              string    `json:"email"`
+	Name               string    `json:"name"`
+	Status             string    `json:"status"`
+	TransactionCount   int       `json:"transaction_count"`
+	TotalSpent         Money     `json:"total_spent"` // in TotalSpentCurrency, the settlement currency
+	TotalSpentCurrency string    `json:"total_spent_currency"`
+	IsBlacklisted      bool      `json:"is_blacklisted"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// AccountAgeDays returns the number of whole days since the user signed up
+func (u *User) AccountAgeDays() int {
+	return int(time.Since(u.CreatedAt).Hours() / 24)
+}
+
+// UserProfile is the public view of a user returned by GET /users/:id
+type UserProfile struct {
+	User
+	AccountAgeDays int `json:"account_age_days"`
+}
+
+// UserAuditEntry records an administrative change to a user
+type UserAuditEntry struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Action    string    `json:"action"` // blacklisted, unblacklisted
+	Reason    string    `json:"reason"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserStatusRequest is the body for blacklisting or unblacklisting a user
+type UserStatusRequest struct {
+	Reason string `json:"reason" binding:"required"`
 }
 
 // FraudLog represents fraud detection events
 type FraudLog struct {
-	ID              string    `json:"id"`
-	TransactionID   string    `json:"transaction_id"`
-	UserID          string    `json:"user_id"`
-	RiskFactors     []string  `json:"risk_factors"`
-	RiskScore       float64   `json:"risk_score"`
-	Action          string    `json:"action"` // approved, blocked, manual_review
-	DetectedAt      time.Time `json:"detected_at"`
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id"`
+	UserID        string    `json:"user_id"`
+	RiskFactors   []string  `json:"risk_factors"`
+	RiskScore     float64   `json:"risk_score"`
+	Action        string    `json:"action"`                // approved, blocked, manual_review
+	ReviewedBy    string    `json:"reviewed_by,omitempty"` // analyst for manual decisions
+	Reason        string    `json:"reason,omitempty"`
+	DetectedAt    time.Time `json:"detected_at"`
+}
+
+// Fraud log actions
+const (
+	FraudActionApproved     = "approved"
+	FraudActionBlocked      = "blocked"
+	FraudActionManualReview = "manual_review"
+	// FraudActionConfirmedFraud records fraud confirmed after the fact, such
+	// as by a lost chargeback
+	FraudActionConfirmedFraud = "confirmed_fraud"
+)
+
+// ManualReview tracks an analyst's handling of a held transaction
+type ManualReview struct {
+	TransactionID string       `json:"transaction_id"`
+	Status        string       `json:"status"` // pending, claimed, approved, rejected
+	AssignedTo    string       `json:"assigned_to,omitempty"`
+	ClaimedAt     *time.Time   `json:"claimed_at,omitempty"`
+	DecidedAt     *time.Time   `json:"decided_at,omitempty"`
+	Reason        string       `json:"reason,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Transaction   *Transaction `json:"transaction,omitempty"`
 }
 
-// PaymentProvider represents payment provider configuration
-type PaymentProvider struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Fee         float64 `json:"fee"`
-	Status      string  `json:"status"`
-	LastChecked time.Time `json:"last_checked"`
+// ReviewDecisionRequest is the body for approving or rejecting a review
+type ReviewDecisionRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// ProviderConfig represents a payment_providers row
+type ProviderConfig struct {
+	ID               string    `json:"id"`
+	Code             string    `json:"code"` // adapter name, stored in transactions.provider
+	Name             string    `json:"name"`
+	Fee              float64   `json:"fee"`
+	FixedFee         Money     `json:"fixed_fee"`
+	FixedFeeCurrency string    `json:"fixed_fee_currency"`
+	Currencies       []string  `json:"currencies"` // empty means any currency
+	Status           string    `json:"status"`
+	LastChecked      time.Time `json:"last_checked"`
+}
+
+// FeeSchedule returns the fees the provider charges per payment
+func (p ProviderConfig) FeeSchedule() FeeSchedule {
+	return FeeSchedule{Percentage: p.Fee, Fixed: p.FixedFee}
+}
+
+// SupportsCurrency reports whether the provider accepts payments in currency
+func (p ProviderConfig) SupportsCurrency(currency string) bool {
+	if len(p.Currencies) == 0 {
+		return true
+	}
+	for _, c := range p.Currencies {
+		if strings.EqualFold(c, currency) {
+			return true
+		}
+	}
+	return false
 }
 
 // APIResponse standard response format
@@ -58,32 +347,93 @@ type APIResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 	Message string      `json:"message,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"` // machine-readable error code
 }
 
 // PaymentRequest incoming payment request
 type PaymentRequest struct {
 	UserID      string                 `json:"user_id" binding:"required"`
-	Amount      float64                `json:"amount" binding:"required,gt=0"`
+	Amount      Money                  `json:"amount"` // see UnmarshalJSON
 	Currency    string                 `json:"currency" binding:"required"`
 	Description string                 `json:"description"`
 	Metadata    map[string]interface{} `json:"metadata"`
+
+	// PaymentMethod is the provider token for the payer's payment method,
+	// such as a Stripe PaymentMethod ID
+	PaymentMethod string `json:"payment_method"`
+
+	// CaptureMethod "manual" only authorizes the payment; it is captured or
+	// voided later through the capture and void endpoints
+	CaptureMethod string `json:"capture_method" binding:"omitempty,oneof=automatic manual"`
+
+	// Optional signals forwarded to the fraud detection service
+	MerchantCategory  string `json:"merchant_category"`
+	DeviceFingerprint string `json:"device_fingerprint"`
+	IPCountry         string `json:"ip_country"`
+	BillingCountry    string `json:"billing_country"`
+
+	// IPAddress is taken from the request, not the body
+	IPAddress string `json:"-"`
+}
+
+// UnmarshalJSON checks currency against ISO 4217, upper-casing it, and reads
+// amount as a JSON number or a decimal string such as "19.99" in that
+// currency
+func (r *PaymentRequest) UnmarshalJSON(data []byte) error {
+	type plain PaymentRequest
+	var body struct {
+		plain
+		Amount DecimalAmount `json:"amount"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	currency, err := normalizeCurrency(body.Currency)
+	if err != nil {
+		return err
+	}
+	body.Currency = currency
+	if body.Amount == "" {
+		return errors.New("amount is required")
+	}
+	amount, err := body.Amount.Money(body.Currency)
+	if err != nil {
+		return err
+	}
+	if !amount.IsPositive() {
+		return errors.New("amount must be greater than 0")
+	}
+
+	*r = PaymentRequest(body.plain)
+	r.Amount = amount
+	return nil
 }
 
-// DashboardStats represents dashboard statistics
+// DashboardStats represents dashboard statistics. TotalRevenue is in
+// Currency.
 type DashboardStats struct {
-	TotalTransactions    int64     `json:"total_transactions"`
-	BlockedTransactions  int64     `json:"blocked_transactions"`
-	TotalRevenue         float64   `json:"total_revenue"`
-	AverageRiskScore     float64   `json:"average_risk_score"`
-	FraudPreventionRate  float64   `json:"fraud_prevention_rate"`
-	TransactionSuccessRate float64  `json:"transaction_success_rate"`
+	Currency               string  `json:"currency"`
+	TotalTransactions      int64   `json:"total_transactions"`
+	BlockedTransactions    int64   `json:"blocked_transactions"`
+	HeldTransactions       int64   `json:"held_transactions"`
+	TotalRevenue           Money   `json:"total_revenue"`
+	AverageRiskScore       float64 `json:"average_risk_score"`
+	FraudPreventionRate    float64 `json:"fraud_prevention_rate"`
+	TransactionSuccessRate float64 `json:"transaction_success_rate"`
 }
 
-// RevenueMetrics represents revenue breakdown
+// RevenueMetrics represents revenue breakdown converted into one currency.
+// Figures come from the ledger; provider and total revenue are net of
+// refunds, dispute losses and provider fees.
 type RevenueMetrics struct {
-	StripeRevenue     float64 `json:"stripe_revenue"`
-	PayPalRevenue     float64 `json:"paypal_revenue"`
-	TotalRevenue      float64 `json:"total_revenue"`
-	TransactionCount  int64   `json:"transaction_count"`
-	AveragePerTxn     float64 `json:"average_per_txn"`
+	Currency         string `json:"currency"`
+	GrossRevenue     Money  `json:"gross_revenue"`
+	Refunds          Money  `json:"refunds"`
+	DisputeLosses    Money  `json:"dispute_losses"`
+	ProviderFees     Money  `json:"provider_fees"`
+	StripeRevenue    Money  `json:"stripe_revenue"`
+	PayPalRevenue    Money  `json:"paypal_revenue"`
+	TotalRevenue     Money  `json:"total_revenue"`
+	TransactionCount int64  `json:"transaction_count"`
+	AveragePerTxn    Money  `json:"average_per_txn"`
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidAmount   = errors.New("amount must be a decimal number")
+	errAmountPrecision = errors.New("amount has more decimal places than its currency allows")
+	errAmountRange     = errors.New("amount is out of range")
+	errNegativeAmount  = errors.New("amount must not be negative")
+	errInvalidCurrency = errors.New("currency must be an ISO 4217 code")
+)
+
+// isAmountError reports whether err is a problem with an amount a client sent
+func isAmountError(err error) bool {
+	switch err {
+	case errInvalidAmount, errAmountPrecision, errAmountRange, errNegativeAmount:
+		return true
+	}
+	return false
+}
+
+// isoCurrencies is the set of active ISO 4217 currency codes, leaving out
+// precious metals and the testing and no-currency codes
+var isoCurrencies = func() map[string]bool {
+	codes := strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BOV
+		BRL BSD BTN BWP BYN BZD CAD CDF CHE CHF CHW CLF CLP CNY COP COU CRC CUP CVE CZK
+		DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL
+		HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT
+		LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR
+		MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF
+		SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP
+		TRY TTD TWD TZS UAH UGX USD USN UYI UYU UYW UZS VED VES VND VUV WST XAF XCD XCG
+		XOF XPF YER ZAR ZMW ZWG`)
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}()
+
+// normalizeCurrency upper-cases a currency code such as "usd", rejecting
+// anything that is not an ISO 4217 code
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !isoCurrencies[code] {
+		return "", errInvalidCurrency
+	}
+	return code, nil
+}
+
+// currencyExponents lists ISO 4217 currencies whose minor unit is not a
+// hundredth. Every other currency has two decimal places.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// CurrencyExponent returns the number of decimal places in a currency's
+// minor unit, for example 2 for USD, 0 for JPY and 3 for BHD
+func CurrencyExponent(currency string) int {
+	if e, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return e
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// Money is an exact amount in the minor units of an ISO 4217 currency, for
+// example {1999, "USD"} for $19.99 or {1999, "JPY"} for ¥1999. Arithmetic
+// between amounts in different currencies is a programming error and panics.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// NewMoney returns an amount of minor units in currency
+func NewMoney(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: strings.ToUpper(currency)}
+}
+
+// splitDecimal splits a decimal such as "-19.99" into its sign, whole and
+// fractional digits
+func splitDecimal(s string) (neg bool, whole, frac string, err error) {
+	s = strings.TrimSpace(s)
+	neg = strings.HasPrefix(s, "-")
+	if neg || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	whole = s
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole+frac == "" || strings.Trim(whole+frac, "0123456789") != "" {
+		return false, "", "", errInvalidAmount
+	}
+	return neg, whole, frac, nil
+}
+
+// ParseMoney parses a decimal such as "19.99" in currency. Trailing zeros
+// beyond the currency's exponent are accepted; other extra digits are not.
+func ParseMoney(s, currency string) (Money, error) {
+	neg, whole, frac, err := splitDecimal(s)
+	if err != nil {
+		return Money{}, err
+	}
+
+	exp := CurrencyExponent(currency)
+	if len(frac) > exp {
+		if strings.Trim(frac[exp:], "0") != "" {
+			return Money{}, errAmountPrecision
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	digits := strings.TrimLeft(whole+frac, "0")
+	if digits == "" {
+		return NewMoney(0, currency), nil
+	}
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, errAmountRange
+	}
+	if neg {
+		minor = -minor
+	}
+	return NewMoney(minor, currency), nil
+}
+
+// String formats the amount as a decimal with the currency's exponent
+func (m Money) String() string {
+	exp := CurrencyExponent(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	p := pow10(exp)
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/p, exp, minor%p)
+}
+
+// Float64 returns the amount in major units. It is for scoring and display,
+// such as the fraud model's features, never for money arithmetic.
+func (m Money) Float64() float64 {
+	return float64(m.Minor) / float64(pow10(CurrencyExponent(m.Currency)))
+}
+
+func (m Money) IsZero() bool     { return m.Minor == 0 }
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+func (m Money) IsNegative() bool { return m.Minor < 0 }
+
+func (m Money) mustMatch(o Money) {
+	// A zero value with no currency is the additive identity
+	if m.Currency != o.Currency && m.Currency != "" && o.Currency != "" {
+		panic(fmt.Sprintf("money: mixing %s and %s", m.Currency, o.Currency))
+	}
+}
+
+func (m Money) currencyWith(o Money) string {
+	if m.Currency == "" {
+		return o.Currency
+	}
+	return m.Currency
+}
+
+// Add returns m + o
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor + o.Minor, Currency: m.currencyWith(o)}
+}
+
+// Sub returns m - o
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return Money{Minor: m.Minor - o.Minor, Currency: m.currencyWith(o)}
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{Minor: -m.Minor, Currency: m.Currency}
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Minor < o.Minor:
+		return -1
+	case m.Minor > o.Minor:
+		return 1
+	}
+	return 0
+}
+
+// Min returns the smaller of m and o
+func (m Money) Min(o Money) Money {
+	if m.Cmp(o) <= 0 {
+		return m
+	}
+	return o
+}
+
+// MulRate multiplies by a rate such as a fee percentage, rounding half away
+// from zero to the nearest minor unit
+func (m Money) MulRate(rate float64) Money {
+	// The shortest decimal form of the rate is what was configured, 0.029
+	// rather than the nearest binary fraction
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	product := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Minor), r)
+	return Money{Minor: roundRat(product), Currency: m.Currency}
+}
+
+// Div divides by n, rounding half away from zero, for averages
+func (m Money) Div(n int64) Money {
+	return Money{Minor: roundRat(big.NewRat(m.Minor, n)), Currency: m.Currency}
+}
+
+// roundRat rounds half away from zero
+func roundRat(r *big.Rat) int64 {
+	num, den := new(big.Int).Abs(r.Num()), r.Denom()
+	twice := new(big.Int).Lsh(num, 1)
+	q := new(big.Int).Quo(twice.Add(twice, den), new(big.Int).Lsh(den, 1))
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
+
+// Convert converts m into currency at rate, the number of units of currency
+// one unit of m's currency buys, rounding half away from zero
+func (m Money) Convert(rate *big.Rat, currency string) Money {
+	scale := big.NewRat(pow10(CurrencyExponent(currency)), pow10(CurrencyExponent(m.Currency)))
+	product := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Minor), rate)
+	return NewMoney(roundRat(product.Mul(product, scale)), currency)
+}
+
+// Exceeds reports whether m is greater than the decimal d, which may be a
+// threshold written without a currency
+func (m Money) Exceeds(d DecimalAmount) bool {
+	threshold, ok := new(big.Rat).SetString(string(d))
+	if !ok {
+		return false
+	}
+	return big.NewRat(m.Minor, pow10(CurrencyExponent(m.Currency))).Cmp(threshold) > 0
+}
+
+// MarshalJSON writes the amount as an exact JSON number in major units, so
+// clients that read amounts as numbers keep working
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Value stores the amount in a DECIMAL column
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// DecimalAmount is an amount as a client sends it, either a JSON number or
+// a decimal string such as "19.99". It becomes Money once its currency is
+// known, which keeps the JSON API backward compatible.
+type DecimalAmount string
+
+func (d *DecimalAmount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*d = ""
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	if _, _, _, err := splitDecimal(s); err != nil {
+		return err
+	}
+	*d = DecimalAmount(strings.TrimSpace(s))
+	return nil
+}
+
+// Money converts the amount into currency; an empty amount is zero
+func (d DecimalAmount) Money(currency string) (Money, error) {
+	if d == "" {
+		return NewMoney(0, currency), nil
+	}
+	return ParseMoney(string(d), currency)
+}
+
+// moneyColumn receives a DECIMAL column as text. It is converted with
+// money once the row's currency has been read.
+type moneyColumn string
+
+func (c moneyColumn) money(currency string) (Money, error) {
+	return ParseMoney(string(c), currency)
+}
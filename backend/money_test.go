@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency string
+		want     Money
+		wantErr  error
+	}{
+		{s: "19.99", currency: "USD", want: NewMoney(1999, "USD")},
+		{s: "19.9", currency: "USD", want: NewMoney(1990, "USD")},
+		{s: "19", currency: "usd", want: NewMoney(1900, "USD")},
+		{s: " 0.05 ", currency: "EUR", want: NewMoney(5, "EUR")},
+		{s: ".5", currency: "USD", want: NewMoney(50, "USD")},
+		{s: "-12.30", currency: "USD", want: NewMoney(-1230, "USD")},
+		{s: "+1.00", currency: "USD", want: NewMoney(100, "USD")},
+		{s: "19.9900", currency: "USD", want: NewMoney(1999, "USD")},
+		{s: "0", currency: "USD", want: NewMoney(0, "USD")},
+		{s: "3000", currency: "JPY", want: NewMoney(3000, "JPY")},
+		{s: "3000.0", currency: "JPY", want: NewMoney(3000, "JPY")},
+		{s: "1.234", currency: "KWD", want: NewMoney(1234, "KWD")},
+		{s: "19.999", currency: "USD", wantErr: errAmountPrecision},
+		{s: "3000.5", currency: "JPY", wantErr: errAmountPrecision},
+		{s: "", currency: "USD", wantErr: errInvalidAmount},
+		{s: "1e3", currency: "USD", wantErr: errInvalidAmount},
+		{s: "1,000.00", currency: "USD", wantErr: errInvalidAmount},
+		{s: "--1", currency: "USD", wantErr: errInvalidAmount},
+		{s: "99999999999999999999", currency: "USD", wantErr: errAmountRange},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.s, tt.currency)
+		if err != tt.wantErr {
+			t.Errorf("ParseMoney(%q, %s) error = %v, want %v", tt.s, tt.currency, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseMoney(%q, %s) = %+v, want %+v", tt.s, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMulRate(t *testing.T) {
+	tests := []struct {
+		m    Money
+		rate float64
+		want Money
+	}{
+		{NewMoney(10000, "USD"), 0.029, NewMoney(290, "USD")},
+		// 0.029 is not exact in binary; the configured decimal is used
+		{NewMoney(1000, "USD"), 0.029, NewMoney(29, "USD")},
+		{NewMoney(1050, "USD"), 0.029, NewMoney(30, "USD")},   // 30.45
+		{NewMoney(1724, "USD"), 0.029, NewMoney(50, "USD")},   // 49.996
+		{NewMoney(50, "USD"), 0.01, NewMoney(1, "USD")},       // 0.5 rounds away from zero
+		{NewMoney(-50, "USD"), 0.01, NewMoney(-1, "USD")},     // and so does -0.5
+		{NewMoney(149, "USD"), 0.01, NewMoney(1, "USD")},      // 1.49
+		{NewMoney(12345, "JPY"), 0.034, NewMoney(420, "JPY")}, // 419.73
+		{NewMoney(10000, "USD"), 0, NewMoney(0, "USD")},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.MulRate(tt.rate); got != tt.want {
+			t.Errorf("%v.MulRate(%v) = %v, want %v", tt.m, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		m        Money
+		rate     string
+		currency string
+		want     Money
+	}{
+		{NewMoney(10000, "USD"), "0.9215", "EUR", NewMoney(9215, "EUR")},
+		{NewMoney(1999, "EUR"), "1.0852", "usd", NewMoney(2169, "USD")},     // 21.693148
+		{NewMoney(200000, "JPY"), "0.0067", "USD", NewMoney(134000, "USD")}, // ¥200,000 to $1,340.00
+		{NewMoney(1340, "USD"), "149.25", "JPY", NewMoney(2000, "JPY")},     // 1999.95
+		{NewMoney(10000, "USD"), "0.307", "KWD", NewMoney(30700, "KWD")},    // three decimals
+		{NewMoney(1, "USD"), "0.5", "EUR", NewMoney(1, "EUR")},              // 0.5 rounds away from zero
+		{NewMoney(-1, "USD"), "0.5", "EUR", NewMoney(-1, "EUR")},            // and so does -0.5
+		{NewMoney(1234, "GBP"), "1", "GBP", NewMoney(1234, "GBP")},          // same currency
+		{NewMoney(100, "USD"), "0.000000000001", "EUR", NewMoney(0, "EUR")}, // tiny rates round to zero
+	}
+
+	for _, tt := range tests {
+		rate, err := parseFXRate(tt.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.m.Convert(rate, tt.currency); got != tt.want {
+			t.Errorf("%v %s.Convert(%s, %s) = %v %s, want %v %s", tt.m, tt.m.Currency, tt.rate, tt.currency, got, got.Currency, tt.want, tt.want.Currency)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PayPalClient calls the PayPal REST API using OAuth client credentials.
+// PAYPAL_API_BASE_URL points it at the sandbox, live or a local mock.
+type PayPalClient struct {
+	FeeSchedule
+	baseURL      string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	token       string
+	tokenExpiry time.Time
+	mu          sync.Mutex
+}
+
+func NewPayPalClient(fees FeeSchedule) *PayPalClient {
+	return &PayPalClient{
+		FeeSchedule:  fees,
+		baseURL:      strings.TrimRight(getEnv("PAYPAL_API_BASE_URL", "https://api-m.sandbox.paypal.com"), "/"),
+		clientID:     getEnv("PAYPAL_CLIENT_ID", ""),
+		clientSecret: getEnv("PAYPAL_CLIENT_SECRET", ""),
+		httpClient:   &http.Client{Timeout: getEnvDuration("PAYPAL_TIMEOUT", 10*time.Second)},
+	}
+}
+
+// PayPalError is an error response from the PayPal API
+type PayPalError struct {
+	StatusCode int    `json:"-"`
+	Name       string `json:"name"`
+	Message    string `json:"message"`
+	DebugID    string `json:"debug_id"`
+	Details    []struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details"`
+}
+
+func (e *PayPalError) Error() string {
+	return fmt.Sprintf("paypal: %d %s: %s (debug_id %s)", e.StatusCode, e.Name, e.Message, e.DebugID)
+}
+
+// Issue returns the first detail issue code, or the error name
+func (e *PayPalError) Issue() string {
+	if len(e.Details) > 0 && e.Details[0].Issue != "" {
+		return e.Details[0].Issue
+	}
+	return e.Name
+}
+
+// accessToken returns a cached OAuth token, fetching a new one shortly before expiry
+func (pc *PayPalClient) accessToken(ctx context.Context) (string, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.token != "" && time.Now().Before(pc.tokenExpiry) {
+		return pc.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pc.baseURL+"/v1/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(pc.clientID, pc.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", decodePayPalError(resp)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding paypal token: %w", err)
+	}
+
+	pc.token = body.AccessToken
+	// Refresh a minute early so in-flight requests never carry an expired token
+	pc.tokenExpiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return pc.token, nil
+}
+
+func (pc *PayPalClient) invalidateToken() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.token = ""
+}
+
+// do sends an authenticated JSON request. requestID is sent as
+// PayPal-Request-Id so retried calls are idempotent on PayPal's side.
+func (pc *PayPalClient) do(ctx context.Context, method, path, requestID string, in, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := pc.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, pc.baseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "return=representation")
+		if requestID != "" {
+			req.Header.Set("PayPal-Request-Id", requestID)
+		}
+
+		resp, err := pc.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		// A revoked or expired token gets one retry with a fresh token
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			pc.invalidateToken()
+			continue
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return decodePayPalError(resp)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return errors.New("paypal: unauthorized")
+}
+
+func decodePayPalError(resp *http.Response) error {
+	ppErr := &PayPalError{StatusCode: resp.StatusCode}
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, ppErr); err != nil || ppErr.Name == "" {
+		// The token endpoint uses OAuth-style errors
+		var oauth struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &oauth)
+		ppErr.Name = oauth.Error
+		ppErr.Message = oauth.Description
+	}
+	return ppErr
+}
+
+type paypalAmount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type paypalLink struct {
+	Href string `json:"href"`
+	Rel  string `json:"rel"`
+}
+
+// paypalPayment is an authorization, capture or refund resource
+type paypalPayment struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	StatusDetails struct {
+		Reason string `json:"reason"`
+	} `json:"status_details"`
+}
+
+type paypalOrder struct {
+	ID            string       `json:"id"`
+	Status        string       `json:"status"` // CREATED, APPROVED, PAYER_ACTION_REQUIRED, COMPLETED
+	Links         []paypalLink `json:"links"`
+	PurchaseUnits []struct {
+		Payments struct {
+			Authorizations []paypalPayment `json:"authorizations"`
+		} `json:"payments"`
+	} `json:"purchase_units"`
+}
+
+func (o *paypalOrder) link(rel string) string {
+	for _, l := range o.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+func (o *paypalOrder) authorization() *paypalPayment {
+	if len(o.PurchaseUnits) == 0 || len(o.PurchaseUnits[0].Payments.Authorizations) == 0 {
+		return nil
+	}
+	return &o.PurchaseUnits[0].Payments.Authorizations[0]
+}
+
+// paypalAmountFor formats amount with its currency's decimal places, which
+// PayPal requires
+func paypalAmountFor(amount Money) paypalAmount {
+	return paypalAmount{
+		CurrencyCode: amount.Currency,
+		Value:        amount.String(),
+	}
+}
+
+// CreateOrder creates an AUTHORIZE-intent order for txn. A vaulted PayPal
+// payment token in txn.PaymentMethod lets the order be authorized without
+// sending the payer through the approval page.
+func (pc *PayPalClient) CreateOrder(ctx context.Context, txn *Transaction) (*paypalOrder, error) {
+	unit := map[string]interface{}{
+		"reference_id": txn.ID,
+		"custom_id":    txn.ID,
+		"amount":       paypalAmountFor(txn.Amount),
+	}
+	if txn.Description != "" {
+		unit["description"] = txn.Description
+	}
+
+	body := map[string]interface{}{
+		"intent":         "AUTHORIZE",
+		"purchase_units": []interface{}{unit},
+	}
+	if txn.PaymentMethod != "" {
+		body["payment_source"] = map[string]interface{}{
+			"paypal": map[string]string{"vault_id": txn.PaymentMethod},
+		}
+	}
+
+	var order paypalOrder
+	if err := pc.do(ctx, http.MethodPost, "/v2/checkout/orders", txn.ID+":create", body, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// AuthorizeOrder authorizes payment for an approved order
+func (pc *PayPalClient) AuthorizeOrder(ctx context.Context, orderID, requestID string) (*paypalOrder, error) {
+	var order paypalOrder
+	path := "/v2/checkout/orders/" + url.PathEscape(orderID) + "/authorize"
+	if err := pc.do(ctx, http.MethodPost, path, requestID, map[string]interface{}{}, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Authorize creates a PayPal order for txn and authorizes it. Orders
+// without a vaulted payment token wait for the payer's approval.
+func (pc *PayPalClient) Authorize(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	order, err := pc.CreateOrder(ctx, txn)
+	if err != nil {
+		return paypalErrorResult("", err)
+	}
+
+	switch order.Status {
+	case "PAYER_ACTION_REQUIRED", "CREATED":
+		// The payer must approve the order on PayPal before it can be authorized
+		return &ProviderResult{
+			ProviderTxnID: order.ID,
+			Status:        StatusPending,
+			FailureCode:   "payer_action_required",
+			NextActionURL: firstNonEmpty(order.link("payer-action"), order.link("approve")),
+		}, nil
+	case "COMPLETED":
+		return paypalAuthorizationResult(order), nil
+	}
+
+	authorized, err := pc.AuthorizeOrder(ctx, order.ID, txn.ID+":authorize")
+	if err != nil {
+		return paypalErrorResult(order.ID, err)
+	}
+	return paypalAuthorizationResult(authorized), nil
+}
+
+// Capture captures amount from the authorization in txn.ProviderTxnID. The
+// capture ID becomes the provider reference since refunds and settlement
+// reports refer to it.
+func (pc *PayPalClient) Capture(ctx context.Context, txn *Transaction, amount Money) (*ProviderResult, error) {
+	body := map[string]interface{}{
+		"amount":        paypalAmountFor(amount),
+		"invoice_id":    txn.ID,
+		"final_capture": true,
+	}
+
+	var capture paypalPayment
+	path := "/v2/payments/authorizations/" + url.PathEscape(txn.ProviderTxnID) + "/capture"
+	if err := pc.do(ctx, http.MethodPost, path, captureIdempotencyKey(txn, amount), body, &capture); err != nil {
+		return paypalErrorResult(txn.ProviderTxnID, err)
+	}
+
+	result := &ProviderResult{ProviderTxnID: capture.ID}
+	switch capture.Status {
+	case "COMPLETED":
+		result.Status = StatusCompleted
+	case "PENDING":
+		result.Status = StatusProcessing
+		result.FailureCode = strings.ToLower(capture.StatusDetails.Reason)
+	default:
+		result.Status = StatusFailed
+		result.FailureCode = strings.ToLower(firstNonEmpty(capture.StatusDetails.Reason, capture.Status))
+	}
+	return result, nil
+}
+
+// Refund refunds amount of the capture in txn.ProviderTxnID
+func (pc *PayPalClient) Refund(ctx context.Context, txn *Transaction, amount Money, reference string) (*ProviderResult, error) {
+	body := map[string]interface{}{
+		"amount":    paypalAmountFor(amount),
+		"custom_id": reference,
+	}
+
+	var refund paypalPayment
+	path := "/v2/payments/captures/" + url.PathEscape(txn.ProviderTxnID) + "/refund"
+	if err := pc.do(ctx, http.MethodPost, path, reference, body, &refund); err != nil {
+		return paypalErrorResult("", err)
+	}
+
+	result := &ProviderResult{ProviderTxnID: refund.ID}
+	switch refund.Status {
+	case "COMPLETED":
+		result.Status = StatusRefunded
+	case "PENDING":
+		result.Status = StatusProcessing
+	default:
+		result.Status = StatusFailed
+		result.FailureCode = strings.ToLower(firstNonEmpty(refund.StatusDetails.Reason, refund.Status))
+	}
+	return result, nil
+}
+
+// Void voids the authorization in txn.ProviderTxnID
+func (pc *PayPalClient) Void(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	path := "/v2/payments/authorizations/" + url.PathEscape(txn.ProviderTxnID) + "/void"
+	if err := pc.do(ctx, http.MethodPost, path, txn.ID+":void", nil, nil); err != nil {
+		return paypalErrorResult(txn.ProviderTxnID, err)
+	}
+	return &ProviderResult{ProviderTxnID: txn.ProviderTxnID, Status: StatusVoided}, nil
+}
+
+// AuthorizationWindow is PayPal's 29 day authorization validity. Only the
+// first 3 days are the honor period in which funds are guaranteed.
+func (pc *PayPalClient) AuthorizationWindow() time.Duration {
+	return 29 * 24 * time.Hour
+}
+
+// AcceptsPaymentMethod accepts a vaulted payment token, or none when the
+// payer approves the order. A Stripe PaymentMethod ID is never a PayPal token.
+func (pc *PayPalClient) AcceptsPaymentMethod(token string) bool {
+	return !strings.HasPrefix(token, "pm_")
+}
+
+// HealthCheck makes a cheap authenticated call to the PayPal API
+func (pc *PayPalClient) HealthCheck(ctx context.Context) error {
+	return pc.do(ctx, http.MethodGet, "/v1/notifications/webhooks-event-types", "", nil, nil)
+}
+
+// paypalAuthorizationResult maps an authorized order onto our statuses
+func paypalAuthorizationResult(order *paypalOrder) *ProviderResult {
+	auth := order.authorization()
+	if auth == nil {
+		return &ProviderResult{ProviderTxnID: order.ID, Status: StatusProcessing}
+	}
+
+	result := &ProviderResult{ProviderTxnID: auth.ID}
+	switch auth.Status {
+	case "CREATED":
+		result.Status = StatusAuthorized
+	case "PENDING":
+		result.Status = StatusProcessing
+		result.FailureCode = strings.ToLower(auth.StatusDetails.Reason)
+	default:
+		result.Status = StatusFailed
+		result.FailureCode = strings.ToLower(firstNonEmpty(auth.StatusDetails.Reason, auth.Status))
+	}
+	return result
+}
+
+// paypalBlockingIssues are issues that indicate a risk or compliance refusal
+var paypalBlockingIssues = map[string]bool{
+	"COMPLIANCE_VIOLATION":      true,
+	"PAYEE_BLOCKED_TRANSACTION": true,
+}
+
+// paypalErrorResult maps a PayPal decline onto a transaction result.
+// Server and network errors are returned as errors.
+func paypalErrorResult(providerTxnID string, err error) (*ProviderResult, error) {
+	var ppErr *PayPalError
+	if !errors.As(err, &ppErr) || ppErr.StatusCode >= 500 || ppErr.StatusCode == http.StatusUnauthorized {
+		return nil, err
+	}
+
+	issue := ppErr.Issue()
+	status := StatusFailed
+	if paypalBlockingIssues[issue] {
+		status = StatusBlocked
+	}
+
+	return &ProviderResult{
+		ProviderTxnID:  providerTxnID,
+		Status:         status,
+		FailureCode:    strings.ToLower(issue),
+		FailureMessage: ppErr.Message,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
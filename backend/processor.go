@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ProviderResult is the outcome of a provider call mapped onto our statuses
+type ProviderResult struct {
+	ProviderTxnID  string
+	Status         string
+	FailureCode    string
+	FailureMessage string
+	// NextActionURL is where the payer completes a pending payment, if any
+	NextActionURL string
+}
+
+// PaymentProcessor charges approved transactions through their payment
+// provider. It is shared by CreateTransaction and the manual review workflow
+// so that both paths process payments the same way.
+type PaymentProcessor struct {
+	db           *DatabaseConnection
+	broker       *MessageBroker
+	cache        *CacheService
+	registry     *ProviderRegistry
+	maxProviders int
+}
+
+func NewPaymentProcessor(db *DatabaseConnection, broker *MessageBroker, cache *CacheService, registry *ProviderRegistry) *PaymentProcessor {
+	return &PaymentProcessor{
+		db:           db,
+		broker:       broker,
+		cache:        cache,
+		registry:     registry,
+		maxProviders: getEnvInt("FAILOVER_MAX_PROVIDERS", 3),
+	}
+}
+
+// Submit charges txn and stores the outcome. Providers in txn.RetryPlan are
+// tried in order while they soft-decline; a hard decline or success ends the
+// plan. A timed-out call also ends it and leaves txn processing until the
+// provider's webhook says how it ended. Every provider call is recorded in
+// payment_attempts. txn is updated in place with the resulting status,
+// provider and provider reference. An error means the outcome could not be
+// stored and txn may be stale.
+func (pp *PaymentProcessor) Submit(ctx context.Context, txn *Transaction) error {
+	plan := txn.RetryPlan
+	if len(plan) == 0 {
+		plan = []string{txn.Provider}
+	}
+	if len(plan) > pp.maxProviders {
+		plan = plan[:pp.maxProviders]
+	}
+
+	var result *ProviderResult
+	for i, provider := range plan {
+		txn.Provider = provider
+		started := time.Now()
+		var err error
+		result, err = pp.charge(ctx, txn)
+		if err != nil {
+			log.Printf("Provider call failed: TxnID=%s, Provider=%s, Error=%v", txn.ID, txn.Provider, err)
+			result = &ProviderResult{
+				Status:         StatusFailed,
+				FailureCode:    providerErrorCode(err),
+				FailureMessage: "Payment provider request failed",
+			}
+			if result.FailureCode == "provider_timeout" {
+				// The provider may have charged anyway, so the payer must not
+				// be charged again elsewhere
+				result.Status = StatusProcessing
+			}
+		}
+		pp.recordAttempt(txn, i+1, result, err, time.Since(started))
+
+		if !isSoftDecline(result) || ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(plan) {
+			log.Printf("Failing over: TxnID=%s, From=%s, To=%s, Code=%s", txn.ID, provider, plan[i+1], result.FailureCode)
+		}
+	}
+
+	return pp.applyResult(txn, result)
+}
+
+// charge authorizes txn and captures the full amount straight away. A
+// declined capture voids the authorization, so failing over never leaves a
+// hold with this provider; if the void fails, txn stays authorized.
+func (pp *PaymentProcessor) charge(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	provider, ok := pp.registry.Get(txn.Provider)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", txn.Provider)
+	}
+
+	authorized, err := provider.Authorize(ctx, txn)
+	if err != nil || authorized.Status != StatusAuthorized || txn.CaptureMethod == CaptureManual {
+		return authorized, err
+	}
+
+	authTxn := *txn
+	authTxn.ProviderTxnID = authorized.ProviderTxnID
+	captured, err := provider.Capture(ctx, &authTxn, txn.Amount)
+	if err != nil {
+		// Keep the authorization so the capture can be retried or voided
+		log.Printf("Capture failed, leaving transaction authorized: TxnID=%s, Provider=%s, Error=%v", txn.ID, txn.Provider, err)
+		return authorized, nil
+	}
+	if captured.Status == StatusFailed || captured.Status == StatusBlocked {
+		voided, err := provider.Void(ctx, &authTxn)
+		if err != nil || voided.Status != StatusVoided {
+			log.Printf("Void after declined capture failed, leaving transaction authorized: TxnID=%s, Provider=%s, Error=%v", txn.ID, txn.Provider, err)
+			return authorized, nil
+		}
+	}
+	return captured, nil
+}
+
+// applyResult persists a provider result and publishes payment.<status>
+func (pp *PaymentProcessor) applyResult(txn *Transaction, result *ProviderResult) error {
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		updated, err := setTransactionStatus(tx, txn.ID, result.Status, "provider:"+txn.Provider, result.FailureCode)
+		if err != nil {
+			return err
+		}
+
+		if updated.Status == StatusAuthorized && updated.AuthorizationExpiresAt == nil {
+			if provider, ok := pp.registry.Get(txn.Provider); ok {
+				expiresAt := time.Now().Add(provider.AuthorizationWindow())
+				updated.AuthorizationExpiresAt = &expiresAt
+			}
+		}
+
+		query := `
+			UPDATE transactions
+			SET provider = $1, provider_txn_id = COALESCE(NULLIF($2, ''), provider_txn_id), failure_code = NULLIF($3, ''), failure_message = NULLIF($4, ''), authorization_expires_at = $5
+			WHERE id = $6
+		`
+		if _, err := tx.Exec(query, txn.Provider, result.ProviderTxnID, result.FailureCode, result.FailureMessage, updated.AuthorizationExpiresAt, txn.ID); err != nil {
+			return err
+		}
+		txn.AuthorizationExpiresAt = updated.AuthorizationExpiresAt
+
+		txn.Status = updated.Status
+		txn.UpdatedAt = updated.UpdatedAt
+		if result.ProviderTxnID != "" {
+			txn.ProviderTxnID = result.ProviderTxnID
+		}
+		txn.FailureCode = result.FailureCode
+		txn.FailureMessage = result.FailureMessage
+		txn.NextActionURL = result.NextActionURL
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store provider result for %s: %v", txn.ID, err)
+		return err
+	}
+
+	pp.cache.Set(txn.ID, *txn, 5*time.Minute)
+	// The result is stored; a lost event must not fail the payment
+	if err := pp.broker.PublishEvent("payment."+txn.Status, txn); err != nil {
+		log.Printf("Failed to publish payment.%s for %s: %v", txn.Status, txn.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// scriptedProvider is a sandbox whose authorize and capture outcomes are
+// fixed by the test, and which counts its voids
+type scriptedProvider struct {
+	*SandboxProvider
+	authorize *ProviderResult
+	authErr   error
+	capture   *ProviderResult
+	voids     int
+}
+
+func (sp *scriptedProvider) Authorize(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	if sp.authErr != nil {
+		return nil, sp.authErr
+	}
+	result := *sp.authorize
+	return &result, nil
+}
+
+func (sp *scriptedProvider) Capture(ctx context.Context, txn *Transaction, amount Money) (*ProviderResult, error) {
+	result := *sp.capture
+	return &result, nil
+}
+
+func (sp *scriptedProvider) Void(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	sp.voids++
+	return &ProviderResult{ProviderTxnID: txn.ProviderTxnID, Status: StatusVoided}, nil
+}
+
+func TestSubmitFailover(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+
+	authorized := &ProviderResult{ProviderTxnID: "auth_1", Status: StatusAuthorized}
+	completed := &ProviderResult{ProviderTxnID: "cap_1", Status: StatusCompleted}
+	softDecline := &ProviderResult{Status: StatusFailed, FailureCode: "processing_error"}
+
+	tests := []struct {
+		name         string
+		first        *scriptedProvider
+		wantStatus   string
+		wantProvider string
+		wantAttempts int
+		wantVoids    int
+	}{
+		{
+			name:         "soft decline fails over",
+			first:        &scriptedProvider{authorize: softDecline},
+			wantStatus:   StatusCompleted,
+			wantProvider: "second",
+			wantAttempts: 2,
+		},
+		{
+			name:         "declined capture is voided before failing over",
+			first:        &scriptedProvider{authorize: authorized, capture: softDecline},
+			wantStatus:   StatusCompleted,
+			wantProvider: "second",
+			wantAttempts: 2,
+			wantVoids:    1,
+		},
+		{
+			name:         "timeout waits for the provider",
+			first:        &scriptedProvider{authErr: context.DeadlineExceeded},
+			wantStatus:   StatusProcessing,
+			wantProvider: "first",
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.first.SandboxProvider = &SandboxProvider{}
+			second := &scriptedProvider{SandboxProvider: &SandboxProvider{}, authorize: authorized, capture: completed}
+			th.processor.registry.mu.Lock()
+			th.processor.registry.providers["first"] = tt.first
+			th.processor.registry.providers["second"] = second
+			th.processor.registry.mu.Unlock()
+
+			now := time.Now()
+			txn := &Transaction{
+				ID:                 uuid.New().String(),
+				UserID:             "user_001",
+				Amount:             NewMoney(10000, "USD"),
+				Currency:           "USD",
+				Status:             StatusProcessing,
+				Provider:           "first",
+				RetryPlan:          []string{"first", "second"},
+				PaymentMethod:      "pm_test",
+				CaptureMethod:      CaptureAutomatic,
+				SettlementAmount:   NewMoney(10000, "USD"),
+				SettlementCurrency: "USD",
+				FXRate:             "1",
+				CreatedAt:          now,
+				UpdatedAt:          now,
+			}
+			if err := db.WithTransaction(func(tx *sql.Tx) error { return insertTransaction(tx, txn) }); err != nil {
+				t.Fatal(err)
+			}
+			if err := th.processor.Submit(context.Background(), txn); err != nil {
+				t.Fatal(err)
+			}
+
+			got := getTestTransaction(t, db, txn.ID)
+			if got.Status != tt.wantStatus || got.Provider != tt.wantProvider {
+				t.Errorf("transaction = %s with %s, want %s with %s", got.Status, got.Provider, tt.wantStatus, tt.wantProvider)
+			}
+			attempts, err := listPaymentAttempts(db, txn.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attempts) != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", len(attempts), tt.wantAttempts)
+			}
+			if tt.first.voids != tt.wantVoids {
+				t.Errorf("%d voids, want %d", tt.first.voids, tt.wantVoids)
+			}
+		})
+	}
+}
@@ -1,62 +1,247 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
 )
 
-// CallFraudDetectionService calls the Python AI service for fraud detection
-func CallFraudDetectionService(req PaymentRequest) (float64, bool) {
-	// In production, this would call the Python FastAPI service via HTTP
-	// For now, we return a simulated response based on amount
-	
+// CallFraudDetectionService calls the Python AI service for fraud detection,
+// falling back to an amount-based heuristic when the service is unavailable
+func CallFraudDetectionService(ctx context.Context, client *FraudClient, txnID string, req PaymentRequest, user *User) *FraudDetectionResponse {
+	data := FraudDetectionRequest{
+		UserID:            req.UserID,
+		Amount:            req.Amount,
+		Currency:          req.Currency,
+		MerchantCategory:  req.MerchantCategory,
+		DeviceFingerprint: req.DeviceFingerprint,
+		IPCountry:         req.IPCountry,
+	}
+	if user != nil {
+		data.PreviousTransactionCount = user.TransactionCount
+		data.AccountAgeDays = user.AccountAgeDays()
+	}
+
+	result, err := client.Predict(ctx, txnID, data)
+	if err != nil {
+		log.Printf("Fraud service unavailable, using heuristic: TxnID=%s, Error=%v", txnID, err)
+		result = heuristicFraudScore(txnID, req)
+	}
+
+	log.Printf("Fraud detection: Amount=%s, RiskScore=%.2f, FraudDetected=%v, Recommendation=%s", req.Amount, result.RiskScore, result.IsFraud, result.Recommendation)
+	return result
+}
+
+// heuristicFraudScore returns a simulated response based on amount
+func heuristicFraudScore(txnID string, req PaymentRequest) *FraudDetectionResponse {
+	amount := req.Amount.Float64()
 	riskScore := 0.0
-	if req.Amount > 5000 {
+	if amount > 5000 {
 		riskScore = 0.75
-	} else if req.Amount > 1000 {
+	} else if amount > 1000 {
 		riskScore = 0.45
-	} else if req.Amount > 100 {
+	} else if amount > 100 {
 		riskScore = 0.15
 	}
 
 	fraudDetected := riskScore > 0.7
 
-	log.Printf("Fraud detection: Amount=%.2f, RiskScore=%.2f, FraudDetected=%v", req.Amount, riskScore, fraudDetected)
-	return riskScore, fraudDetected
+	riskFactors := []string{}
+	if amount > 5000 {
+		riskFactors = append(riskFactors, "High transaction amount")
+	}
+
+	recommendation := "APPROVE"
+	if fraudDetected {
+		recommendation = "BLOCK"
+	}
+
+	return &FraudDetectionResponse{
+		TransactionID:  txnID,
+		RiskScore:      riskScore,
+		IsFraud:        fraudDetected,
+		RiskFactors:    riskFactors,
+		Recommendation: recommendation,
+		Fallback:       true,
+	}
+}
+
+// Provider statuses. disabled is set by operators and never changed by the
+// health checker; routing only uses active and degraded providers.
+const (
+	ProviderActive   = "active"
+	ProviderDegraded = "degraded"
+	ProviderDown     = "down"
+	ProviderDisabled = "disabled"
+)
+
+// PaymentProvider is implemented by every acquirer adapter. Amounts are in
+// txn.Currency; results are mapped onto our statuses.
+type PaymentProvider interface {
+	// Authorize reserves txn.Amount on the payment method, returning
+	// StatusAuthorized with the provider reference needed to capture or void
+	Authorize(ctx context.Context, txn *Transaction) (*ProviderResult, error)
+	// Capture collects amount from the authorization in txn.ProviderTxnID
+	Capture(ctx context.Context, txn *Transaction, amount Money) (*ProviderResult, error)
+	// Refund returns amount of a captured payment. reference identifies the
+	// refund on our side and keeps retries idempotent.
+	Refund(ctx context.Context, txn *Transaction, amount Money, reference string) (*ProviderResult, error)
+	// Void releases an uncaptured authorization
+	Void(ctx context.Context, txn *Transaction) (*ProviderResult, error)
+	// AuthorizationWindow is how long an authorization can still be captured
+	AuthorizationWindow() time.Duration
+	// AcceptsPaymentMethod reports whether token is a payment method this
+	// provider can charge, so failover skips providers that would decline it
+	AcceptsPaymentMethod(token string) bool
+	// HealthCheck returns an error when the provider API cannot be used
+	HealthCheck(ctx context.Context) error
+	// FeeQuote returns what the provider charges for a payment, converting
+	// fees set in another currency at rates
+	FeeQuote(amount Money, rates fxRates) (FeeQuote, error)
+}
+
+// FeeQuote is the processing cost of a payment with one provider
+type FeeQuote struct {
+	Percentage float64 `json:"percentage"`
+	Fixed      Money   `json:"fixed"`
+	Total      Money   `json:"total"`
+	Currency   string  `json:"currency"`
+}
+
+// captureIdempotencyKey keys a provider capture call on its amount. A
+// retried call is deduplicated, while a capture for another amount after a
+// decline is not rejected as a reused key.
+func captureIdempotencyKey(txn *Transaction, amount Money) string {
+	return fmt.Sprintf("%s:capture:%d", txn.ID, amount.Minor)
 }
 
-// SelectPaymentProvider selects the best payment provider based on logic
-func SelectPaymentProvider(amount float64) string {
-	// Smart routing logic: use Stripe for smaller transactions, PayPal for larger
-	if amount > 1000 {
-		return "paypal"
+// FeeSchedule implements FeeQuote from the fees configured in
+// payment_providers. Adapters embed it.
+type FeeSchedule struct {
+	Percentage float64
+	Fixed      Money // in payment_providers.fixed_fee_currency
+}
+
+func (fs FeeSchedule) FeeQuote(amount Money, rates fxRates) (FeeQuote, error) {
+	fixed := NewMoney(0, amount.Currency)
+	if !fs.Fixed.IsZero() {
+		var err error
+		if fixed, err = rates.convert(fs.Fixed, amount.Currency); err != nil {
+			return FeeQuote{}, fmt.Errorf("fixed fee: %w", err)
+		}
 	}
-	return "stripe"
+	return FeeQuote{
+		Percentage: fs.Percentage,
+		Fixed:      fixed,
+		Total:      amount.MulRate(fs.Percentage).Add(fixed),
+		Currency:   amount.Currency,
+	}, nil
+}
+
+// providerFactories builds an adapter for each payment_providers.code. A new
+// acquirer is added by implementing PaymentProvider and registering it here.
+var providerFactories = map[string]func(cfg ProviderConfig) PaymentProvider{
+	"stripe": func(cfg ProviderConfig) PaymentProvider {
+		return NewStripeClient(cfg.FeeSchedule())
+	},
+	"paypal": func(cfg ProviderConfig) PaymentProvider {
+		return NewPayPalClient(cfg.FeeSchedule())
+	},
+	"sandbox": func(cfg ProviderConfig) PaymentProvider {
+		return NewSandboxProvider(cfg.FeeSchedule())
+	},
 }
 
-// ProcessStripePayment processes payment via Stripe
-func ProcessStripePayment(txnID string, amount float64, token string) (string, error) {
-	// Integration with Stripe API
-	log.Printf("Processing Stripe payment: TxnID=%s, Amount=%.2f", txnID, amount)
-	
-	// This would use the Stripe SDK in production
-	providerTxnID := "stripe_" + txnID
-	return providerTxnID, nil
+// ProviderRegistry holds an adapter for every row in payment_providers,
+// keyed by code, which is the value stored in transactions.provider
+type ProviderRegistry struct {
+	db        *DatabaseConnection
+	providers map[string]PaymentProvider
+	configs   []ProviderConfig
+	mu        sync.RWMutex
 }
 
-// ProcessPayPalPayment processes payment via PayPal
-func ProcessPayPalPayment(txnID string, amount float64, email string) (string, error) {
-	// Integration with PayPal API
-	log.Printf("Processing PayPal payment: TxnID=%s, Amount=%.2f, Email=%s", txnID, amount, email)
-	
-	// This would use the PayPal SDK in production
-	providerTxnID := "paypal_" + txnID
-	return providerTxnID, nil
+func NewProviderRegistry(db *DatabaseConnection) (*ProviderRegistry, error) {
+	pr := &ProviderRegistry{db: db, providers: make(map[string]PaymentProvider)}
+	if err := pr.Load(); err != nil {
+		return nil, err
+	}
+	return pr, nil
 }
 
-// GetProviderStatus checks the status of a payment provider
-func GetProviderStatus(provider string) bool {
-	// Check provider status via their health endpoint
-	// For now, assume both are always up
-	return true
+// Load reads payment_providers and rebuilds adapters whose configuration changed
+func (pr *ProviderRegistry) Load() error {
+	configs, err := listProviderConfigs(pr.db)
+	if err != nil {
+		return err
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	previous := make(map[string]ProviderConfig, len(pr.configs))
+	for _, cfg := range pr.configs {
+		previous[cfg.Code] = cfg
+	}
+
+	providers := make(map[string]PaymentProvider, len(configs))
+	for _, cfg := range configs {
+		factory, ok := providerFactories[cfg.Code]
+		if !ok {
+			log.Printf("No adapter registered for payment provider %s (%s)", cfg.ID, cfg.Code)
+			continue
+		}
+		// Keep existing adapters so cached state such as OAuth tokens survives
+		if existing, ok := pr.providers[cfg.Code]; ok && previous[cfg.Code].FeeSchedule() == cfg.FeeSchedule() {
+			providers[cfg.Code] = existing
+			continue
+		}
+		providers[cfg.Code] = factory(cfg)
+	}
+
+	pr.providers = providers
+	pr.configs = configs
+	return nil
+}
+
+// Get returns the adapter for a provider code
+func (pr *ProviderRegistry) Get(code string) (PaymentProvider, bool) {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	p, ok := pr.providers[code]
+	return p, ok
+}
+
+// Configs returns the provider configuration as last loaded
+func (pr *ProviderRegistry) Configs() []ProviderConfig {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return append([]ProviderConfig(nil), pr.configs...)
+}
+
+func listProviderConfigs(db *DatabaseConnection) ([]ProviderConfig, error) {
+	query := `SELECT id, code, name, fee, fixed_fee, fixed_fee_currency, currencies, status, last_checked FROM payment_providers ORDER BY name`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configs []ProviderConfig
+	for rows.Next() {
+		var p ProviderConfig
+		var fixedFee moneyColumn
+		if err := rows.Scan(&p.ID, &p.Code, &p.Name, &p.Fee, &fixedFee, &p.FixedFeeCurrency, pq.Array(&p.Currencies), &p.Status, &p.LastChecked); err != nil {
+			return nil, err
+		}
+		if p.FixedFee, err = fixedFee.money(p.FixedFeeCurrency); err != nil {
+			return nil, fmt.Errorf("provider %s fixed_fee: %w", p.ID, err)
+		}
+		configs = append(configs, p)
+	}
+	return configs, rows.Err()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestFeeQuote(t *testing.T) {
+	rates := fxRates{"USD": {"EUR": big.NewRat(9, 10), "JPY": big.NewRat(150, 1)}}
+	stripe := FeeSchedule{Percentage: 0.029, Fixed: NewMoney(30, "USD")}
+
+	tests := []struct {
+		name      string
+		fees      FeeSchedule
+		amount    Money
+		wantFixed Money
+		wantTotal Money
+		wantErr   error
+	}{
+		{name: "same currency", fees: stripe, amount: NewMoney(10000, "USD"), wantFixed: NewMoney(30, "USD"), wantTotal: NewMoney(320, "USD")},
+		{name: "converted fixed fee", fees: stripe, amount: NewMoney(10000, "EUR"), wantFixed: NewMoney(27, "EUR"), wantTotal: NewMoney(317, "EUR")},
+		{name: "zero-decimal currency", fees: stripe, amount: NewMoney(10000, "JPY"), wantFixed: NewMoney(45, "JPY"), wantTotal: NewMoney(335, "JPY")},
+		{name: "inverse rate", fees: FeeSchedule{Fixed: NewMoney(27, "EUR")}, amount: NewMoney(10000, "USD"), wantFixed: NewMoney(30, "USD"), wantTotal: NewMoney(30, "USD")},
+		{name: "no fixed fee needs no rate", fees: FeeSchedule{Percentage: 0.01}, amount: NewMoney(10000, "GBP"), wantFixed: NewMoney(0, "GBP"), wantTotal: NewMoney(100, "GBP")},
+		{name: "no rate", fees: stripe, amount: NewMoney(10000, "GBP"), wantErr: errFXRateUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote, err := tt.fees.FeeQuote(tt.amount, rates)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("FeeQuote error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FeeQuote error: %v", err)
+			}
+			if quote.Fixed != tt.wantFixed || quote.Total != tt.wantTotal || quote.Currency != tt.amount.Currency {
+				t.Errorf("FeeQuote = fixed %v, total %v %s, want %v, %v", quote.Fixed, quote.Total, quote.Currency, tt.wantFixed, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestAcceptsPaymentMethod(t *testing.T) {
+	tests := []struct {
+		token   string
+		stripe  bool
+		paypal  bool
+		sandbox bool
+	}{
+		{token: "pm_card_visa", stripe: true, paypal: false, sandbox: true},
+		{token: "8kk8451t", stripe: false, paypal: true, sandbox: true},
+		{token: "", stripe: false, paypal: true, sandbox: true},
+		{token: "sandbox_decline", stripe: false, paypal: true, sandbox: true},
+	}
+
+	for _, tt := range tests {
+		if got := (&StripeClient{}).AcceptsPaymentMethod(tt.token); got != tt.stripe {
+			t.Errorf("stripe accepts %q = %v, want %v", tt.token, got, tt.stripe)
+		}
+		if got := (&PayPalClient{}).AcceptsPaymentMethod(tt.token); got != tt.paypal {
+			t.Errorf("paypal accepts %q = %v, want %v", tt.token, got, tt.paypal)
+		}
+		if got := (&SandboxProvider{}).AcceptsPaymentMethod(tt.token); got != tt.sandbox {
+			t.Errorf("sandbox accepts %q = %v, want %v", tt.token, got, tt.sandbox)
+		}
+	}
+}
+
+func TestCaptureIdempotencyKey(t *testing.T) {
+	txn := &Transaction{ID: "txn_1"}
+	full := captureIdempotencyKey(txn, NewMoney(10000, "USD"))
+	if again := captureIdempotencyKey(txn, NewMoney(10000, "USD")); again != full {
+		t.Errorf("retried capture key = %q, want %q", again, full)
+	}
+	if partial := captureIdempotencyKey(txn, NewMoney(4000, "USD")); partial == full {
+		t.Errorf("capture of another amount reuses key %q", full)
+	}
+}
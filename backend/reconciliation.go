@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Mismatch types
+const (
+	MismatchMissingInternal   = "missing_internal"    // in a provider report, not in our records
+	MismatchMissingAtProvider = "missing_at_provider" // captured or refunded by us, in no provider report
+	MismatchAmount            = "amount_mismatch"
+)
+
+// Mismatch statuses
+const (
+	MismatchOpen     = "open"
+	MismatchResolved = "resolved"
+)
+
+// reconcilerName is recorded as resolved_by when a mismatch no longer applies
+const reconcilerName = "reconciliation"
+
+var (
+	errMismatchNotFound = errors.New("mismatch not found")
+	errMismatchResolved = errors.New("mismatch is already resolved")
+)
+
+// SettlementReconciled is published as settlement.reconciled when a run
+// finds new mismatches or resolves old ones
+type SettlementReconciled struct {
+	ReportID       string `json:"report_id"`
+	Provider       string `json:"provider"`
+	NewMismatches  int    `json:"new_mismatches"`
+	Resolved       int    `json:"resolved"`
+	OpenMismatches int    `json:"open_mismatches"`
+}
+
+// mismatchFinding is one difference found by a reconciliation run
+type mismatchFinding struct {
+	Type          string
+	Kind          string
+	Reference     string
+	TransactionID string
+	Internal      *Money
+	Provider      *Money
+}
+
+// Reconciler matches imported settlement reports against our transactions
+// and refunds. Reports are reconciled when they are imported, and again
+// every interval while they have open mismatches, since a later report, a
+// webhook or a refund can settle them.
+type Reconciler struct {
+	db     *DatabaseConnection
+	broker *MessageBroker
+}
+
+func NewReconciler(db *DatabaseConnection, broker *MessageBroker) *Reconciler {
+	r := &Reconciler{db: db, broker: broker}
+	go r.run(getEnvDuration("RECONCILIATION_INTERVAL", time.Hour))
+	return r
+}
+
+func (r *Reconciler) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.ReconcilePending()
+	}
+}
+
+// ReconcilePending reconciles reports that have never been reconciled and
+// those with open mismatches
+func (r *Reconciler) ReconcilePending() {
+	query := `
+		SELECT id FROM settlement_reports s
+		WHERE reconciled_at IS NULL
+			OR EXISTS (SELECT 1 FROM reconciliation_mismatches m WHERE m.report_id = s.id AND m.status = $1)
+		ORDER BY created_at
+	`
+	rows, err := r.db.Query(query, MismatchOpen)
+	if err != nil {
+		log.Printf("Failed to load settlement reports to reconcile: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Failed to scan settlement report: %v", err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := r.Reconcile(id); err != nil {
+			log.Printf("Failed to reconcile settlement report %s: %v", id, err)
+		}
+	}
+}
+
+// Reconcile compares one report with our records and stores what differs.
+// Open mismatches of the report that no longer apply are resolved.
+func (r *Reconciler) Reconcile(reportID string) (*SettlementReconciled, error) {
+	var result *SettlementReconciled
+	err := r.db.WithTransaction(func(tx *sql.Tx) error {
+		var provider string
+		var periodStart, periodEnd sql.NullTime
+		// Locking the report keeps the job and an import from reconciling it at once
+		query := `SELECT provider, period_start, period_end FROM settlement_reports WHERE id = $1 FOR UPDATE`
+		if err := tx.QueryRow(query, reportID).Scan(&provider, &periodStart, &periodEnd); err != nil {
+			if err == sql.ErrNoRows {
+				return errReportNotFound
+			}
+			return err
+		}
+		result = &SettlementReconciled{ReportID: reportID, Provider: provider}
+
+		findings, err := findRowMismatches(tx, reportID)
+		if err != nil {
+			return err
+		}
+		if periodStart.Valid && periodEnd.Valid {
+			missing, err := findMissingAtProvider(tx, provider, periodStart.Time, periodEnd.Time)
+			if err != nil {
+				return err
+			}
+			findings = append(findings, missing...)
+		}
+
+		current := []string{}
+		for _, f := range findings {
+			id, created, err := recordMismatch(tx, reportID, provider, f)
+			if err != nil {
+				return err
+			}
+			if id != "" {
+				current = append(current, id)
+			}
+			if created {
+				result.NewMismatches++
+			}
+		}
+
+		now := time.Now()
+		query = `
+			UPDATE reconciliation_mismatches
+			SET status = $1, resolved_by = $2, resolution = $3, resolved_at = $4, updated_at = $4
+			WHERE report_id = $5 AND status = $6 AND NOT (id = ANY($7))
+		`
+		res, err := tx.Exec(query, MismatchResolved, reconcilerName, "No longer mismatched", now, reportID, MismatchOpen, pq.Array(current))
+		if err != nil {
+			return err
+		}
+		resolved, _ := res.RowsAffected()
+		result.Resolved = int(resolved)
+
+		query = `SELECT COUNT(*) FROM reconciliation_mismatches WHERE report_id = $1 AND status = $2`
+		if err := tx.QueryRow(query, reportID, MismatchOpen).Scan(&result.OpenMismatches); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE settlement_reports SET reconciled_at = $1 WHERE id = $2`, now, reportID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.NewMismatches > 0 || result.Resolved > 0 {
+		r.broker.PublishEvent("settlement.reconciled", result)
+	}
+	return result, nil
+}
+
+// findRowMismatches matches a report's payments to our transactions by
+// provider_txn_id and its refunds to our refunds by provider_refund_id.
+// Rows for the same reference are added together, and amounts are compared
+// without their sign. A row in the settlement currency, such as a Stripe
+// balance transaction for a payment taken in another currency, is compared
+// with the amount we settled at.
+func findRowMismatches(tx *sql.Tx, reportID string) ([]mismatchFinding, error) {
+	query := `
+		WITH reported AS (
+			SELECT kind, provider, COALESCE(provider_reference, row_id) AS reference, currency, SUM(gross) AS gross
+			FROM settlement_report_rows
+			WHERE report_id = $1 AND kind IN ($2, $3)
+			GROUP BY kind, provider, COALESCE(provider_reference, row_id), currency
+		)
+		SELECT r.kind, r.reference, r.gross, r.currency, COALESCE(t.id, f.transaction_id, ''),
+			CASE WHEN r.kind = $2 THEN t.captured_amount WHEN f.status = $4 THEN 0 ELSE f.amount END,
+			COALESCE(t.currency, f.currency, ''),
+			COALESCE(t.amount, ft.amount), COALESCE(t.settlement_amount, ft.settlement_amount),
+			COALESCE(t.settlement_currency, ft.settlement_currency, ''), COALESCE(t.fx_rate, ft.fx_rate)
+		FROM reported r
+		LEFT JOIN transactions t ON r.kind = $2 AND t.provider = r.provider AND t.provider_txn_id = r.reference
+		LEFT JOIN refunds f ON r.kind = $3 AND f.provider = r.provider AND f.provider_refund_id = r.reference
+		LEFT JOIN transactions ft ON ft.id = f.transaction_id
+	`
+	rows, err := tx.Query(query, reportID, SettlementPayment, SettlementRefund, RefundFailed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []mismatchFinding
+	for rows.Next() {
+		var f mismatchFinding
+		var gross moneyColumn
+		var currency, internalCurrency, settlementCurrency string
+		var internal, txnAmount, settlementAmount, fxRate sql.NullString
+		if err := rows.Scan(&f.Kind, &f.Reference, &gross, &currency, &f.TransactionID, &internal, &internalCurrency,
+			&txnAmount, &settlementAmount, &settlementCurrency, &fxRate); err != nil {
+			return nil, err
+		}
+		reported, err := gross.money(currency)
+		if err != nil {
+			return nil, err
+		}
+		if reported.IsNegative() {
+			reported = reported.Neg()
+		}
+		f.Provider = &reported
+
+		if !internal.Valid {
+			f.Type = MismatchMissingInternal
+			findings = append(findings, f)
+			continue
+		}
+		ours, err := moneyColumn(internal.String).money(internalCurrency)
+		if err != nil {
+			return nil, err
+		}
+		if reported.Currency != ours.Currency && reported.Currency == settlementCurrency {
+			txn := &Transaction{SettlementCurrency: settlementCurrency, FXRate: json.Number(fxRate.String)}
+			if txn.Amount, err = moneyColumn(txnAmount.String).money(internalCurrency); err != nil {
+				return nil, err
+			}
+			if txn.SettlementAmount, err = moneyColumn(settlementAmount.String).money(settlementCurrency); err != nil {
+				return nil, err
+			}
+			ours = txn.settled(ours)
+		}
+		if ours.Currency != reported.Currency || ours.Cmp(reported) != 0 {
+			f.Type = MismatchAmount
+			f.Internal = &ours
+			findings = append(findings, f)
+		}
+	}
+	return findings, rows.Err()
+}
+
+// findMissingAtProvider finds payments captured and refunds that succeeded
+// with provider during a report's period that appear in none of the
+// provider's reports. Capture times come from the ledger.
+func findMissingAtProvider(tx *sql.Tx, provider string, from, to time.Time) ([]mismatchFinding, error) {
+	query := `
+		SELECT $4::text, t.id, COALESCE(NULLIF(t.provider_txn_id, ''), t.id), t.captured_amount, t.currency
+		FROM transactions t
+		JOIN journal_entries e ON e.reference_type = $5 AND e.reference_id = t.id
+		WHERE t.provider = $1 AND e.created_at BETWEEN $2 AND $3
+			AND NOT EXISTS (SELECT 1 FROM journal_entries x WHERE x.reference_type = $6 AND x.reference_id = t.id)
+			AND NOT EXISTS (SELECT 1 FROM settlement_report_rows r WHERE r.provider = t.provider AND r.kind = $4 AND r.provider_reference = t.provider_txn_id)
+		UNION ALL
+		SELECT $7::text, f.transaction_id, COALESCE(NULLIF(f.provider_refund_id, ''), f.id), f.amount, f.currency
+		FROM refunds f
+		WHERE f.provider = $1 AND f.status = $8 AND f.updated_at BETWEEN $2 AND $3
+			AND NOT EXISTS (SELECT 1 FROM settlement_report_rows r WHERE r.provider = f.provider AND r.kind = $7 AND r.provider_reference = f.provider_refund_id)
+	`
+	rows, err := tx.Query(query, provider, from, to, SettlementPayment, EntryCapture, EntryCaptureReversal, SettlementRefund, RefundSucceeded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []mismatchFinding
+	for rows.Next() {
+		f := mismatchFinding{Type: MismatchMissingAtProvider}
+		var amount moneyColumn
+		var currency string
+		if err := rows.Scan(&f.Kind, &f.TransactionID, &f.Reference, &amount, &currency); err != nil {
+			return nil, err
+		}
+		ours, err := amount.money(currency)
+		if err != nil {
+			return nil, err
+		}
+		f.Internal = &ours
+		findings = append(findings, f)
+	}
+	return findings, rows.Err()
+}
+
+// recordMismatch opens a mismatch, or updates the open one for the same
+// reference and type. A mismatch an analyst resolved is not raised again.
+// It returns the ID of the open mismatch, if any, and whether it is new.
+func recordMismatch(tx *sql.Tx, reportID, provider string, f mismatchFinding) (string, bool, error) {
+	var id, status, resolvedBy string
+	query := `
+		SELECT id, status, COALESCE(resolved_by, '')
+		FROM reconciliation_mismatches
+		WHERE provider = $1 AND kind = $2 AND provider_reference = $3 AND type = $4
+		ORDER BY created_at DESC
+		LIMIT 1
+		FOR UPDATE
+	`
+	err := tx.QueryRow(query, provider, f.Kind, f.Reference, f.Type).Scan(&id, &status, &resolvedBy)
+	if err != nil && err != sql.ErrNoRows {
+		return "", false, err
+	}
+	now := time.Now()
+
+	switch {
+	case err == nil && status == MismatchOpen:
+		query = `
+			UPDATE reconciliation_mismatches
+			SET report_id = $1, transaction_id = NULLIF($2, ''), internal_amount = $3, internal_currency = NULLIF($4, ''),
+				provider_amount = $5, provider_currency = NULLIF($6, ''), updated_at = $7
+			WHERE id = $8
+		`
+		_, err := tx.Exec(query, reportID, f.TransactionID, f.Internal, moneyCurrency(f.Internal), f.Provider, moneyCurrency(f.Provider), now, id)
+		return id, false, err
+	case err == nil && resolvedBy != reconcilerName:
+		return "", false, nil
+	}
+
+	id = uuid.New().String()
+	query = `
+		INSERT INTO reconciliation_mismatches (id, report_id, provider, type, kind, provider_reference, transaction_id,
+			internal_amount, internal_currency, provider_amount, provider_currency, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, NULLIF($9, ''), $10, NULLIF($11, ''), $12, $13, $13)
+	`
+	_, err = tx.Exec(query, id, reportID, provider, f.Type, f.Kind, f.Reference, f.TransactionID,
+		f.Internal, moneyCurrency(f.Internal), f.Provider, moneyCurrency(f.Provider), MismatchOpen, now)
+	return id, true, err
+}
+
+// moneyCurrency is the currency of an amount that may be missing
+func moneyCurrency(m *Money) string {
+	if m == nil {
+		return ""
+	}
+	return m.Currency
+}
+
+const mismatchColumns = `id, report_id, provider, type, kind, provider_reference, COALESCE(transaction_id, ''), internal_amount, COALESCE(internal_currency, ''), provider_amount, COALESCE(provider_currency, ''), status, COALESCE(resolved_by, ''), COALESCE(resolution, ''), created_at, updated_at, resolved_at`
+
+func scanMismatch(row rowScanner, m *ReconciliationMismatch) error {
+	var internal, reported sql.NullString
+	var resolvedAt sql.NullTime
+	err := row.Scan(&m.ID, &m.ReportID, &m.Provider, &m.Type, &m.Kind, &m.ProviderReference, &m.TransactionID, &internal, &m.InternalCurrency,
+		&reported, &m.ProviderCurrency, &m.Status, &m.ResolvedBy, &m.Resolution, &m.CreatedAt, &m.UpdatedAt, &resolvedAt)
+	if err != nil {
+		return err
+	}
+	if internal.Valid {
+		amount, err := moneyColumn(internal.String).money(m.InternalCurrency)
+		if err != nil {
+			return err
+		}
+		m.InternalAmount = &amount
+	}
+	if reported.Valid {
+		amount, err := moneyColumn(reported.String).money(m.ProviderCurrency)
+		if err != nil {
+			return err
+		}
+		m.ProviderAmount = &amount
+	}
+	if resolvedAt.Valid {
+		m.ResolvedAt = &resolvedAt.Time
+	}
+	return nil
+}
+
+// resolveMismatch closes an open mismatch by hand
+func resolveMismatch(tx *sql.Tx, id, analyst, resolution string) (*ReconciliationMismatch, error) {
+	var m ReconciliationMismatch
+	query := `SELECT ` + mismatchColumns + ` FROM reconciliation_mismatches WHERE id = $1 FOR UPDATE`
+	if err := scanMismatch(tx.QueryRow(query, id), &m); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errMismatchNotFound
+		}
+		return nil, err
+	}
+	if m.Status != MismatchOpen {
+		return nil, errMismatchResolved
+	}
+
+	now := time.Now()
+	m.Status, m.ResolvedBy, m.Resolution = MismatchResolved, analyst, resolution
+	m.ResolvedAt, m.UpdatedAt = &now, now
+	query = `UPDATE reconciliation_mismatches SET status = $1, resolved_by = $2, resolution = $3, resolved_at = $4, updated_at = $4 WHERE id = $5`
+	if _, err := tx.Exec(query, m.Status, m.ResolvedBy, m.Resolution, now, m.ID); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListReconciliationMismatches lists mismatches, newest first. They can be
+// filtered by ?status= (default open, or all), ?type=, ?provider= and
+// ?report_id=.
+func (ah *AdminHandler) ListReconciliationMismatches(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	status := c.DefaultQuery("status", MismatchOpen)
+	if status == "all" {
+		status = ""
+	}
+
+	query := `
+		SELECT ` + mismatchColumns + `
+		FROM reconciliation_mismatches
+		WHERE ($1::text = '' OR status = $1) AND ($2::text = '' OR type = $2) AND ($3::text = '' OR provider = $3) AND ($4::text = '' OR report_id = $4)
+		ORDER BY created_at DESC
+		LIMIT $5
+	`
+	rows, err := ah.db.Query(query, status, c.Query("type"), c.Query("provider"), c.Query("report_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch reconciliation mismatches",
+		})
+		return
+	}
+	defer rows.Close()
+
+	mismatches := []ReconciliationMismatch{}
+	for rows.Next() {
+		var m ReconciliationMismatch
+		if err := scanMismatch(rows, &m); err != nil {
+			continue
+		}
+		mismatches = append(mismatches, m)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    mismatches,
+	})
+}
+
+// ResolveReconciliationMismatch closes a mismatch an analyst has dealt with,
+// for example a payout that was corrected by hand
+func (ah *AdminHandler) ResolveReconciliationMismatch(c *gin.Context) {
+	analyst, ok := analystFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Resolution string `json:"resolution" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	var mismatch *ReconciliationMismatch
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		mismatch, err = resolveMismatch(tx, c.Param("id"), analyst, req.Resolution)
+		return err
+	})
+	switch {
+	case err == errMismatchNotFound:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Mismatch not found"})
+		return
+	case err == errMismatchResolved:
+		c.JSON(http.StatusConflict, APIResponse{Success: false, Error: err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to resolve reconciliation mismatch %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to resolve mismatch"})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    mismatch,
+		Message: "Mismatch resolved",
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// redisClient is a minimal RESP client that works with Redis and compatible
+// servers (Valkey, KeyDB, Dragonfly). It holds one connection and pipelines
+// commands over it.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	conn     net.Conn
+	rd       *bufio.Reader
+	mu       sync.Mutex
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis scheme %q", u.Scheme)
+	}
+
+	rc := &redisClient{addr: u.Host, timeout: getEnvDuration("REDIS_TIMEOUT", 500*time.Millisecond)}
+	if !strings.Contains(rc.addr, ":") {
+		rc.addr += ":6379"
+	}
+	if u.User != nil {
+		rc.password, _ = u.User.Password()
+	}
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		if rc.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", path)
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := rc.connect(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", rc.addr, rc.timeout)
+	if err != nil {
+		return err
+	}
+	rc.conn = conn
+	rc.rd = bufio.NewReader(conn)
+
+	var setup [][]string
+	if rc.password != "" {
+		setup = append(setup, []string{"AUTH", rc.password})
+	}
+	if rc.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(rc.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := rc.roundTrip(setup)
+		if err == nil {
+			err = firstError(replies)
+		}
+		if err != nil {
+			rc.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *redisClient) close() {
+	if rc.conn != nil {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+}
+
+// Pipeline sends all commands in one round trip and returns their replies.
+// Error replies are returned in place; only I/O failures return an error.
+func (rc *redisClient) Pipeline(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.conn == nil {
+		if err := rc.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(rc.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rc.conn.SetDeadline(deadline)
+
+	replies, err := rc.roundTrip(cmds)
+	if err != nil {
+		// The stream is in an unknown state; reconnect on next use
+		rc.close()
+		return nil, err
+	}
+	return replies, nil
+}
+
+func (rc *redisClient) roundTrip(cmds [][]string) ([]interface{}, error) {
+	var buf strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&buf, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(rc.conn, buf.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := rc.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (rc *redisClient) readReply() (interface{}, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	prefix, payload := line[0], line[1:len(line)-2]
+
+	switch prefix {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", prefix)
+	}
+}
+
+func firstError(replies []interface{}) error {
+	for _, r := range replies {
+		if err, ok := r.(redisError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedisVelocityStore keeps each counter in a sorted set scored by event time,
+// so every replica pointed at the same server shares the same windows
+type RedisVelocityStore struct {
+	client    *redisClient
+	retention time.Duration
+}
+
+func NewRedisVelocityStore(rawURL string, retention time.Duration) (*RedisVelocityStore, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisVelocityStore{client: client, retention: retention}, nil
+}
+
+func (rs *RedisVelocityStore) Record(ctx context.Context, key string, amount int64, at time.Time) error {
+	score := strconv.FormatInt(at.UnixMilli(), 10)
+	// The member encodes the amount; the uuid keeps concurrent events distinct
+	member := score + ":" + strconv.FormatInt(amount, 10) + ":" + uuid.New().String()
+	cutoff := strconv.FormatInt(at.Add(-rs.retention).UnixMilli(), 10)
+
+	replies, err := rs.client.Pipeline(ctx,
+		[]string{"ZADD", key, score, member},
+		[]string{"ZREMRANGEBYSCORE", key, "-inf", "(" + cutoff},
+		[]string{"PEXPIRE", key, strconv.FormatInt(rs.retention.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return err
+	}
+	return firstError(replies)
+}
+
+func (rs *RedisVelocityStore) Window(ctx context.Context, key string, window time.Duration, at time.Time) (int, int64, error) {
+	min := "(" + strconv.FormatInt(at.Add(-window).UnixMilli(), 10)
+	max := strconv.FormatInt(at.UnixMilli(), 10)
+
+	replies, err := rs.client.Pipeline(ctx, []string{"ZRANGEBYSCORE", key, min, max})
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := firstError(replies); err != nil {
+		return 0, 0, err
+	}
+
+	members, ok := replies[0].([]interface{})
+	if !ok {
+		return 0, 0, errors.New("redis: unexpected ZRANGEBYSCORE reply")
+	}
+
+	var sum int64
+	for _, m := range members {
+		parts := strings.SplitN(fmt.Sprint(m), ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		// Decimal amounts left by older versions are counted but not summed
+		if amount, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			sum += amount
+		}
+	}
+	return len(members), sum, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Refund statuses
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+var (
+	errRefundNotAllowed     = errors.New("transaction cannot be refunded in its current status")
+	errRefundExceedsBalance = errors.New("refund amount exceeds the refundable balance")
+	errRefundInvalidAmount  = errors.New("refund amount must be positive")
+)
+
+// refundableStatuses are the transaction statuses that hold captured funds
+var refundableStatuses = map[string]bool{
+	StatusCaptured:  true,
+	StatusCompleted: true,
+}
+
+// RefundRequest is the body of POST /transactions/:id/refunds. A zero
+// amount refunds whatever is still refundable.
+type RefundRequest struct {
+	Amount DecimalAmount `json:"amount"`
+	Reason string        `json:"reason"`
+}
+
+const refundColumns = `id, transaction_id, amount, currency, status, provider, COALESCE(provider_refund_id, ''), COALESCE(reason, ''), COALESCE(failure_code, ''), COALESCE(failure_message, ''), COALESCE(requested_by, ''), created_at, updated_at`
+
+func scanRefund(row rowScanner, r *Refund) error {
+	var amount moneyColumn
+	if err := row.Scan(&r.ID, &r.TransactionID, &amount, &r.Currency, &r.Status, &r.Provider, &r.ProviderRefundID, &r.Reason, &r.FailureCode, &r.FailureMessage, &r.RequestedBy, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return err
+	}
+	var err error
+	r.Amount, err = amount.money(r.Currency)
+	return err
+}
+
+func insertRefund(tx *sql.Tx, r *Refund) error {
+	query := `
+		INSERT INTO refunds (id, transaction_id, amount, currency, status, provider, reason, requested_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10)
+	`
+	_, err := tx.Exec(query, r.ID, r.TransactionID, r.Amount, r.Currency, r.Status, r.Provider, r.Reason, r.RequestedBy, r.CreatedAt, r.UpdatedAt)
+	return err
+}
+
+func listRefunds(db *DatabaseConnection, txnID string) ([]Refund, error) {
+	query := `SELECT ` + refundColumns + ` FROM refunds WHERE transaction_id = $1 ORDER BY created_at ASC`
+	rows, err := db.Query(query, txnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		var r Refund
+		if err := scanRefund(rows, &r); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
+
+// reserveRefund validates a refund against the captured amount minus prior
+// refunds and stores it as pending. The amount is added to refunded_amount
+// straight away so concurrent requests cannot refund the same funds twice.
+func reserveRefund(tx *sql.Tx, txnID string, req RefundRequest, requestedBy string) (*Refund, *Transaction, error) {
+	txn, err := getTransactionForUpdate(tx, txnID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !refundableStatuses[txn.Status] {
+		return nil, nil, errRefundNotAllowed
+	}
+
+	remaining := txn.CapturedAmount.Sub(txn.RefundedAmount)
+	amount, err := req.Amount.Money(txn.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amount.IsNegative() {
+		return nil, nil, errRefundInvalidAmount
+	}
+	if amount.IsZero() {
+		amount = remaining
+	}
+	if !amount.IsPositive() || amount.Cmp(remaining) > 0 {
+		return nil, nil, errRefundExceedsBalance
+	}
+
+	now := time.Now()
+	refund := &Refund{
+		ID:            uuid.New().String(),
+		TransactionID: txn.ID,
+		Amount:        amount,
+		Currency:      txn.Currency,
+		Status:        RefundPending,
+		Provider:      txn.Provider,
+		Reason:        req.Reason,
+		RequestedBy:   requestedBy,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := insertRefund(tx, refund); err != nil {
+		return nil, nil, err
+	}
+
+	txn.RefundedAmount = txn.RefundedAmount.Add(amount)
+	query := `UPDATE transactions SET refunded_amount = $1 WHERE id = $2`
+	if _, err := tx.Exec(query, txn.RefundedAmount, txn.ID); err != nil {
+		return nil, nil, err
+	}
+	return refund, txn, nil
+}
+
+// settleRefund records the final outcome of a pending refund. A failed
+// refund releases its amount and a succeeded one is posted to the ledger;
+// the transaction becomes refunded once its succeeded refunds cover the
+// captured amount. It returns false when the refund was already settled, so
+// callers publish each outcome once.
+func settleRefund(tx *sql.Tx, refundID, status, providerRefundID, failureCode, failureMessage string) (*Refund, bool, error) {
+	var r Refund
+	query := `SELECT ` + refundColumns + ` FROM refunds WHERE id = $1 FOR UPDATE`
+	if err := scanRefund(tx.QueryRow(query, refundID), &r); err != nil {
+		return nil, false, err
+	}
+	if r.Status != RefundPending {
+		return &r, false, nil
+	}
+
+	r.Status = status
+	r.FailureCode = failureCode
+	r.FailureMessage = failureMessage
+	if providerRefundID != "" {
+		r.ProviderRefundID = providerRefundID
+	}
+	r.UpdatedAt = time.Now()
+	query = `
+		UPDATE refunds
+		SET status = $1, provider_refund_id = NULLIF($2, ''), failure_code = NULLIF($3, ''), failure_message = NULLIF($4, ''), updated_at = $5
+		WHERE id = $6
+	`
+	if _, err := tx.Exec(query, r.Status, r.ProviderRefundID, r.FailureCode, r.FailureMessage, r.UpdatedAt, r.ID); err != nil {
+		return nil, false, err
+	}
+
+	switch status {
+	case RefundFailed:
+		query = `UPDATE transactions SET refunded_amount = GREATEST(refunded_amount - $1, 0) WHERE id = $2`
+		if _, err := tx.Exec(query, r.Amount, r.TransactionID); err != nil {
+			return nil, false, err
+		}
+	case RefundSucceeded:
+		txn, err := getTransactionForUpdate(tx, r.TransactionID)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := postUserPayback(tx, txn, AccountRefunds, EntryRefund, r.ID, r.Amount); err != nil {
+			return nil, false, err
+		}
+
+		var captured, succeeded moneyColumn
+		query = `
+			SELECT t.captured_amount, COALESCE(SUM(r.amount) FILTER (WHERE r.status = $1), 0)
+			FROM transactions t LEFT JOIN refunds r ON r.transaction_id = t.id
+			WHERE t.id = $2
+			GROUP BY t.captured_amount
+		`
+		if err := tx.QueryRow(query, RefundSucceeded, r.TransactionID).Scan(&captured, &succeeded); err != nil {
+			return nil, false, err
+		}
+		capturedAmount, err := captured.money(r.Currency)
+		if err != nil {
+			return nil, false, err
+		}
+		succeededAmount, err := succeeded.money(r.Currency)
+		if err != nil {
+			return nil, false, err
+		}
+		if succeededAmount.Cmp(capturedAmount) >= 0 {
+			if _, err := setTransactionStatus(tx, r.TransactionID, StatusRefunded, "refund", r.ID); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return &r, true, nil
+}
+
+// Refund refunds part or all of a captured transaction through the provider
+// that captured it. Provider declines and errors come back as a failed
+// refund rather than an error, and an error means the provider was not
+// called.
+func (pp *PaymentProcessor) Refund(ctx context.Context, txnID string, req RefundRequest, requestedBy string) (*Refund, error) {
+	var refund *Refund
+	var txn *Transaction
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		refund, txn, err = reserveRefund(tx, txnID, req, requestedBy)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pp.cache.Delete(txnID)
+	pp.broker.PublishEvent("refund.created", refund)
+
+	var result *ProviderResult
+	provider, ok := pp.registry.Get(refund.Provider)
+	if !ok {
+		result = &ProviderResult{Status: StatusFailed, FailureCode: "provider_unavailable", FailureMessage: "Payment provider is not configured"}
+	} else {
+		// The refund ID is the provider idempotency key, so a retried call
+		// cannot refund twice
+		result, err = provider.Refund(ctx, txn, refund.Amount, refund.ID)
+		if err != nil {
+			log.Printf("Refund call failed: RefundID=%s, Provider=%s, Error=%v", refund.ID, refund.Provider, err)
+			result = &ProviderResult{Status: StatusFailed, FailureCode: providerErrorCode(err), FailureMessage: "Payment provider request failed"}
+			if result.FailureCode == "provider_timeout" {
+				// The provider may have refunded anyway; leave the funds
+				// reserved until its webhook says how it ended
+				result = &ProviderResult{Status: StatusProcessing}
+			}
+		}
+	}
+
+	status := RefundPending
+	switch result.Status {
+	case StatusRefunded:
+		status = RefundSucceeded
+	case StatusFailed, StatusBlocked:
+		status = RefundFailed
+	}
+	if status != RefundPending {
+		completed, err := pp.completeRefund(refund.ID, status, result.ProviderTxnID, result.FailureCode, result.FailureMessage)
+		if err == nil {
+			return completed, nil
+		}
+		// The provider has answered, so the refund must not be created
+		// again; it stays pending until the provider's webhook settles it
+	}
+
+	// The provider settles it later and tells us by webhook
+	query := `UPDATE refunds SET provider_refund_id = NULLIF($1, ''), updated_at = $2 WHERE id = $3`
+	if _, err := pp.db.ExecuteQuery(query, result.ProviderTxnID, time.Now(), refund.ID); err != nil {
+		log.Printf("Failed to store provider refund ID for %s: %v", refund.ID, err)
+	}
+	refund.ProviderRefundID = result.ProviderTxnID
+	return refund, nil
+}
+
+// completeRefund settles a refund and publishes refund.succeeded or refund.failed
+func (pp *PaymentProcessor) completeRefund(refundID, status, providerRefundID, failureCode, failureMessage string) (*Refund, error) {
+	var refund *Refund
+	var settled bool
+	err := pp.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		refund, settled, err = settleRefund(tx, refundID, status, providerRefundID, failureCode, failureMessage)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to settle refund %s: %v", refundID, err)
+		return nil, err
+	}
+
+	pp.cache.Delete(refund.TransactionID)
+	if settled {
+		pp.broker.PublishEvent("refund."+refund.Status, refund)
+	}
+	return refund, nil
+}
+
+// CreateRefund refunds part or all of one of the caller's transactions
+func (th *TransactionHandler) CreateRefund(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	refund, err := th.processor.Refund(c.Request.Context(), c.Param("id"), req, c.GetString("user_id"))
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Transaction not found"})
+		return
+	case err == errRefundNotAllowed:
+		c.JSON(http.StatusConflict, APIResponse{Success: false, Error: err.Error(), Code: "refund_not_allowed"})
+		return
+	case err == errRefundExceedsBalance || err == errRefundInvalidAmount || isAmountError(err):
+		c.JSON(http.StatusUnprocessableEntity, APIResponse{Success: false, Error: err.Error(), Code: "invalid_refund_amount"})
+		return
+	case err != nil:
+		log.Printf("Failed to refund %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to create refund"})
+		return
+	}
+
+	if refund.Status == RefundFailed {
+		c.JSON(http.StatusPaymentRequired, APIResponse{
+			Success: false,
+			Data:    refund,
+			Error:   "Refund was declined by the provider",
+			Code:    refund.FailureCode,
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    refund,
+	})
+}
+
+// ListRefunds lists the refunds of one of the caller's transactions, oldest first
+func (th *TransactionHandler) ListRefunds(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	refunds, err := listRefunds(th.db, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch refunds",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    refunds,
+	})
+}
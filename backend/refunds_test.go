@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestCreateRefund(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	router := newTestRouter(th)
+	txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureAutomatic)
+	if txn.Status != StatusCompleted {
+		t.Fatalf("status = %s, want %s", txn.Status, StatusCompleted)
+	}
+	path := "/api/v1/transactions/" + txn.ID + "/refunds"
+
+	// Steps run in order against the same transaction
+	tests := []struct {
+		name         string
+		path         string
+		userID       string
+		body         string
+		wantStatus   int
+		wantRefunded Money
+		wantTxn      string
+	}{
+		{"unknown transaction", "/api/v1/transactions/missing/refunds", "user_001", `{"amount": 10.00}`, http.StatusNotFound, NewMoney(0, "USD"), StatusCompleted},
+		{"another user's transaction", path, "user_002", `{"amount": 10.00}`, http.StatusForbidden, NewMoney(0, "USD"), StatusCompleted},
+		{"partial refund", path, "user_001", `{"amount": 30.00}`, http.StatusCreated, NewMoney(3000, "USD"), StatusCompleted},
+		{"over the refundable balance", path, "user_001", `{"amount": 80.00}`, http.StatusUnprocessableEntity, NewMoney(3000, "USD"), StatusCompleted},
+		{"too many decimal places", path, "user_001", `{"amount": 1.001}`, http.StatusUnprocessableEntity, NewMoney(3000, "USD"), StatusCompleted},
+		{"negative amount", path, "user_001", `{"amount": -5.00}`, http.StatusUnprocessableEntity, NewMoney(3000, "USD"), StatusCompleted},
+		{"rest of the balance", path, "user_001", `{}`, http.StatusCreated, NewMoney(10000, "USD"), StatusRefunded},
+		{"already refunded", path, "user_001", `{"amount": 1.00}`, http.StatusConflict, NewMoney(10000, "USD"), StatusRefunded},
+	}
+
+	for _, tt := range tests {
+		w := serveTest(router, http.MethodPost, tt.path, tt.userID, tt.body)
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+		got := getTestTransaction(t, db, txn.ID)
+		if got.RefundedAmount.Cmp(tt.wantRefunded) != 0 || got.Status != tt.wantTxn {
+			t.Fatalf("%s: transaction = %s refunded, %s, want %s, %s", tt.name, got.RefundedAmount, got.Status, tt.wantRefunded, tt.wantTxn)
+		}
+	}
+
+	refunds, err := listRefunds(db, txn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 2 || refunds[0].Amount.Cmp(NewMoney(3000, "USD")) != 0 || refunds[1].Amount.Cmp(NewMoney(7000, "USD")) != 0 {
+		t.Errorf("refunds = %+v, want 30.00 and 70.00", refunds)
+	}
+	for _, r := range refunds {
+		if r.Status != RefundSucceeded || r.RequestedBy != "user_001" {
+			t.Errorf("refund %s = %s by %q, want succeeded by user_001", r.ID, r.Status, r.RequestedBy)
+		}
+	}
+}
+
+func TestCreateRefundConcurrent(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	router := newTestRouter(th)
+	txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureAutomatic)
+	path := "/api/v1/transactions/" + txn.ID + "/refunds"
+
+	// Ten refunds of 20.00 race for a 100.00 balance; exactly five fit
+	const requests = 10
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"amount": 20.00, "reason": "race %d"}`, i)
+			codes <- serveTest(router, http.MethodPost, path, "user_001", body).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusUnprocessableEntity, http.StatusConflict:
+			// Over the balance, or the transaction was already refunded
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if created != 5 {
+		t.Errorf("%d refunds created, want 5", created)
+	}
+
+	got := getTestTransaction(t, db, txn.ID)
+	if got.RefundedAmount.Cmp(NewMoney(10000, "USD")) != 0 || got.Status != StatusRefunded {
+		t.Errorf("transaction = %s refunded, %s, want 100.00, %s", got.RefundedAmount, got.Status, StatusRefunded)
+	}
+	refunds, err := listRefunds(db, txn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 5 {
+		t.Errorf("%d refunds stored, want 5", len(refunds))
+	}
+}
+
+func TestTransactionReadsRequireOwner(t *testing.T) {
+	db := openTestDB(t)
+	th := newTestTransactionHandler(t, db)
+	router := newTestRouter(th)
+	txn := createTestTransaction(t, th, "user_001", NewMoney(10000, "USD"), CaptureAutomatic)
+
+	for _, resource := range []string{"refunds", "attempts", "history"} {
+		tests := []struct {
+			txnID      string
+			userID     string
+			wantStatus int
+		}{
+			{txn.ID, "user_001", http.StatusOK},
+			{txn.ID, "user_002", http.StatusForbidden},
+			{"missing", "user_001", http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			w := serveTest(router, http.MethodGet, "/api/v1/transactions/"+tt.txnID+"/"+resource, tt.userID, "")
+			if w.Code != tt.wantStatus {
+				t.Errorf("GET %s of %s as %s = %d, want %d", resource, tt.txnID, tt.userID, w.Code, tt.wantStatus)
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Manual review statuses
+const (
+	ReviewPending  = "pending"
+	ReviewClaimed  = "claimed"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+var (
+	errReviewNotFound = errors.New("review not found")
+	errReviewClaimed  = errors.New("review is claimed by another analyst")
+	errReviewDecided  = errors.New("review has already been decided")
+)
+
+// reviewClaimTTL is how long a claim is held before another analyst may take over
+var reviewClaimTTL = getEnvDuration("REVIEW_CLAIM_TTL", 30*time.Minute)
+
+// insertManualReview queues a held transaction for analyst review
+func insertManualReview(tx *sql.Tx, txnID string, createdAt time.Time) error {
+	query := `INSERT INTO manual_reviews (transaction_id, status, created_at) VALUES ($1, $2, $3)`
+	_, err := tx.Exec(query, txnID, ReviewPending, createdAt)
+	return err
+}
+
+// analystFromContext returns the analyst set by AdminMiddleware, responding
+// with 400 when the X-Admin-User header is missing
+func analystFromContext(c *gin.Context) (string, bool) {
+	analyst := c.GetString("admin_user")
+	if analyst == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "X-Admin-User header is required",
+		})
+		return "", false
+	}
+	return analyst, true
+}
+
+// reviewError responds to a failed review action. Not found and conflicts
+// are reported as they are; anything else is logged and hidden from the client.
+func reviewError(c *gin.Context, err error, action string) {
+	switch {
+	case err == errReviewNotFound:
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: err.Error()})
+	case err == errReviewClaimed || err == errReviewDecided || errors.Is(err, errIllegalTransition):
+		c.JSON(http.StatusConflict, APIResponse{Success: false, Error: err.Error()})
+	default:
+		log.Printf("Failed to %s review %s: %v", action, c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to " + action + " review"})
+	}
+}
+
+func (ah *AdminHandler) ListReviews(c *gin.Context) {
+	status := c.DefaultQuery("status", ReviewPending)
+
+	query := `
+		SELECT r.transaction_id, r.status, COALESCE(r.assigned_to, ''), r.claimed_at, r.decided_at, COALESCE(r.reason, ''), r.created_at,
+			t.id, t.user_id, t.amount, t.currency, t.status, t.risk_score, t.fraud_detected, COALESCE(t.provider, ''), COALESCE(t.provider_txn_id, ''), COALESCE(t.description, ''), t.created_at, t.updated_at
+		FROM manual_reviews r
+		JOIN transactions t ON t.id = r.transaction_id
+		WHERE r.status = $1
+		ORDER BY r.created_at ASC
+		LIMIT 100
+	`
+	rows, err := ah.db.Query(query, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch reviews",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var reviews []ManualReview
+	for rows.Next() {
+		var r ManualReview
+		var claimedAt, decidedAt sql.NullTime
+		var amount moneyColumn
+		txn := &Transaction{}
+		if err := rows.Scan(&r.TransactionID, &r.Status, &r.AssignedTo, &claimedAt, &decidedAt, &r.Reason, &r.CreatedAt,
+			&txn.ID, &txn.UserID, &amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.ProviderTxnID, &txn.Description, &txn.CreatedAt, &txn.UpdatedAt); err != nil {
+			continue
+		}
+		txn.Amount, _ = amount.money(txn.Currency)
+		if claimedAt.Valid {
+			r.ClaimedAt = &claimedAt.Time
+		}
+		if decidedAt.Valid {
+			r.DecidedAt = &decidedAt.Time
+		}
+		r.Transaction = txn
+		reviews = append(reviews, r)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    reviews,
+	})
+}
+
+func (ah *AdminHandler) ClaimReview(c *gin.Context) {
+	analyst, ok := analystFromContext(c)
+	if !ok {
+		return
+	}
+	txnID := c.Param("id")
+	now := time.Now()
+
+	var review ManualReview
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		r, err := lockReview(tx, txnID)
+		if err != nil {
+			return err
+		}
+		if err := checkClaimable(r, analyst, now); err != nil {
+			return err
+		}
+
+		query := `UPDATE manual_reviews SET status = $1, assigned_to = $2, claimed_at = $3 WHERE transaction_id = $4`
+		if _, err := tx.Exec(query, ReviewClaimed, analyst, now, txnID); err != nil {
+			return err
+		}
+		r.Status = ReviewClaimed
+		r.AssignedTo = analyst
+		r.ClaimedAt = &now
+		review = *r
+		return nil
+	})
+	if err != nil {
+		reviewError(c, err, "claim")
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    review,
+		Message: "Review claimed",
+	})
+}
+
+func (ah *AdminHandler) ApproveReview(c *gin.Context) {
+	ah.decideReview(c, ReviewApproved)
+}
+
+func (ah *AdminHandler) RejectReview(c *gin.Context) {
+	ah.decideReview(c, ReviewRejected)
+}
+
+// decideReview resolves a held transaction. Approval moves it back into
+// provider processing; rejection blocks it. Either way a FraudLog entry is
+// written with the analyst's identity.
+func (ah *AdminHandler) decideReview(c *gin.Context, decision string) {
+	analyst, ok := analystFromContext(c)
+	if !ok {
+		return
+	}
+
+	var req ReviewDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	txnID := c.Param("id")
+	now := time.Now()
+
+	action, status := FraudActionBlocked, StatusBlocked
+	if decision == ReviewApproved {
+		action, status = FraudActionApproved, StatusProcessing
+	}
+
+	var txn *Transaction
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		r, err := lockReview(tx, txnID)
+		if err != nil {
+			return err
+		}
+		if err := checkClaimable(r, analyst, now); err != nil {
+			return err
+		}
+
+		txn, err = getTransactionForUpdate(tx, txnID)
+		if err != nil {
+			return err
+		}
+
+		txn.Status = status
+		if decision == ReviewApproved {
+			routeTransaction(ah.router, txn)
+		}
+
+		updated, err := setTransactionStatus(tx, txnID, txn.Status, "review:"+analyst, req.Reason)
+		if err != nil {
+			return err
+		}
+		txn.UpdatedAt = updated.UpdatedAt
+
+		query := `
+			UPDATE transactions
+			SET provider = NULLIF($1, ''), routing_reason = NULLIF($2, ''), retry_plan = $3, failure_code = NULLIF($4, ''), failure_message = NULLIF($5, '')
+			WHERE id = $6
+		`
+		if _, err := tx.Exec(query, txn.Provider, txn.RoutingReason, pq.Array(txn.RetryPlan), txn.FailureCode, txn.FailureMessage, txn.ID); err != nil {
+			return err
+		}
+
+		query = `UPDATE manual_reviews SET status = $1, assigned_to = $2, decided_at = $3, reason = $4 WHERE transaction_id = $5`
+		if _, err := tx.Exec(query, decision, analyst, now, req.Reason, txnID); err != nil {
+			return err
+		}
+
+		// Carry the original risk factors onto the analyst's log entry
+		var riskFactors []string
+		query = `SELECT risk_factors FROM fraud_logs WHERE transaction_id = $1 ORDER BY detected_at ASC LIMIT 1`
+		if err := tx.QueryRow(query, txnID).Scan(pq.Array(&riskFactors)); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		return insertFraudLog(tx, &FraudLog{
+			TransactionID: txn.ID,
+			UserID:        txn.UserID,
+			RiskFactors:   riskFactors,
+			RiskScore:     txn.RiskScore,
+			Action:        action,
+			ReviewedBy:    analyst,
+			Reason:        req.Reason,
+			DetectedAt:    now,
+		})
+	})
+	if err != nil {
+		verb := "approve"
+		if decision == ReviewRejected {
+			verb = "reject"
+		}
+		reviewError(c, err, verb)
+		return
+	}
+
+	ah.cache.Delete(txnID)
+
+	if decision == ReviewApproved && txn.Provider == "" {
+		ah.broker.PublishEvent("payment.failed", txn)
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Data:    txn,
+			Message: "Transaction approved but no payment provider is available",
+		})
+		return
+	}
+	if decision == ReviewApproved {
+		if err := ah.processor.Submit(c.Request.Context(), txn); err != nil {
+			log.Printf("Failed to process approved transaction %s: %v", txnID, err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Error:   "Transaction approved but payment processing failed",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Data:    txn,
+			Message: "Transaction approved and resumed",
+		})
+		return
+	}
+
+	ah.broker.PublishEvent("payment.blocked", txn)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    txn,
+		Message: "Transaction rejected",
+	})
+}
+
+func lockReview(tx *sql.Tx, txnID string) (*ManualReview, error) {
+	var r ManualReview
+	var claimedAt sql.NullTime
+	query := `SELECT transaction_id, status, COALESCE(assigned_to, ''), claimed_at, created_at FROM manual_reviews WHERE transaction_id = $1 FOR UPDATE`
+	err := tx.QueryRow(query, txnID).Scan(&r.TransactionID, &r.Status, &r.AssignedTo, &claimedAt, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errReviewNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claimedAt.Valid {
+		r.ClaimedAt = &claimedAt.Time
+	}
+	return &r, nil
+}
+
+// checkClaimable allows pending reviews, reviews already claimed by the same
+// analyst, and claims that have gone stale
+func checkClaimable(r *ManualReview, analyst string, now time.Time) error {
+	switch r.Status {
+	case ReviewPending:
+		return nil
+	case ReviewClaimed:
+		if r.AssignedTo == analyst || r.ClaimedAt == nil || now.Sub(*r.ClaimedAt) > reviewClaimTTL {
+			return nil
+		}
+		return errReviewClaimed
+	default:
+		return errReviewDecided
+	}
+}
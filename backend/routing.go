@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// RoutingRule pins payments in a currency and/or merchant category to a
+// provider. Empty fields match anything.
+type RoutingRule struct {
+	ID               string    `json:"id"`
+	Currency         string    `json:"currency,omitempty"`
+	MerchantCategory string    `json:"merchant_category,omitempty"`
+	Provider         string    `json:"provider"`
+	Priority         int       `json:"priority"`
+	Enabled          bool      `json:"enabled"`
+	CreatedBy        string    `json:"created_by,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// specificity ranks rules matching both fields above single-field rules
+func (r RoutingRule) specificity() int {
+	n := 0
+	if r.Currency != "" {
+		n++
+	}
+	if r.MerchantCategory != "" {
+		n++
+	}
+	return n
+}
+
+func (r RoutingRule) matches(currency, merchantCategory string) bool {
+	return (r.Currency == "" || strings.EqualFold(r.Currency, currency)) &&
+		(r.MerchantCategory == "" || strings.EqualFold(r.MerchantCategory, merchantCategory))
+}
+
+// RouteCandidate is one provider considered for a payment
+type RouteCandidate struct {
+	Provider      string  `json:"provider"`
+	Status        string  `json:"status"`
+	Fee           Money   `json:"fee"`
+	SuccessRate   float64 `json:"success_rate"`
+	EffectiveCost float64 `json:"effective_cost"`
+	Excluded      string  `json:"excluded,omitempty"`
+}
+
+// RoutingDecision is the chosen provider and why. Provider is empty when no
+// provider can take the payment.
+type RoutingDecision struct {
+	Provider   string           `json:"provider"`
+	Reason     string           `json:"reason"`
+	RuleID     string           `json:"rule_id,omitempty"`
+	Fallbacks  []string         `json:"fallbacks"` // tried in order if Provider soft-declines
+	Candidates []RouteCandidate `json:"candidates"`
+}
+
+type providerStats struct {
+	succeeded int
+	attempted int
+}
+
+// PaymentRouter picks a provider for each approved payment. Admin routing
+// rules win when their provider is available; otherwise the provider with
+// the lowest effective cost is chosen, which is its fee divided by its
+// recent success rate so that an unreliable cheap provider loses to a
+// reliable one.
+type PaymentRouter struct {
+	db            *DatabaseConnection
+	registry      *ProviderRegistry
+	successWindow time.Duration
+	minSamples    int
+	rules         []RoutingRule
+	stats         map[string]providerStats
+	mu            sync.RWMutex
+}
+
+func NewPaymentRouter(db *DatabaseConnection, registry *ProviderRegistry) *PaymentRouter {
+	pr := &PaymentRouter{
+		db:            db,
+		registry:      registry,
+		successWindow: getEnvDuration("ROUTING_SUCCESS_WINDOW", 1*time.Hour),
+		// Below this many recent payments a provider's success rate is not trusted
+		minSamples: getEnvInt("ROUTING_MIN_SAMPLES", 20),
+		stats:      make(map[string]providerStats),
+	}
+	if err := pr.Refresh(); err != nil {
+		log.Printf("Failed to load routing data: %v", err)
+	}
+
+	go pr.refreshLoop(getEnvDuration("ROUTING_REFRESH_INTERVAL", 30*time.Second))
+	return pr
+}
+
+// Refresh reloads provider configuration, routing rules and success rates
+func (pr *PaymentRouter) Refresh() error {
+	if err := pr.registry.Load(); err != nil {
+		return err
+	}
+
+	rules, err := listRoutingRules(pr.db)
+	if err != nil {
+		return err
+	}
+	stats, err := pr.loadStats()
+	if err != nil {
+		return err
+	}
+
+	// Most specific rules first, then by priority
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].specificity() != rules[j].specificity() {
+			return rules[i].specificity() > rules[j].specificity()
+		}
+		return rules[i].Priority < rules[j].Priority
+	})
+
+	pr.mu.Lock()
+	pr.rules = rules
+	pr.stats = stats
+	pr.mu.Unlock()
+	return nil
+}
+
+func (pr *PaymentRouter) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pr.Refresh(); err != nil {
+			log.Printf("Failed to refresh routing data: %v", err)
+		}
+	}
+}
+
+// loadStats counts recent provider calls from payment_attempts, so an
+// attempt that soft-declined and failed over still counts against the
+// provider that declined it. Hard declines such as insufficient_funds are
+// about the payer, not the provider, and are left out.
+func (pr *PaymentRouter) loadStats() (map[string]providerStats, error) {
+	softCodes := make([]string, 0, len(softDeclineCodes))
+	for code := range softDeclineCodes {
+		softCodes = append(softCodes, code)
+	}
+	query := `
+		SELECT provider,
+			COUNT(*) FILTER (WHERE status IN ($2, $3, $4)),
+			COUNT(*) FILTER (WHERE status IN ($2, $3, $4) OR (status = $5 AND error_code = ANY($6)))
+		FROM payment_attempts
+		WHERE created_at > $1
+		GROUP BY provider
+	`
+	rows, err := pr.db.Query(query, time.Now().Add(-pr.successWindow), StatusAuthorized, StatusCaptured, StatusCompleted, StatusFailed, pq.Array(softCodes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[string]providerStats)
+	for rows.Next() {
+		var provider string
+		var s providerStats
+		if err := rows.Scan(&provider, &s.succeeded, &s.attempted); err != nil {
+			return nil, err
+		}
+		stats[provider] = s
+	}
+	return stats, rows.Err()
+}
+
+// successRate returns the provider's recent success rate, or 1 when there
+// are too few attempts to judge
+func (pr *PaymentRouter) successRate(provider string) float64 {
+	s := pr.stats[provider]
+	if s.attempted < pr.minSamples || s.attempted == 0 {
+		return 1
+	}
+	return float64(s.succeeded) / float64(s.attempted)
+}
+
+// providerUsable reports whether routing may send payments to a provider
+// in this status. Degraded providers are only used as a last resort.
+func providerUsable(status string) bool {
+	return status == ProviderActive || status == ProviderDegraded
+}
+
+// SelectPaymentProvider chooses the provider for a payment. Providers that
+// cannot charge paymentMethod are not eligible, even as fallbacks.
+func (pr *PaymentRouter) SelectPaymentProvider(amount Money, merchantCategory, paymentMethod string) *RoutingDecision {
+	currency := amount.Currency
+	rates, err := loadFXRates(pr.db, time.Now())
+	if err != nil {
+		// Providers with a fixed fee in another currency are excluded below
+		log.Printf("Failed to load FX rates for routing: %v", err)
+	}
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+
+	decision := &RoutingDecision{}
+	eligible := make(map[string]*RouteCandidate)
+
+	for _, cfg := range pr.registry.Configs() {
+		candidate := RouteCandidate{Provider: cfg.Code, Status: cfg.Status}
+		provider, ok := pr.registry.Get(cfg.Code)
+		switch {
+		case !ok:
+			candidate.Excluded = "no adapter"
+		case !providerUsable(cfg.Status):
+			candidate.Excluded = "provider " + cfg.Status
+		case !cfg.SupportsCurrency(currency):
+			candidate.Excluded = "currency not supported"
+		case !provider.AcceptsPaymentMethod(paymentMethod):
+			candidate.Excluded = "payment method not supported"
+		default:
+			quote, err := provider.FeeQuote(amount, rates)
+			if err != nil {
+				candidate.Excluded = "no fx rate for fees"
+				break
+			}
+			candidate.Fee = quote.Total
+			candidate.SuccessRate = pr.successRate(cfg.Code)
+			// Effective cost only ranks providers, so it need not be exact
+			candidate.EffectiveCost = math.Round(candidate.Fee.Float64()/math.Max(candidate.SuccessRate, 0.01)*100) / 100
+		}
+		decision.Candidates = append(decision.Candidates, candidate)
+	}
+	for i := range decision.Candidates {
+		if c := &decision.Candidates[i]; c.Excluded == "" {
+			eligible[c.Provider] = c
+		}
+	}
+
+	// Pinned routing rules
+	var skipped []string
+	for _, rule := range pr.rules {
+		if !rule.Enabled || !rule.matches(currency, merchantCategory) {
+			continue
+		}
+		if c, ok := eligible[rule.Provider]; ok {
+			decision.Provider = c.Provider
+			decision.RuleID = rule.ID
+			decision.Reason = fmt.Sprintf("pinned by routing rule %s (%s)", rule.ID, describeRoutingRule(rule))
+			decision.Fallbacks = rankedFallbacks(decision.Candidates, c.Provider)
+			return decision
+		}
+		skipped = append(skipped, fmt.Sprintf("pinned provider %s unavailable", rule.Provider))
+	}
+
+	// Cheapest effective cost, preferring healthy providers over degraded ones
+	var best *RouteCandidate
+	for i := range decision.Candidates {
+		c := &decision.Candidates[i]
+		if c.Excluded != "" {
+			continue
+		}
+		if best == nil || betterRoute(c, best) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		decision.Reason = "no eligible provider for " + currency
+		return decision
+	}
+
+	decision.Provider = best.Provider
+	reason := fmt.Sprintf("lowest effective cost %.2f %s (fee %s, success rate %.0f%%) among %d eligible providers",
+		best.EffectiveCost, currency, best.Fee, best.SuccessRate*100, len(eligible))
+	if best.Status == ProviderDegraded {
+		reason = "no healthy provider available; " + reason
+	}
+	if len(skipped) > 0 {
+		reason = strings.Join(skipped, "; ") + "; " + reason
+	}
+	decision.Reason = reason
+	decision.Fallbacks = rankedFallbacks(decision.Candidates, best.Provider)
+	return decision
+}
+
+// rankedFallbacks returns the eligible providers other than primary, best first
+func rankedFallbacks(candidates []RouteCandidate, primary string) []string {
+	var ranked []*RouteCandidate
+	for i := range candidates {
+		if c := &candidates[i]; c.Excluded == "" && c.Provider != primary {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return betterRoute(ranked[i], ranked[j]) })
+
+	fallbacks := make([]string, 0, len(ranked))
+	for _, c := range ranked {
+		fallbacks = append(fallbacks, c.Provider)
+	}
+	return fallbacks
+}
+
+func betterRoute(c, best *RouteCandidate) bool {
+	if (c.Status == ProviderActive) != (best.Status == ProviderActive) {
+		return c.Status == ProviderActive
+	}
+	return c.EffectiveCost < best.EffectiveCost
+}
+
+func describeRoutingRule(rule RoutingRule) string {
+	var parts []string
+	if rule.Currency != "" {
+		parts = append(parts, "currency "+rule.Currency)
+	}
+	if rule.MerchantCategory != "" {
+		parts = append(parts, "merchant category "+rule.MerchantCategory)
+	}
+	return strings.Join(parts, ", ")
+}
+
+const routingRuleColumns = `id, COALESCE(currency, ''), COALESCE(merchant_category, ''), provider, priority, enabled, COALESCE(created_by, ''), created_at`
+
+func scanRoutingRule(row rowScanner, rule *RoutingRule) error {
+	return row.Scan(&rule.ID, &rule.Currency, &rule.MerchantCategory, &rule.Provider, &rule.Priority, &rule.Enabled, &rule.CreatedBy, &rule.CreatedAt)
+}
+
+func listRoutingRules(db *DatabaseConnection) ([]RoutingRule, error) {
+	query := `SELECT ` + routingRuleColumns + ` FROM routing_rules ORDER BY priority ASC, created_at ASC`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []RoutingRule
+	for rows.Next() {
+		var rule RoutingRule
+		if err := scanRoutingRule(rows, &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// RoutingRuleRequest is the body for creating a routing rule
+type RoutingRuleRequest struct {
+	Currency         string `json:"currency"`
+	MerchantCategory string `json:"merchant_category"`
+	Provider         string `json:"provider" binding:"required"`
+	Priority         int    `json:"priority"`
+	Enabled          *bool  `json:"enabled"`
+}
+
+func (ah *AdminHandler) ListRoutingRules(c *gin.Context) {
+	rules, err := listRoutingRules(ah.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch routing rules",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rules,
+	})
+}
+
+func (ah *AdminHandler) CreateRoutingRule(c *gin.Context) {
+	var req RoutingRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if req.Currency == "" && req.MerchantCategory == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "A routing rule needs a currency, a merchant_category or both",
+		})
+		return
+	}
+	if req.Currency != "" {
+		currency, err := normalizeCurrency(req.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error(), Code: "invalid_currency"})
+			return
+		}
+		req.Currency = currency
+	}
+	if _, ok := ah.router.registry.Get(req.Provider); !ok {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Unknown provider %q", req.Provider),
+		})
+		return
+	}
+
+	rule := RoutingRule{
+		ID:               uuid.New().String(),
+		Currency:         req.Currency,
+		MerchantCategory: req.MerchantCategory,
+		Provider:         req.Provider,
+		Priority:         req.Priority,
+		Enabled:          req.Enabled == nil || *req.Enabled,
+		CreatedBy:        c.GetString("admin_user"),
+		CreatedAt:        time.Now(),
+	}
+
+	query := `
+		INSERT INTO routing_rules (id, currency, merchant_category, provider, priority, enabled, created_by, created_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6, NULLIF($7, ''), $8)
+	`
+	if _, err := ah.db.ExecuteQuery(query, rule.ID, rule.Currency, rule.MerchantCategory, rule.Provider, rule.Priority, rule.Enabled, rule.CreatedBy, rule.CreatedAt); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to create routing rule",
+		})
+		return
+	}
+
+	ah.refreshRouting()
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    rule,
+		Message: "Routing rule created",
+	})
+}
+
+func (ah *AdminHandler) DeleteRoutingRule(c *gin.Context) {
+	result, err := ah.db.ExecuteQuery(`DELETE FROM routing_rules WHERE id = $1`, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to delete routing rule",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Routing rule not found",
+		})
+		return
+	}
+
+	ah.refreshRouting()
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Routing rule deleted",
+	})
+}
+
+// PreviewRouting shows which provider a payment would be routed to
+func (ah *AdminHandler) PreviewRouting(c *gin.Context) {
+	var req struct {
+		Amount           DecimalAmount `json:"amount" binding:"required"`
+		Currency         string        `json:"currency" binding:"required"`
+		MerchantCategory string        `json:"merchant_category"`
+		PaymentMethod    string        `json:"payment_method"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	currency, err := normalizeCurrency(req.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error(), Code: "invalid_currency"})
+		return
+	}
+	amount, err := req.Amount.Money(currency)
+	if err == nil && !amount.IsPositive() {
+		err = errors.New("amount must be greater than 0")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    ah.router.SelectPaymentProvider(amount, req.MerchantCategory, req.PaymentMethod),
+	})
+}
+
+// refreshRouting applies an admin edit immediately on this replica; other
+// replicas pick it up on their next refresh
+func (ah *AdminHandler) refreshRouting() {
+	if err := ah.router.Refresh(); err != nil {
+		log.Printf("Failed to refresh routing data: %v", err)
+	}
+}
+
+// routeTransaction assigns a provider and retry plan to an approved
+// transaction. When no provider can take it the transaction is failed with
+// no_provider_available.
+func routeTransaction(router *PaymentRouter, txn *Transaction) {
+	decision := router.SelectPaymentProvider(txn.Amount, txn.MerchantCategory, txn.PaymentMethod)
+	txn.Provider = decision.Provider
+	txn.RoutingReason = decision.Reason
+	txn.RetryPlan = nil
+	if decision.Provider != "" {
+		txn.RetryPlan = append([]string{decision.Provider}, decision.Fallbacks...)
+	}
+	if decision.Provider == "" {
+		txn.Status = StatusFailed
+		txn.FailureCode = "no_provider_available"
+		txn.FailureMessage = decision.Reason
+	}
+}
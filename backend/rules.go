@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Fraud rule types
+const (
+	RuleAmountAbove     = "amount_above"
+	RuleUserBlacklisted = "user_blacklisted"
+	RuleVelocity        = "velocity"
+	RuleCountryMismatch = "country_mismatch"
+)
+
+// FraudRule is a declarative rule stored in the fraud_rules table. A matching
+// rule adds its risk factor, adjusts the score and may force a decision.
+type FraudRule struct {
+	ID              string          `json:"id"`
+	Name            string          `json:"name"`
+	Type            string          `json:"type"`
+	Params          json.RawMessage `json:"params"`
+	RiskFactor      string          `json:"risk_factor"`
+	ScoreAdjustment float64         `json:"score_adjustment"`
+	ForcedAction    string          `json:"forced_action,omitempty"` // approved, blocked, manual_review
+	Priority        int             `json:"priority"`
+	Enabled         bool            `json:"enabled"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// FraudAssessment is the combined result of the rules and the ML model
+type FraudAssessment struct {
+	Model        *FraudDetectionResponse `json:"model,omitempty"`
+	RiskScore    float64                 `json:"risk_score"`
+	RiskFactors  []string                `json:"risk_factors"`
+	MatchedRules []string                `json:"matched_rules"`
+	IsFraud      bool                    `json:"is_fraud"`
+	Action       string                  `json:"action"`
+}
+
+// ruleCondition decides whether a rule matches a payment request
+type ruleCondition interface {
+	Matches(ctx context.Context, rc *ruleContext) (bool, error)
+}
+
+type compiledRule struct {
+	FraudRule
+	condition ruleCondition
+}
+
+// ruleContext carries the request being evaluated, its amount in the
+// settlement currency and the paying user
+type ruleContext struct {
+	db      *DatabaseConnection
+	req     PaymentRequest
+	settled Money
+	user    *User
+	now     time.Time
+}
+
+type amountAboveCondition struct {
+	Amount   DecimalAmount `json:"amount"`
+	Currency string        `json:"currency"` // empty means the settlement currency
+}
+
+// Matches compares payments in Currency with Amount. Without a currency,
+// every payment's settlement amount is compared, so one threshold covers
+// all currencies.
+func (c amountAboveCondition) Matches(ctx context.Context, rc *ruleContext) (bool, error) {
+	if c.Currency == "" {
+		return rc.settled.Exceeds(c.Amount), nil
+	}
+	if !strings.EqualFold(c.Currency, rc.req.Currency) {
+		return false, nil
+	}
+	return rc.req.Amount.Exceeds(c.Amount), nil
+}
+
+// blacklistCondition matches a blacklisted user. Those are rejected before
+// the rules run, so in practice it matches users whose blacklisting was
+// lifted within the last Days days.
+type blacklistCondition struct {
+	Days int `json:"days"`
+}
+
+func (c blacklistCondition) Matches(ctx context.Context, rc *ruleContext) (bool, error) {
+	if rc.user == nil {
+		return false, nil
+	}
+	if rc.user.IsBlacklisted || c.Days == 0 {
+		return rc.user.IsBlacklisted, nil
+	}
+	var recent bool
+	since := rc.now.AddDate(0, 0, -c.Days)
+	query := `SELECT EXISTS (SELECT 1 FROM user_audit_log WHERE user_id = $1 AND action = $2 AND created_at > $3)`
+	if err := rc.db.QueryRow(query, rc.user.ID, UserActionUnblacklisted, since).Scan(&recent); err != nil {
+		return false, err
+	}
+	return recent, nil
+}
+
+type velocityCondition struct {
+	Count   int `json:"count"`
+	Minutes int `json:"minutes"`
+}
+
+func (c velocityCondition) Matches(ctx context.Context, rc *ruleContext) (bool, error) {
+	var recent int
+	since := rc.now.Add(-time.Duration(c.Minutes) * time.Minute)
+	query := `SELECT COUNT(*) FROM transactions WHERE user_id = $1 AND created_at > $2`
+	if err := rc.db.QueryRow(query, rc.req.UserID, since).Scan(&recent); err != nil {
+		return false, err
+	}
+	// Count the transaction being evaluated as well
+	return recent+1 > c.Count, nil
+}
+
+type countryMismatchCondition struct{}
+
+func (countryMismatchCondition) Matches(ctx context.Context, rc *ruleContext) (bool, error) {
+	if rc.req.IPCountry == "" || rc.req.BillingCountry == "" {
+		return false, nil
+	}
+	return !strings.EqualFold(rc.req.IPCountry, rc.req.BillingCountry), nil
+}
+
+// compileRule validates a rule and parses its params into a condition
+func compileRule(rule FraudRule) (*compiledRule, error) {
+	params := rule.Params
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+
+	var cond ruleCondition
+	switch rule.Type {
+	case RuleAmountAbove:
+		var c amountAboveCondition
+		if err := json.Unmarshal(params, &c); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		if c.Currency != "" {
+			currency, err := normalizeCurrency(c.Currency)
+			if err != nil {
+				return nil, err
+			}
+			c.Currency = currency
+		}
+		if amount, err := c.Amount.Money(c.Currency); err != nil || !amount.IsPositive() {
+			return nil, fmt.Errorf("amount must be a decimal greater than 0")
+		}
+		cond = c
+	case RuleUserBlacklisted:
+		var c blacklistCondition
+		if err := json.Unmarshal(params, &c); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		if c.Days < 0 {
+			return nil, fmt.Errorf("days must not be negative")
+		}
+		cond = c
+	case RuleVelocity:
+		var c velocityCondition
+		if err := json.Unmarshal(params, &c); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		if c.Count <= 0 || c.Minutes <= 0 {
+			return nil, fmt.Errorf("count and minutes must be greater than 0")
+		}
+		cond = c
+	case RuleCountryMismatch:
+		cond = countryMismatchCondition{}
+	default:
+		return nil, fmt.Errorf("unknown rule type %q", rule.Type)
+	}
+
+	switch rule.ForcedAction {
+	case "", FraudActionApproved, FraudActionBlocked, FraudActionManualReview:
+	default:
+		return nil, fmt.Errorf("unknown forced action %q", rule.ForcedAction)
+	}
+
+	return &compiledRule{FraudRule: rule, condition: cond}, nil
+}
+
+// actionSeverity orders forced actions so the strictest one wins
+func actionSeverity(action string) int {
+	switch action {
+	case FraudActionBlocked:
+		return 3
+	case FraudActionManualReview:
+		return 2
+	case FraudActionApproved:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// RulesEngine evaluates the fraud rules stored in Postgres together with the
+// ML model score. Rules are reloaded whenever the table changes.
+type RulesEngine struct {
+	db          *DatabaseConnection
+	fraudClient *FraudClient
+	velocity    *VelocityChecker
+	thresholds  DecisionThresholds
+	rules       []*compiledRule
+	version     string
+	mu          sync.RWMutex
+}
+
+func NewRulesEngine(db *DatabaseConnection, fraudClient *FraudClient, velocity *VelocityChecker) *RulesEngine {
+	re := &RulesEngine{
+		db:          db,
+		fraudClient: fraudClient,
+		velocity:    velocity,
+		thresholds:  LoadDecisionThresholds(),
+	}
+	if err := re.Reload(); err != nil {
+		log.Printf("Failed to load fraud rules: %v", err)
+	}
+
+	go re.watch(getEnvDuration("RULES_RELOAD_INTERVAL", 15*time.Second))
+	return re
+}
+
+// Reload replaces the active rule set with the enabled rules in the database
+func (re *RulesEngine) Reload() error {
+	version, err := re.currentVersion()
+	if err != nil {
+		return err
+	}
+
+	rules, err := listFraudRules(re.db)
+	if err != nil {
+		return err
+	}
+
+	var compiled []*compiledRule
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		cr, err := compileRule(rule)
+		if err != nil {
+			log.Printf("Skipping fraud rule %s: %v", rule.ID, err)
+			continue
+		}
+		compiled = append(compiled, cr)
+	}
+
+	re.mu.Lock()
+	re.rules = compiled
+	re.version = version
+	re.mu.Unlock()
+
+	log.Printf("Loaded %d fraud rules", len(compiled))
+	return nil
+}
+
+// currentVersion fingerprints the rules table so replicas notice edits made elsewhere
+func (re *RulesEngine) currentVersion() (string, error) {
+	var count int
+	var updatedAt sql.NullTime
+	query := `SELECT COUNT(*), MAX(updated_at) FROM fraud_rules`
+	if err := re.db.QueryRow(query).Scan(&count, &updatedAt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", count, updatedAt.Time.UnixNano()), nil
+}
+
+func (re *RulesEngine) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		version, err := re.currentVersion()
+		if err != nil {
+			log.Printf("Failed to check fraud rules version: %v", err)
+			continue
+		}
+
+		re.mu.RLock()
+		changed := version != re.version
+		re.mu.RUnlock()
+
+		if changed {
+			if err := re.Reload(); err != nil {
+				log.Printf("Failed to reload fraud rules: %v", err)
+			}
+		}
+	}
+}
+
+// Evaluate runs the rules and velocity checks and, unless a rule has already
+// blocked the payment, the ML model, and combines them into a single decision.
+// settled is the payment converted into the settlement currency.
+func (re *RulesEngine) Evaluate(ctx context.Context, txnID string, req PaymentRequest, settled Money, user *User) *FraudAssessment {
+	re.mu.RLock()
+	rules := re.rules
+	re.mu.RUnlock()
+
+	rc := &ruleContext{db: re.db, req: req, settled: settled, user: user, now: time.Now()}
+	assessment := &FraudAssessment{RiskFactors: []string{}, MatchedRules: []string{}}
+
+	var adjustment float64
+	forced := ""
+	for _, rule := range rules {
+		matched, err := rule.condition.Matches(ctx, rc)
+		if err != nil {
+			log.Printf("Fraud rule %s failed to evaluate: %v", rule.ID, err)
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		assessment.MatchedRules = append(assessment.MatchedRules, rule.ID)
+		assessment.RiskFactors = append(assessment.RiskFactors, rule.RiskFactor)
+		adjustment += rule.ScoreAdjustment
+		if actionSeverity(rule.ForcedAction) > actionSeverity(forced) {
+			forced = rule.ForcedAction
+		}
+	}
+
+	velocityFactors, velocityAdjustment := re.velocity.Check(ctx, req, settled, rc.now)
+	assessment.RiskFactors = append(assessment.RiskFactors, velocityFactors...)
+	adjustment += velocityAdjustment
+
+	// A blocking rule is final, so skip the round trip to the model
+	if forced != FraudActionBlocked {
+		assessment.Model = CallFraudDetectionService(ctx, re.fraudClient, txnID, req, rc.user)
+		assessment.RiskScore = assessment.Model.RiskScore
+		assessment.IsFraud = assessment.Model.IsFraud
+		factors := make([]string, 0, len(assessment.Model.RiskFactors)+len(assessment.RiskFactors))
+		factors = append(factors, assessment.Model.RiskFactors...)
+		assessment.RiskFactors = append(factors, assessment.RiskFactors...)
+	}
+
+	assessment.RiskScore += adjustment
+	if assessment.RiskScore < 0 {
+		assessment.RiskScore = 0
+	} else if assessment.RiskScore > 1 {
+		assessment.RiskScore = 1
+	}
+
+	if forced != "" {
+		assessment.Action = forced
+	} else {
+		assessment.Action = re.thresholds.Decide(assessment.RiskScore, assessment.IsFraud)
+	}
+
+	log.Printf("Fraud assessment: TxnID=%s, RiskScore=%.2f, MatchedRules=%v, Action=%s", txnID, assessment.RiskScore, assessment.MatchedRules, assessment.Action)
+	return assessment
+}
+
+const fraudRuleColumns = `id, name, rule_type, params, risk_factor, score_adjustment, COALESCE(forced_action, ''), priority, enabled, created_at, updated_at`
+
+func scanFraudRule(row rowScanner, rule *FraudRule) error {
+	var params []byte
+	if err := row.Scan(&rule.ID, &rule.Name, &rule.Type, &params, &rule.RiskFactor, &rule.ScoreAdjustment, &rule.ForcedAction, &rule.Priority, &rule.Enabled, &rule.CreatedAt, &rule.UpdatedAt); err != nil {
+		return err
+	}
+	rule.Params = json.RawMessage(params)
+	return nil
+}
+
+func listFraudRules(db *DatabaseConnection) ([]FraudRule, error) {
+	query := `SELECT ` + fraudRuleColumns + ` FROM fraud_rules ORDER BY priority ASC, created_at ASC`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []FraudRule
+	for rows.Next() {
+		var rule FraudRule
+		if err := scanFraudRule(rows, &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// FraudRuleRequest is the body for creating or updating a fraud rule
+type FraudRuleRequest struct {
+	Name            string          `json:"name" binding:"required"`
+	Type            string          `json:"type" binding:"required"`
+	Params          json.RawMessage `json:"params"`
+	RiskFactor      string          `json:"risk_factor" binding:"required"`
+	ScoreAdjustment float64         `json:"score_adjustment"`
+	ForcedAction    string          `json:"forced_action"`
+	Priority        int             `json:"priority"`
+	Enabled         *bool           `json:"enabled"`
+}
+
+func (r FraudRuleRequest) toRule(id string, now time.Time) FraudRule {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+	params := r.Params
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+	return FraudRule{
+		ID:              id,
+		Name:            r.Name,
+		Type:            r.Type,
+		Params:          params,
+		RiskFactor:      r.RiskFactor,
+		ScoreAdjustment: r.ScoreAdjustment,
+		ForcedAction:    r.ForcedAction,
+		Priority:        r.Priority,
+		Enabled:         enabled,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// bindFraudRule parses and validates a rule from the request body
+func bindFraudRule(c *gin.Context, id string) (*FraudRule, bool) {
+	var req FraudRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return nil, false
+	}
+
+	rule := req.toRule(id, time.Now())
+	if _, err := compileRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return nil, false
+	}
+	return &rule, true
+}
+
+func (ah *AdminHandler) ListFraudRules(c *gin.Context) {
+	rules, err := listFraudRules(ah.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch fraud rules",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rules,
+	})
+}
+
+func (ah *AdminHandler) CreateFraudRule(c *gin.Context) {
+	rule, ok := bindFraudRule(c, uuid.New().String())
+	if !ok {
+		return
+	}
+
+	query := `
+		INSERT INTO fraud_rules (id, name, rule_type, params, risk_factor, score_adjustment, forced_action, priority, enabled, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11)
+	`
+	if _, err := ah.db.ExecuteQuery(query, rule.ID, rule.Name, rule.Type, []byte(rule.Params), rule.RiskFactor, rule.ScoreAdjustment, rule.ForcedAction, rule.Priority, rule.Enabled, rule.CreatedAt, rule.UpdatedAt); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to create fraud rule",
+		})
+		return
+	}
+
+	ah.reloadRules()
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    rule,
+		Message: "Fraud rule created",
+	})
+}
+
+func (ah *AdminHandler) UpdateFraudRule(c *gin.Context) {
+	rule, ok := bindFraudRule(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	query := `
+		UPDATE fraud_rules
+		SET name = $1, rule_type = $2, params = $3, risk_factor = $4, score_adjustment = $5, forced_action = NULLIF($6, ''), priority = $7, enabled = $8, updated_at = $9
+		WHERE id = $10
+		RETURNING created_at
+	`
+	err := ah.db.QueryRow(query, rule.Name, rule.Type, []byte(rule.Params), rule.RiskFactor, rule.ScoreAdjustment, rule.ForcedAction, rule.Priority, rule.Enabled, rule.UpdatedAt, rule.ID).Scan(&rule.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Fraud rule not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to update fraud rule",
+		})
+		return
+	}
+
+	ah.reloadRules()
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    rule,
+		Message: "Fraud rule updated",
+	})
+}
+
+func (ah *AdminHandler) DeleteFraudRule(c *gin.Context) {
+	result, err := ah.db.ExecuteQuery(`DELETE FROM fraud_rules WHERE id = $1`, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to delete fraud rule",
+		})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Fraud rule not found",
+		})
+		return
+	}
+
+	ah.reloadRules()
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Fraud rule deleted",
+	})
+}
+
+// reloadRules applies an admin edit immediately on this replica; other
+// replicas pick it up on their next version check
+func (ah *AdminHandler) reloadRules() {
+	if err := ah.rules.Reload(); err != nil {
+		log.Printf("Failed to reload fraud rules: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBlacklistConditionCurrent(t *testing.T) {
+	tests := []struct {
+		name string
+		user *User
+		want bool
+	}{
+		{name: "no user", user: nil, want: false},
+		{name: "blacklisted", user: &User{ID: "user_001", IsBlacklisted: true}, want: true},
+		{name: "not blacklisted", user: &User{ID: "user_001"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without days only the current flag is read, so no database is needed
+			got, err := blacklistCondition{}.Matches(context.Background(), &ruleContext{user: tt.user})
+			if err != nil || got != tt.want {
+				t.Errorf("Matches = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountAboveCondition(t *testing.T) {
+	tests := []struct {
+		name    string
+		cond    amountAboveCondition
+		amount  Money
+		settled Money
+		want    bool
+	}{
+		{name: "same currency above", cond: amountAboveCondition{Amount: "1000", Currency: "USD"}, amount: NewMoney(100001, "USD"), settled: NewMoney(100001, "USD"), want: true},
+		{name: "same currency at threshold", cond: amountAboveCondition{Amount: "1000", Currency: "USD"}, amount: NewMoney(100000, "USD"), settled: NewMoney(100000, "USD"), want: false},
+		{name: "other currency", cond: amountAboveCondition{Amount: "1000", Currency: "USD"}, amount: NewMoney(200000, "EUR"), settled: NewMoney(217000, "USD"), want: false},
+		{name: "no currency, small yen payment", cond: amountAboveCondition{Amount: "1000"}, amount: NewMoney(1001, "JPY"), settled: NewMoney(667, "USD"), want: false},
+		{name: "no currency, large dinar payment", cond: amountAboveCondition{Amount: "1000"}, amount: NewMoney(1000000, "KWD"), settled: NewMoney(325700, "USD"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &ruleContext{req: PaymentRequest{Amount: tt.amount, Currency: tt.amount.Currency}, settled: tt.settled}
+			if got, _ := tt.cond.Matches(context.Background(), rc); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
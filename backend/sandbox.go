@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sandbox payment method tokens that trigger specific outcomes. Any other
+// token is authorized and captured successfully.
+const (
+	sandboxTokenDecline     = "sandbox_decline"
+	sandboxTokenFraud       = "sandbox_fraud"
+	sandboxTokenPending     = "sandbox_pending"
+	sandboxTokenUnavailable = "sandbox_unavailable"
+)
+
+// errSandboxUnavailable mimics a provider outage
+var errSandboxUnavailable = errors.New("sandbox: processor unavailable")
+
+// SandboxProvider is an in-process provider for local development and
+// tests. It never moves money and needs no credentials.
+type SandboxProvider struct {
+	FeeSchedule
+}
+
+func NewSandboxProvider(fees FeeSchedule) *SandboxProvider {
+	return &SandboxProvider{FeeSchedule: fees}
+}
+
+func sandboxID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+func (sp *SandboxProvider) Authorize(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	switch txn.PaymentMethod {
+	case sandboxTokenDecline:
+		return &ProviderResult{
+			Status:         StatusFailed,
+			FailureCode:    "card_declined",
+			FailureMessage: "Sandbox decline",
+		}, nil
+	case sandboxTokenFraud:
+		return &ProviderResult{
+			Status:         StatusBlocked,
+			FailureCode:    "fraudulent",
+			FailureMessage: "Sandbox fraud decline",
+		}, nil
+	case sandboxTokenPending:
+		return &ProviderResult{
+			ProviderTxnID: sandboxID("sbx_auth"),
+			Status:        StatusPending,
+			FailureCode:   "requires_action",
+		}, nil
+	case sandboxTokenUnavailable:
+		return nil, errSandboxUnavailable
+	}
+	return &ProviderResult{ProviderTxnID: sandboxID("sbx_auth"), Status: StatusAuthorized}, nil
+}
+
+func (sp *SandboxProvider) Capture(ctx context.Context, txn *Transaction, amount Money) (*ProviderResult, error) {
+	return &ProviderResult{ProviderTxnID: sandboxID("sbx_cap"), Status: StatusCompleted}, nil
+}
+
+func (sp *SandboxProvider) Refund(ctx context.Context, txn *Transaction, amount Money, reference string) (*ProviderResult, error) {
+	return &ProviderResult{ProviderTxnID: sandboxID("sbx_ref"), Status: StatusRefunded}, nil
+}
+
+func (sp *SandboxProvider) Void(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	return &ProviderResult{ProviderTxnID: txn.ProviderTxnID, Status: StatusVoided}, nil
+}
+
+func (sp *SandboxProvider) AuthorizationWindow() time.Duration {
+	return 7 * 24 * time.Hour
+}
+
+func (sp *SandboxProvider) AcceptsPaymentMethod(token string) bool {
+	return true
+}
+
+func (sp *SandboxProvider) HealthCheck(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Settlement row kinds. Only payments and refunds are reconciled; fees,
+// payouts and adjustments are stored as other.
+const (
+	SettlementPayment = "payment"
+	SettlementRefund  = "refund"
+	SettlementOther   = "other"
+)
+
+// maxSettlementReportSize bounds an uploaded report
+const maxSettlementReportSize = 50 << 20
+
+var (
+	errReportNotFound        = errors.New("settlement report not found")
+	errReportAlreadyImported = errors.New("this report has already been imported")
+)
+
+// settlementParsers read each provider's report format
+var settlementParsers = map[string]func(io.Reader) ([]SettlementRow, error){
+	"stripe": parseStripeBalanceReport,
+	"paypal": parsePayPalSettlementReport,
+}
+
+// csvHeader maps lower-cased column names to their position
+type csvHeader map[string]int
+
+func newCSVHeader(names []string) csvHeader {
+	h := csvHeader{}
+	for i, name := range names {
+		h[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	return h
+}
+
+// get returns the value of the first of names the report has
+func (h csvHeader) get(record []string, names ...string) string {
+	for _, name := range names {
+		if i, ok := h[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+	}
+	return ""
+}
+
+func (h csvHeader) has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := h[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reportTimeLayouts are the timestamp formats Stripe and PayPal reports use
+var reportTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	time.RFC3339,
+	"2006/01/02 15:04:05 -0700",
+	"2006/01/02 15:04:05 MST",
+}
+
+// parseReportTime reads a report timestamp, or Unix seconds
+func parseReportTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	for _, layout := range reportTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// stripeKinds maps Stripe balance transaction types and reporting
+// categories onto row kinds
+var stripeKinds = map[string]string{
+	"charge":         SettlementPayment,
+	"payment":        SettlementPayment,
+	"refund":         SettlementRefund,
+	"payment_refund": SettlementRefund,
+}
+
+// parseStripeBalanceReport reads a Stripe balance transactions export or an
+// itemized balance report from the Reports API. Amounts are decimals in
+// major units.
+func parseStripeBalanceReport(r io.Reader) ([]SettlementRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	names, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	h := newCSVHeader(names)
+	for _, column := range [][]string{{"id", "balance_transaction_id"}, {"amount", "gross"}, {"currency"}, {"created (utc)", "created_utc", "created"}} {
+		if !h.has(column...) {
+			return nil, fmt.Errorf("missing column %q", column[0])
+		}
+	}
+
+	var rows []SettlementRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		row, err := stripeSettlementRow(h, record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// errStripeReportNoPaymentIntent rejects a Stripe report with payments but
+// no payment_intent_id column. provider_txn_id holds the PaymentIntent ID,
+// so the charge IDs in source would never match.
+var errStripeReportNoPaymentIntent = errors.New("payment rows need a payment_intent_id column; export the report with it included")
+
+// stripeSettlementRow reads one balance transaction. Payments are matched on
+// payment_intent_id and refunds on the refund ID in source.
+func stripeSettlementRow(h csvHeader, record []string) (SettlementRow, error) {
+	currency, err := normalizeCurrency(h.get(record, "currency"))
+	if err != nil {
+		return SettlementRow{}, err
+	}
+	row := SettlementRow{
+		Provider:    "stripe",
+		RowID:       h.get(record, "id", "balance_transaction_id"),
+		Type:        h.get(record, "type", "reporting_category"),
+		Currency:    currency,
+		Description: h.get(record, "description"),
+	}
+	if row.RowID == "" {
+		return row, errors.New("missing balance transaction id")
+	}
+	if row.Gross, err = ParseMoney(h.get(record, "amount", "gross"), currency); err != nil {
+		return row, err
+	}
+	row.Fee = NewMoney(0, currency)
+	if fee := h.get(record, "fee"); fee != "" {
+		if row.Fee, err = ParseMoney(fee, currency); err != nil {
+			return row, err
+		}
+	}
+	row.Net = row.Gross.Sub(row.Fee)
+	if net := h.get(record, "net"); net != "" {
+		if row.Net, err = ParseMoney(net, currency); err != nil {
+			return row, err
+		}
+	}
+	if row.OccurredAt, err = parseReportTime(h.get(record, "created (utc)", "created_utc", "created")); err != nil {
+		return row, err
+	}
+
+	row.Kind = stripeKinds[strings.ToLower(row.Type)]
+	switch row.Kind {
+	case SettlementPayment:
+		if !h.has("payment_intent_id") {
+			return row, errStripeReportNoPaymentIntent
+		}
+		// A charge made without a PaymentIntent is not one of ours and is
+		// reported as missing internally
+		row.ProviderReference = h.get(record, "payment_intent_id")
+		if row.ProviderReference == "" {
+			row.ProviderReference = h.get(record, "source", "source_id")
+		}
+	case SettlementRefund:
+		row.ProviderReference = h.get(record, "source", "source_id")
+	default:
+		row.Kind = SettlementOther
+	}
+	return row, nil
+}
+
+// parsePayPalSettlementReport reads a PayPal settlement report (STL). Each
+// line starts with a record type: CH holds the column names and SB one
+// transaction, while headers, footers and totals are skipped.
+func parsePayPalSettlementReport(r io.Reader) ([]SettlementRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var h csvHeader
+	var rows []SettlementRow
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch strings.TrimSpace(strings.TrimPrefix(record[0], "\ufeff")) {
+		case "CH":
+			h = newCSVHeader(record[1:])
+		case "SB":
+			if h == nil {
+				return nil, fmt.Errorf("line %d: transaction before the CH column header", line)
+			}
+			row, err := paypalSettlementRow(h, record[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			rows = append(rows, row)
+		}
+	}
+	if h == nil {
+		return nil, errors.New("no CH column header; not a PayPal settlement report")
+	}
+	return rows, nil
+}
+
+// paypalSettlementRow reads one SB record. Event codes T00xx are payments
+// and T11xx refunds; the transaction ID is the capture or refund ID we store.
+func paypalSettlementRow(h csvHeader, record []string) (SettlementRow, error) {
+	currency, err := normalizeCurrency(h.get(record, "gross transaction currency"))
+	if err != nil {
+		return SettlementRow{}, err
+	}
+	row := SettlementRow{
+		Provider:    "paypal",
+		RowID:       h.get(record, "transaction id"),
+		Type:        h.get(record, "transaction event code"),
+		Currency:    currency,
+		Description: h.get(record, "invoice id"),
+	}
+	if row.RowID == "" {
+		return row, errors.New("missing transaction id")
+	}
+	if feeCurrency := h.get(record, "fee currency"); feeCurrency != "" && !strings.EqualFold(feeCurrency, currency) {
+		return row, fmt.Errorf("fee currency %s differs from gross currency %s", feeCurrency, currency)
+	}
+	if row.Gross, err = paypalMinorUnits(h.get(record, "gross transaction amount"), h.get(record, "transaction debit or credit"), currency); err != nil {
+		return row, err
+	}
+	fee, err := paypalMinorUnits(h.get(record, "fee amount"), h.get(record, "fee debit or credit"), currency)
+	if err != nil {
+		return row, err
+	}
+	// A fee debit is a charge, reported here as a positive fee
+	row.Fee = fee.Neg()
+	row.Net = row.Gross.Sub(row.Fee)
+
+	occurred := h.get(record, "transaction completion date")
+	if occurred == "" {
+		occurred = h.get(record, "transaction initiation date")
+	}
+	if row.OccurredAt, err = parseReportTime(occurred); err != nil {
+		return row, err
+	}
+
+	switch {
+	case strings.HasPrefix(row.Type, "T00"):
+		row.Kind = SettlementPayment
+	case strings.HasPrefix(row.Type, "T11"):
+		row.Kind = SettlementRefund
+	default:
+		row.Kind = SettlementOther
+	}
+	if row.Kind != SettlementOther {
+		row.ProviderReference = row.RowID
+	}
+	return row, nil
+}
+
+// paypalMinorUnits reads an STL amount, which is in minor units and signed
+// by a separate CR or DR column
+func paypalMinorUnits(amount, sign, currency string) (Money, error) {
+	if amount == "" {
+		return NewMoney(0, currency), nil
+	}
+	minor, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return Money{}, errInvalidAmount
+	}
+	if strings.EqualFold(sign, "DR") {
+		minor = -minor
+	}
+	return NewMoney(minor, currency), nil
+}
+
+// insertSettlementReport stores a report and its rows. Rows already stored
+// with an earlier, overlapping report are skipped.
+func insertSettlementReport(tx *sql.Tx, report *SettlementReport, rows []SettlementRow) error {
+	for _, row := range rows {
+		at := row.OccurredAt
+		if report.PeriodStart == nil || at.Before(*report.PeriodStart) {
+			report.PeriodStart = &at
+		}
+		if report.PeriodEnd == nil || at.After(*report.PeriodEnd) {
+			report.PeriodEnd = &at
+		}
+	}
+
+	query := `
+		INSERT INTO settlement_reports (id, provider, filename, checksum, period_start, period_end, imported_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)
+		ON CONFLICT (provider, checksum) DO NOTHING
+	`
+	result, err := tx.Exec(query, report.ID, report.Provider, report.Filename, report.Checksum, report.PeriodStart, report.PeriodEnd, report.ImportedBy, report.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errReportAlreadyImported
+	}
+
+	query = `
+		INSERT INTO settlement_report_rows (id, report_id, provider, row_id, kind, type, provider_reference, gross, fee, net, currency, occurred_at, description)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10, $11, $12, NULLIF($13, ''))
+		ON CONFLICT (provider, row_id) DO NOTHING
+	`
+	for i := range rows {
+		row := &rows[i]
+		row.ID = uuid.New().String()
+		row.ReportID = report.ID
+		result, err := tx.Exec(query, row.ID, row.ReportID, row.Provider, row.RowID, row.Kind, row.Type, row.ProviderReference, row.Gross, row.Fee, row.Net, row.Currency, row.OccurredAt, row.Description)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			report.RowCount++
+		} else {
+			report.SkippedRows++
+		}
+	}
+
+	query = `UPDATE settlement_reports SET row_count = $1, skipped_rows = $2 WHERE id = $3`
+	_, err = tx.Exec(query, report.RowCount, report.SkippedRows, report.ID)
+	return err
+}
+
+const settlementReportColumns = `id, provider, filename, checksum, row_count, skipped_rows, period_start, period_end, COALESCE(imported_by, ''), reconciled_at, created_at`
+
+func scanSettlementReport(row rowScanner, r *SettlementReport) error {
+	var periodStart, periodEnd, reconciledAt sql.NullTime
+	if err := row.Scan(&r.ID, &r.Provider, &r.Filename, &r.Checksum, &r.RowCount, &r.SkippedRows, &periodStart, &periodEnd, &r.ImportedBy, &reconciledAt, &r.CreatedAt); err != nil {
+		return err
+	}
+	if periodStart.Valid {
+		r.PeriodStart = &periodStart.Time
+	}
+	if periodEnd.Valid {
+		r.PeriodEnd = &periodEnd.Time
+	}
+	if reconciledAt.Valid {
+		r.ReconciledAt = &reconciledAt.Time
+	}
+	r.OpenMismatches = map[string]int{}
+	return nil
+}
+
+// countOpenMismatches fills in each report's open mismatches by type
+func countOpenMismatches(db *DatabaseConnection, reports []SettlementReport) error {
+	if len(reports) == 0 {
+		return nil
+	}
+	byID := map[string]*SettlementReport{}
+	ids := make([]string, 0, len(reports))
+	for i := range reports {
+		byID[reports[i].ID] = &reports[i]
+		ids = append(ids, reports[i].ID)
+	}
+
+	query := `
+		SELECT report_id, type, COUNT(*)
+		FROM reconciliation_mismatches
+		WHERE status = $1 AND report_id = ANY($2)
+		GROUP BY report_id, type
+	`
+	rows, err := db.Query(query, MismatchOpen, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reportID, mismatchType string
+		var count int
+		if err := rows.Scan(&reportID, &mismatchType, &count); err != nil {
+			return err
+		}
+		byID[reportID].OpenMismatches[mismatchType] = count
+	}
+	return rows.Err()
+}
+
+func getSettlementReport(db *DatabaseConnection, id string) (*SettlementReport, error) {
+	var report SettlementReport
+	query := `SELECT ` + settlementReportColumns + ` FROM settlement_reports WHERE id = $1`
+	if err := scanSettlementReport(db.QueryRow(query, id), &report); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errReportNotFound
+		}
+		return nil, err
+	}
+	reports := []SettlementReport{report}
+	if err := countOpenMismatches(db, reports); err != nil {
+		return nil, err
+	}
+	return &reports[0], nil
+}
+
+func listSettlementRows(db *DatabaseConnection, reportID string) ([]SettlementRow, error) {
+	query := `
+		SELECT id, report_id, provider, row_id, kind, COALESCE(type, ''), COALESCE(provider_reference, ''), gross, fee, net, currency, occurred_at, COALESCE(description, '')
+		FROM settlement_report_rows
+		WHERE report_id = $1
+		ORDER BY occurred_at, row_id
+	`
+	rows, err := db.Query(query, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []SettlementRow{}
+	for rows.Next() {
+		var r SettlementRow
+		var gross, fee, net moneyColumn
+		if err := rows.Scan(&r.ID, &r.ReportID, &r.Provider, &r.RowID, &r.Kind, &r.Type, &r.ProviderReference, &gross, &fee, &net, &r.Currency, &r.OccurredAt, &r.Description); err != nil {
+			return nil, err
+		}
+		if r.Gross, err = gross.money(r.Currency); err != nil {
+			return nil, err
+		}
+		if r.Fee, err = fee.money(r.Currency); err != nil {
+			return nil, err
+		}
+		if r.Net, err = net.money(r.Currency); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// ImportSettlementReport stores an uploaded Stripe or PayPal report, sent as
+// multipart form fields provider and file, and reconciles it
+func (ah *AdminHandler) ImportSettlementReport(c *gin.Context) {
+	provider := strings.ToLower(c.PostForm("provider"))
+	parse, ok := settlementParsers[provider]
+	if !ok {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "provider must be stripe or paypal",
+		})
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "file is required",
+		})
+		return
+	}
+	if header.Size > maxSettlementReportSize {
+		c.JSON(http.StatusRequestEntityTooLarge, APIResponse{
+			Success: false,
+			Error:   "Report is larger than 50 MB",
+		})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	rows, err := parse(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid %s report: %v", provider, err),
+			Code:    "invalid_report",
+		})
+		return
+	}
+
+	checksum := sha256.Sum256(data)
+	report := &SettlementReport{
+		ID:         uuid.New().String(),
+		Provider:   provider,
+		Filename:   header.Filename,
+		Checksum:   hex.EncodeToString(checksum[:]),
+		ImportedBy: c.GetString("admin_user"),
+		CreatedAt:  time.Now(),
+	}
+	err = ah.db.WithTransaction(func(tx *sql.Tx) error {
+		return insertSettlementReport(tx, report, rows)
+	})
+	if err == errReportAlreadyImported {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "report_already_imported",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to import %s settlement report %s: %v", provider, header.Filename, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to import settlement report",
+		})
+		return
+	}
+
+	// The reconciliation job retries reports that fail here
+	if _, err := ah.reconciler.Reconcile(report.ID); err != nil {
+		log.Printf("Failed to reconcile settlement report %s: %v", report.ID, err)
+	}
+	if imported, err := getSettlementReport(ah.db, report.ID); err == nil {
+		report = imported
+	}
+
+	c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Data:    report,
+		Message: fmt.Sprintf("Imported %d rows", report.RowCount),
+	})
+}
+
+// ListSettlementReports lists imported reports, newest first, optionally
+// for one ?provider=
+func (ah *AdminHandler) ListSettlementReports(c *gin.Context) {
+	query := `SELECT ` + settlementReportColumns + ` FROM settlement_reports WHERE $1::text = '' OR provider = $1 ORDER BY created_at DESC LIMIT 100`
+	rows, err := ah.db.Query(query, c.Query("provider"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch settlement reports",
+		})
+		return
+	}
+	defer rows.Close()
+
+	reports := []SettlementReport{}
+	for rows.Next() {
+		var r SettlementReport
+		if err := scanSettlementReport(rows, &r); err != nil {
+			continue
+		}
+		reports = append(reports, r)
+	}
+	if err := countOpenMismatches(ah.db, reports); err != nil {
+		log.Printf("Failed to count open reconciliation mismatches: %v", err)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    reports,
+	})
+}
+
+// GetSettlementReport returns a report with its rows
+func (ah *AdminHandler) GetSettlementReport(c *gin.Context) {
+	report, err := getSettlementReport(ah.db, c.Param("id"))
+	if err == errReportNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Settlement report not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch settlement report",
+		})
+		return
+	}
+	if report.Rows, err = listSettlementRows(ah.db, report.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch settlement report",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    report,
+	})
+}
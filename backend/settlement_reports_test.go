@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStripeBalanceReport(t *testing.T) {
+	const header = "id,type,source,payment_intent_id,amount,fee,net,currency,created (utc)\n"
+
+	tests := []struct {
+		name    string
+		report  string
+		want    []SettlementRow
+		wantErr error
+	}{
+		{
+			name: "payment, refund and payout",
+			report: header +
+				"txn_1,charge,ch_1,pi_1,100.00,3.20,96.80,usd,2024-03-01 10:00:00\n" +
+				"txn_2,refund,re_1,,-40.00,0.00,-40.00,usd,2024-03-02 11:30:00\n" +
+				"txn_3,payout,po_1,,-56.80,,,usd,2024-03-03 00:00:00\n",
+			want: []SettlementRow{
+				{RowID: "txn_1", Kind: SettlementPayment, Type: "charge", ProviderReference: "pi_1", Gross: NewMoney(10000, "USD"), Fee: NewMoney(320, "USD"), Net: NewMoney(9680, "USD"), OccurredAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+				{RowID: "txn_2", Kind: SettlementRefund, Type: "refund", ProviderReference: "re_1", Gross: NewMoney(-4000, "USD"), Fee: NewMoney(0, "USD"), Net: NewMoney(-4000, "USD"), OccurredAt: time.Date(2024, 3, 2, 11, 30, 0, 0, time.UTC)},
+				{RowID: "txn_3", Kind: SettlementOther, Type: "payout", Gross: NewMoney(-5680, "USD"), Fee: NewMoney(0, "USD"), Net: NewMoney(-5680, "USD"), OccurredAt: time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name: "charge without a PaymentIntent",
+			report: header +
+				"txn_1,charge,ch_1,,10.00,,,eur,1709287200\n",
+			want: []SettlementRow{
+				{RowID: "txn_1", Kind: SettlementPayment, Type: "charge", ProviderReference: "ch_1", Gross: NewMoney(1000, "EUR"), Fee: NewMoney(0, "EUR"), Net: NewMoney(1000, "EUR"), OccurredAt: time.Unix(1709287200, 0).UTC()},
+			},
+		},
+		{
+			name: "itemized report column names",
+			report: "balance_transaction_id,reporting_category,source_id,payment_intent_id,gross,fee,net,currency,created_utc\n" +
+				"txn_1,payment_refund,re_1,,-5.00,0.00,-5.00,gbp,2024-03-01T10:00:00Z\n",
+			want: []SettlementRow{
+				{RowID: "txn_1", Kind: SettlementRefund, Type: "payment_refund", ProviderReference: "re_1", Gross: NewMoney(-500, "GBP"), Fee: NewMoney(0, "GBP"), Net: NewMoney(-500, "GBP"), OccurredAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name: "no payment_intent_id column",
+			report: "id,type,source,amount,currency,created\n" +
+				"txn_1,charge,ch_1,10.00,usd,2024-03-01 10:00:00\n",
+			wantErr: errStripeReportNoPaymentIntent,
+		},
+		{
+			name: "no payment_intent_id column and no payments",
+			report: "id,type,source,amount,currency,created\n" +
+				"txn_1,payout,po_1,-10.00,usd,2024-03-01 10:00:00\n",
+			want: []SettlementRow{
+				{RowID: "txn_1", Kind: SettlementOther, Type: "payout", Gross: NewMoney(-1000, "USD"), Fee: NewMoney(0, "USD"), Net: NewMoney(-1000, "USD"), OccurredAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:    "too many decimals",
+			report:  header + "txn_1,charge,ch_1,pi_1,10.001,,,usd,2024-03-01 10:00:00\n",
+			wantErr: errAmountPrecision,
+		},
+		{
+			name:    "missing column",
+			report:  "id,type,amount,created\ntxn_1,charge,10.00,2024-03-01 10:00:00\n",
+			wantErr: errors.New(`missing column "currency"`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseStripeBalanceReport(strings.NewReader(tt.report))
+			checkSettlementRows(t, "stripe", rows, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestParsePayPalSettlementReport(t *testing.T) {
+	const preamble = `"RH","2024/03/02 02:00:00 +0000","A","MERCHANT123",011` + "\n" +
+		`"FH",01` + "\n" +
+		`"SH","2024/03/01 00:00:00 +0000","2024/03/01 23:59:59 +0000","MERCHANT123",""` + "\n" +
+		`"CH","Transaction ID","Invoice ID","PayPal Reference ID","Transaction Event Code","Transaction Initiation Date","Transaction Completion Date","Transaction Debit or Credit","Gross Transaction Amount","Gross Transaction Currency","Fee Debit or Credit","Fee Amount","Fee Currency"` + "\n"
+
+	tests := []struct {
+		name    string
+		report  string
+		want    []SettlementRow
+		wantErr error
+	}{
+		{
+			name: "payment, refund and withdrawal",
+			report: preamble +
+				`"SB","5TY05013RG002845M","INV-1","","T0006","2024/03/01 10:00:00 +0000","2024/03/01 10:00:05 +0000","CR","10000","USD","DR","379","USD"` + "\n" +
+				`"SB","1JU08902781691411","INV-1","5TY05013RG002845M","T1107","2024/03/01 12:00:00 +0000","","DR","4000","USD","CR","110","USD"` + "\n" +
+				`"SB","9NP24938CB8472312","","","T0400","2024/03/01 13:00:00 +0000","2024/03/01 13:00:00 +0000","DR","5000","USD","","",""` + "\n" +
+				`"SF",3` + "\n" +
+				`"SC",3` + "\n" +
+				`"RF",3` + "\n",
+			want: []SettlementRow{
+				{RowID: "5TY05013RG002845M", Kind: SettlementPayment, Type: "T0006", ProviderReference: "5TY05013RG002845M", Gross: NewMoney(10000, "USD"), Fee: NewMoney(379, "USD"), Net: NewMoney(9621, "USD"), OccurredAt: time.Date(2024, 3, 1, 10, 0, 5, 0, time.UTC), Description: "INV-1"},
+				{RowID: "1JU08902781691411", Kind: SettlementRefund, Type: "T1107", ProviderReference: "1JU08902781691411", Gross: NewMoney(-4000, "USD"), Fee: NewMoney(-110, "USD"), Net: NewMoney(-3890, "USD"), OccurredAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), Description: "INV-1"},
+				{RowID: "9NP24938CB8472312", Kind: SettlementOther, Type: "T0400", Gross: NewMoney(-5000, "USD"), Fee: NewMoney(0, "USD"), Net: NewMoney(-5000, "USD"), OccurredAt: time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:   "zero-decimal currency",
+			report: preamble + `"SB","2AB","","","T0006","2024/03/01 10:00:00 +0000","","CR","3000","JPY","DR","120","JPY"` + "\n",
+			want: []SettlementRow{
+				{RowID: "2AB", Kind: SettlementPayment, Type: "T0006", ProviderReference: "2AB", Gross: NewMoney(3000, "JPY"), Fee: NewMoney(120, "JPY"), Net: NewMoney(2880, "JPY"), OccurredAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:    "fee in another currency",
+			report:  preamble + `"SB","2AB","","","T0006","2024/03/01 10:00:00 +0000","","CR","10000","EUR","DR","379","USD"` + "\n",
+			wantErr: errors.New("line 5: fee currency USD differs from gross currency EUR"),
+		},
+		{
+			name:    "decimal amount",
+			report:  preamble + `"SB","2AB","","","T0006","2024/03/01 10:00:00 +0000","","CR","100.00","USD","","",""` + "\n",
+			wantErr: errInvalidAmount,
+		},
+		{
+			name:    "transaction before the column header",
+			report:  `"SB","2AB","","","T0006","2024/03/01 10:00:00 +0000","","CR","10000","USD","","",""` + "\n",
+			wantErr: errors.New("line 1: transaction before the CH column header"),
+		},
+		{
+			name:    "not a settlement report",
+			report:  "id,amount\ntxn_1,10.00\n",
+			wantErr: errors.New("no CH column header; not a PayPal settlement report"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parsePayPalSettlementReport(strings.NewReader(tt.report))
+			checkSettlementRows(t, "paypal", rows, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+// checkSettlementRows compares parsed rows, filling in the provider and
+// currency the want rows leave out. A sentinel wantErr is matched with
+// errors.Is and any other by its message.
+func checkSettlementRows(t *testing.T, provider string, rows []SettlementRow, err error, want []SettlementRow, wantErr error) {
+	t.Helper()
+	if wantErr != nil {
+		if err == nil || (!errors.Is(err, wantErr) && err.Error() != wantErr.Error()) {
+			t.Fatalf("error = %v, want %v", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(rows), len(want), rows)
+	}
+	for i, w := range want {
+		w.Provider = provider
+		w.Currency = w.Gross.Currency
+		if got := rows[i]; got != w {
+			t.Errorf("row %d = %+v\nwant %+v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// transactionTransitions lists the statuses each status may move to.
+// Statuses without an entry are final.
+var transactionTransitions = map[string][]string{
+	StatusPending:    {StatusProcessing, StatusAuthorized, StatusCaptured, StatusCompleted, StatusFailed, StatusBlocked},
+	StatusProcessing: {StatusPending, StatusAuthorized, StatusCaptured, StatusCompleted, StatusFailed, StatusBlocked},
+	StatusHeld:       {StatusProcessing, StatusFailed, StatusBlocked},
+	StatusAuthorized: {StatusProcessing, StatusCaptured, StatusCompleted, StatusFailed, StatusVoided},
+	StatusCaptured:   {StatusCompleted, StatusFailed, StatusRefunded, StatusDisputed},
+	StatusCompleted:  {StatusRefunded, StatusDisputed},
+	StatusDisputed:   {StatusCompleted, StatusRefunded},
+}
+
+var errIllegalTransition = errors.New("illegal status transition")
+
+// canTransition reports whether a transaction may move from one status to another
+func canTransition(from, to string) bool {
+	for _, next := range transactionTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTransition returns an error wrapping errIllegalTransition when the
+// move is not allowed
+func checkTransition(from, to string) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("%w from %s to %s", errIllegalTransition, from, to)
+	}
+	return nil
+}
+
+// countsTowardSpend reports whether a transaction in status is included in
+// the user's transaction_count and total_spent
+func countsTowardSpend(status string) bool {
+	return status == StatusCompleted || status == StatusDisputed
+}
+
+// insertStatusHistory records a status change. from is empty for the status
+// a transaction was created with.
+func insertStatusHistory(tx *sql.Tx, txnID, from, to, source, reason string, at time.Time) error {
+	query := `
+		INSERT INTO transaction_status_history (id, transaction_id, from_status, to_status, source, reason, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7)
+	`
+	_, err := tx.Exec(query, uuid.New().String(), txnID, from, to, source, reason, at)
+	return err
+}
+
+func listStatusHistory(db *DatabaseConnection, txnID string) ([]StatusChange, error) {
+	query := `
+		SELECT id, transaction_id, COALESCE(from_status, ''), to_status, source, COALESCE(reason, ''), created_at
+		FROM transaction_status_history
+		WHERE transaction_id = $1
+		ORDER BY created_at ASC
+	`
+	rows, err := db.Query(query, txnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var h StatusChange
+		if err := rows.Scan(&h.ID, &h.TransactionID, &h.FromStatus, &h.ToStatus, &h.Source, &h.Reason, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// GetTransactionHistory lists every status one of the caller's
+// transactions has been in
+func (th *TransactionHandler) GetTransactionHistory(c *gin.Context) {
+	if !th.requireTransactionOwner(c) {
+		return
+	}
+
+	history, err := listStatusHistory(th.db, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch status history",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    history,
+	})
+}
+
+// flowOnlyStatuses need a refund or dispute record and a ledger posting
+// backed by the provider, so an admin cannot set them by hand. The value
+// says where they come from.
+var flowOnlyStatuses = map[string]string{
+	StatusRefunded: "POST /transactions/:id/refunds",
+	StatusDisputed: "provider dispute webhooks",
+}
+
+// SetTransactionStatus lets an admin move a transaction by hand, for example
+// to correct a status after an incident. The state machine still applies.
+func (ah *AdminHandler) SetTransactionStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if flow, ok := flowOnlyStatuses[req.Status]; ok {
+		c.JSON(http.StatusUnprocessableEntity, APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("%s cannot be set by hand; it is set by %s", req.Status, flow),
+			Code:    "status_not_settable",
+		})
+		return
+	}
+
+	var txn *Transaction
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		txn, err = setTransactionStatus(tx, c.Param("id"), req.Status, "admin:"+c.GetString("admin_user"), req.Reason)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, APIResponse{Success: false, Error: "Transaction not found"})
+		return
+	}
+	if errors.Is(err, errIllegalTransition) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "illegal_transition",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set status of %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to update transaction status"})
+		return
+	}
+
+	ah.cache.Delete(txn.ID)
+	ah.broker.PublishEvent("payment."+txn.Status, txn)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    txn,
+	})
+}
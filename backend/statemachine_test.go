@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{StatusPending, StatusProcessing, true},
+		{StatusProcessing, StatusAuthorized, true},
+		{StatusProcessing, StatusCompleted, true},
+		{StatusHeld, StatusProcessing, true},
+		{StatusHeld, StatusCompleted, false},
+		{StatusAuthorized, StatusCaptured, true},
+		{StatusAuthorized, StatusVoided, true},
+		{StatusAuthorized, StatusRefunded, false},
+		{StatusCaptured, StatusCompleted, true},
+		{StatusCaptured, StatusVoided, false},
+		{StatusCompleted, StatusRefunded, true},
+		{StatusCompleted, StatusDisputed, true},
+		{StatusCompleted, StatusFailed, false},
+		{StatusCompleted, StatusProcessing, false},
+		{StatusDisputed, StatusCompleted, true},
+		{StatusDisputed, StatusRefunded, true},
+		{StatusDisputed, StatusVoided, false},
+		// Final statuses go nowhere
+		{StatusFailed, StatusProcessing, false},
+		{StatusBlocked, StatusProcessing, false},
+		{StatusRefunded, StatusCompleted, false},
+		{StatusVoided, StatusAuthorized, false},
+		{"unknown", StatusCompleted, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	if err := checkTransition(StatusCompleted, StatusRefunded); err != nil {
+		t.Errorf("checkTransition(completed, refunded) = %v, want nil", err)
+	}
+	err := checkTransition(StatusRefunded, StatusCompleted)
+	if !errors.Is(err, errIllegalTransition) {
+		t.Errorf("checkTransition(refunded, completed) = %v, want errIllegalTransition", err)
+	}
+}
+
+func TestCountsTowardSpend(t *testing.T) {
+	for status, want := range map[string]bool{
+		StatusCompleted:  true,
+		StatusDisputed:   true,
+		StatusCaptured:   false,
+		StatusAuthorized: false,
+		StatusRefunded:   false,
+		StatusFailed:     false,
+	} {
+		if got := countsTowardSpend(status); got != want {
+			t.Errorf("countsTowardSpend(%s) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestSetTransactionStatusRejectsFlowOnlyStatuses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// The check runs before the database is touched
+	router.POST("/admin/transactions/:id/status", (&AdminHandler{}).SetTransactionStatus)
+
+	for _, status := range []string{StatusRefunded, StatusDisputed} {
+		body := `{"status": "` + status + `", "reason": "manual"}`
+		w := serveTest(router, http.MethodPost, "/admin/transactions/txn_1/status", "admin", body)
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "status_not_settable") {
+			t.Errorf("set %s = %d: %s, want 422 status_not_settable", status, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/client"
+)
+
+// StripeClient wraps the Stripe API client. STRIPE_API_BASE_URL points it at
+// a local fake such as stripe-mock in development and CI.
+type StripeClient struct {
+	FeeSchedule
+	api *client.API
+}
+
+func NewStripeClient(fees FeeSchedule) *StripeClient {
+	config := &stripe.BackendConfig{
+		HTTPClient:        &http.Client{Timeout: getEnvDuration("STRIPE_TIMEOUT", 10*time.Second)},
+		MaxNetworkRetries: stripe.Int64(int64(getEnvInt("STRIPE_MAX_RETRIES", 2))),
+	}
+	if baseURL := getEnv("STRIPE_API_BASE_URL", ""); baseURL != "" {
+		config.URL = stripe.String(strings.TrimRight(baseURL, "/"))
+	}
+
+	backends := &stripe.Backends{
+		API:     stripe.GetBackendWithConfig(stripe.APIBackend, config),
+		Connect: stripe.GetBackend(stripe.ConnectBackend),
+		Uploads: stripe.GetBackend(stripe.UploadsBackend),
+	}
+
+	api := &client.API{}
+	api.Init(getEnv("STRIPE_SECRET_KEY", ""), backends)
+	return &StripeClient{FeeSchedule: fees, api: api}
+}
+
+// Authorize creates and confirms a manual-capture PaymentIntent for txn
+// using the payment method token supplied by the client
+func (sc *StripeClient) Authorize(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	if txn.PaymentMethod == "" {
+		return &ProviderResult{
+			Status:         StatusFailed,
+			FailureCode:    "payment_method_required",
+			FailureMessage: "A payment_method token is required for Stripe payments",
+		}, nil
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(txn.Amount.Minor),
+		Currency:           stripe.String(strings.ToLower(txn.Currency)),
+		PaymentMethod:      stripe.String(txn.PaymentMethod),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		CaptureMethod:      stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+		Description:        stripe.String(txn.Description),
+		Metadata: map[string]string{
+			"txn_id":  txn.ID,
+			"user_id": txn.UserID,
+		},
+	}
+	params.Context = ctx
+	// Keyed on our transaction so a retried request never creates a second intent
+	params.SetIdempotencyKey(txn.ID + ":create")
+
+	intent, err := sc.api.PaymentIntents.New(params)
+	if err != nil {
+		return stripeErrorResult(err)
+	}
+
+	confirmParams := &stripe.PaymentIntentConfirmParams{}
+	confirmParams.Context = ctx
+	confirmParams.SetIdempotencyKey(txn.ID + ":confirm")
+
+	confirmed, err := sc.api.PaymentIntents.Confirm(intent.ID, confirmParams)
+	if err != nil {
+		result, mapErr := stripeErrorResult(err)
+		if result != nil {
+			result.ProviderTxnID = intent.ID
+		}
+		return result, mapErr
+	}
+
+	return stripeIntentResult(confirmed), nil
+}
+
+// Capture captures amount from the PaymentIntent in txn.ProviderTxnID
+func (sc *StripeClient) Capture(ctx context.Context, txn *Transaction, amount Money) (*ProviderResult, error) {
+	params := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(amount.Minor),
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey(captureIdempotencyKey(txn, amount))
+
+	intent, err := sc.api.PaymentIntents.Capture(txn.ProviderTxnID, params)
+	if err != nil {
+		result, mapErr := stripeErrorResult(err)
+		if result != nil {
+			result.ProviderTxnID = txn.ProviderTxnID
+		}
+		return result, mapErr
+	}
+	return stripeIntentResult(intent), nil
+}
+
+// Refund refunds amount of the PaymentIntent in txn.ProviderTxnID
+func (sc *StripeClient) Refund(ctx context.Context, txn *Transaction, amount Money, reference string) (*ProviderResult, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(txn.ProviderTxnID),
+		Amount:        stripe.Int64(amount.Minor),
+	}
+	params.Context = ctx
+	params.AddMetadata("txn_id", txn.ID)
+	params.AddMetadata("refund_id", reference)
+	params.SetIdempotencyKey(reference)
+
+	refund, err := sc.api.Refunds.New(params)
+	if err != nil {
+		return stripeErrorResult(err)
+	}
+
+	result := &ProviderResult{ProviderTxnID: refund.ID}
+	switch refund.Status {
+	case stripe.RefundStatusSucceeded:
+		result.Status = StatusRefunded
+	case stripe.RefundStatusPending, stripe.RefundStatusRequiresAction:
+		result.Status = StatusProcessing
+	default:
+		result.Status = StatusFailed
+		result.FailureCode = string(refund.FailureReason)
+		if result.FailureCode == "" {
+			result.FailureCode = string(refund.Status)
+		}
+	}
+	return result, nil
+}
+
+// Void cancels the uncaptured PaymentIntent in txn.ProviderTxnID
+func (sc *StripeClient) Void(ctx context.Context, txn *Transaction) (*ProviderResult, error) {
+	params := &stripe.PaymentIntentCancelParams{}
+	params.Context = ctx
+	params.SetIdempotencyKey(txn.ID + ":void")
+
+	intent, err := sc.api.PaymentIntents.Cancel(txn.ProviderTxnID, params)
+	if err != nil {
+		return stripeErrorResult(err)
+	}
+	if intent.Status != stripe.PaymentIntentStatusCanceled {
+		return nil, fmt.Errorf("stripe: payment intent %s is %s after cancel", intent.ID, intent.Status)
+	}
+	return &ProviderResult{ProviderTxnID: intent.ID, Status: StatusVoided}, nil
+}
+
+// AuthorizationWindow is Stripe's 7 day limit on capturing a card authorization
+func (sc *StripeClient) AuthorizationWindow() time.Duration {
+	return 7 * 24 * time.Hour
+}
+
+// AcceptsPaymentMethod accepts Stripe PaymentMethod IDs
+func (sc *StripeClient) AcceptsPaymentMethod(token string) bool {
+	return strings.HasPrefix(token, "pm_")
+}
+
+// HealthCheck makes a cheap authenticated call to the Stripe API
+func (sc *StripeClient) HealthCheck(ctx context.Context) error {
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
+	_, err := sc.api.Balance.Get(params)
+	return err
+}
+
+// stripeIntentResult maps a PaymentIntent status onto our transaction statuses
+func stripeIntentResult(intent *stripe.PaymentIntent) *ProviderResult {
+	result := &ProviderResult{ProviderTxnID: intent.ID}
+
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		result.Status = StatusCompleted
+	case stripe.PaymentIntentStatusRequiresCapture:
+		result.Status = StatusAuthorized
+	case stripe.PaymentIntentStatusProcessing:
+		result.Status = StatusProcessing
+	case stripe.PaymentIntentStatusRequiresAction:
+		// Needs customer authentication such as 3-D Secure; finished via webhook
+		result.Status = StatusPending
+		result.FailureCode = "requires_action"
+	case stripe.PaymentIntentStatusCanceled:
+		result.Status = StatusFailed
+		result.FailureCode = "canceled"
+	default:
+		result.Status = StatusFailed
+		if intent.LastPaymentError != nil {
+			return declineResult(intent.ID, intent.LastPaymentError)
+		}
+		result.FailureCode = string(intent.Status)
+	}
+	return result
+}
+
+// stripeErrorResult maps a Stripe API error onto a transaction result. Card
+// declines are returned as a result; anything else is returned as an error.
+func stripeErrorResult(err error) (*ProviderResult, error) {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+		id := ""
+		if stripeErr.PaymentIntent != nil {
+			id = stripeErr.PaymentIntent.ID
+		}
+		return declineResult(id, stripeErr), nil
+	}
+	return nil, err
+}
+
+// fraudDeclineCodes are issuer decline codes that indicate fraud rather than
+// an ordinary failure; they block the transaction instead of failing it
+var fraudDeclineCodes = map[stripe.DeclineCode]bool{
+	stripe.DeclineCodeFraudulent:        true,
+	stripe.DeclineCodeLostCard:          true,
+	stripe.DeclineCodeStolenCard:        true,
+	stripe.DeclineCodePickupCard:        true,
+	stripe.DeclineCodeMerchantBlacklist: true,
+}
+
+func declineResult(providerTxnID string, stripeErr *stripe.Error) *ProviderResult {
+	code := string(stripeErr.DeclineCode)
+	if code == "" {
+		code = string(stripeErr.Code)
+	}
+
+	status := StatusFailed
+	if fraudDeclineCodes[stripeErr.DeclineCode] {
+		status = StatusBlocked
+	}
+
+	return &ProviderResult{
+		ProviderTxnID:  providerTxnID,
+		Status:         status,
+		FailureCode:    code,
+		FailureMessage: stripeErr.Msg,
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v75"
+)
+
+func TestDeclineResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        *stripe.Error
+		wantStatus string
+		wantCode   string
+	}{
+		{
+			name:       "issuer decline",
+			err:        &stripe.Error{Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeInsufficientFunds, Msg: "Your card has insufficient funds."},
+			wantStatus: StatusFailed,
+			wantCode:   "insufficient_funds",
+		},
+		{
+			name:       "card error without decline code",
+			err:        &stripe.Error{Code: stripe.ErrorCodeExpiredCard, Msg: "Your card has expired."},
+			wantStatus: StatusFailed,
+			wantCode:   "expired_card",
+		},
+		{
+			name:       "fraudulent",
+			err:        &stripe.Error{Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeFraudulent},
+			wantStatus: StatusBlocked,
+			wantCode:   "fraudulent",
+		},
+		{
+			name:       "stolen card",
+			err:        &stripe.Error{Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeStolenCard},
+			wantStatus: StatusBlocked,
+			wantCode:   "stolen_card",
+		},
+		{
+			name:       "merchant blacklist",
+			err:        &stripe.Error{Code: stripe.ErrorCodeCardDeclined, DeclineCode: stripe.DeclineCodeMerchantBlacklist},
+			wantStatus: StatusBlocked,
+			wantCode:   "merchant_blacklist",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := declineResult("pi_123", tt.err)
+			if result.Status != tt.wantStatus || result.FailureCode != tt.wantCode {
+				t.Errorf("declineResult = %s/%s, want %s/%s", result.Status, result.FailureCode, tt.wantStatus, tt.wantCode)
+			}
+			if result.ProviderTxnID != "pi_123" || result.FailureMessage != tt.err.Msg {
+				t.Errorf("declineResult = %+v, want the intent ID and Stripe's message", result)
+			}
+		})
+	}
+}
+
+func TestStripeErrorResult(t *testing.T) {
+	networkErr := errors.New("connection reset")
+	tests := []struct {
+		name       string
+		err        error
+		wantResult bool
+		wantStatus string
+		wantID     string
+	}{
+		{
+			name:       "card error is a decline",
+			err:        &stripe.Error{Type: stripe.ErrorTypeCard, DeclineCode: stripe.DeclineCodeGenericDecline, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1"}},
+			wantResult: true,
+			wantStatus: StatusFailed,
+			wantID:     "pi_1",
+		},
+		{
+			name:       "wrapped card error",
+			err:        fmt.Errorf("confirm: %w", &stripe.Error{Type: stripe.ErrorTypeCard, DeclineCode: stripe.DeclineCodeLostCard}),
+			wantResult: true,
+			wantStatus: StatusBlocked,
+		},
+		{name: "invalid request is an error", err: &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing}},
+		{name: "api error is an error", err: &stripe.Error{Type: stripe.ErrorTypeAPI}},
+		{name: "network error is an error", err: networkErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := stripeErrorResult(tt.err)
+			if !tt.wantResult {
+				if result != nil || err != tt.err {
+					t.Fatalf("stripeErrorResult = %+v, %v, want nil, the original error", result, err)
+				}
+				return
+			}
+			if err != nil || result == nil {
+				t.Fatalf("stripeErrorResult = %+v, %v, want a result", result, err)
+			}
+			if result.Status != tt.wantStatus || result.ProviderTxnID != tt.wantID {
+				t.Errorf("stripeErrorResult = %+v, want status %s and ID %q", result, tt.wantStatus, tt.wantID)
+			}
+		})
+	}
+}
+
+// fakeStripe serves the PaymentIntent endpoints the client calls. confirm is
+// the status and body returned by the confirm call.
+func fakeStripe(t *testing.T, confirmStatus int, confirmBody string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer sk_test_") {
+			t.Errorf("missing secret key on %s", r.URL.Path)
+		}
+		if r.Header.Get("Idempotency-Key") == "" {
+			t.Errorf("missing Idempotency-Key on %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			r.ParseForm()
+			if r.PostForm.Get("capture_method") != "manual" || r.PostForm.Get("metadata[txn_id]") != "txn_1" {
+				t.Errorf("unexpected create params %v", r.PostForm)
+			}
+			fmt.Fprint(w, `{"id": "pi_1", "object": "payment_intent", "status": "requires_confirmation"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents/pi_1/confirm":
+			w.WriteHeader(confirmStatus)
+			fmt.Fprint(w, confirmBody)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func newTestStripeClient(t *testing.T, baseURL string) *StripeClient {
+	t.Setenv("STRIPE_API_BASE_URL", baseURL)
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("STRIPE_MAX_RETRIES", "0")
+	return NewStripeClient(FeeSchedule{})
+}
+
+func TestStripeAuthorize(t *testing.T) {
+	tests := []struct {
+		name          string
+		confirmStatus int
+		confirmBody   string
+		wantErr       bool
+		wantStatus    string
+		wantCode      string
+	}{
+		{
+			name:          "authorized",
+			confirmStatus: http.StatusOK,
+			confirmBody:   `{"id": "pi_1", "object": "payment_intent", "status": "requires_capture"}`,
+			wantStatus:    StatusAuthorized,
+		},
+		{
+			name:          "requires authentication",
+			confirmStatus: http.StatusOK,
+			confirmBody:   `{"id": "pi_1", "object": "payment_intent", "status": "requires_action"}`,
+			wantStatus:    StatusPending,
+			wantCode:      "requires_action",
+		},
+		{
+			name:          "issuer decline",
+			confirmStatus: http.StatusPaymentRequired,
+			confirmBody:   `{"error": {"type": "card_error", "code": "card_declined", "decline_code": "insufficient_funds", "message": "Your card has insufficient funds."}}`,
+			wantStatus:    StatusFailed,
+			wantCode:      "insufficient_funds",
+		},
+		{
+			name:          "fraud decline",
+			confirmStatus: http.StatusPaymentRequired,
+			confirmBody:   `{"error": {"type": "card_error", "code": "card_declined", "decline_code": "fraudulent", "message": "Your card was declined."}}`,
+			wantStatus:    StatusBlocked,
+			wantCode:      "fraudulent",
+		},
+		{
+			name:          "stripe outage",
+			confirmStatus: http.StatusInternalServerError,
+			confirmBody:   `{"error": {"type": "api_error", "message": "Something went wrong."}}`,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeStripe(t, tt.confirmStatus, tt.confirmBody)
+			defer server.Close()
+			sc := newTestStripeClient(t, server.URL)
+
+			txn := &Transaction{ID: "txn_1", UserID: "user_001", Amount: NewMoney(1999, "USD"), Currency: "USD", PaymentMethod: "pm_card_visa"}
+			result, err := sc.Authorize(context.Background(), txn)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Authorize = %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authorize error: %v", err)
+			}
+			if result.Status != tt.wantStatus || result.FailureCode != tt.wantCode {
+				t.Errorf("Authorize = %s/%s, want %s/%s", result.Status, result.FailureCode, tt.wantStatus, tt.wantCode)
+			}
+			if result.ProviderTxnID != "pi_1" {
+				t.Errorf("ProviderTxnID = %q, want pi_1", result.ProviderTxnID)
+			}
+		})
+	}
+}
+
+func TestStripeAuthorizeRequiresPaymentMethod(t *testing.T) {
+	sc := newTestStripeClient(t, "http://127.0.0.1:0")
+	result, err := sc.Authorize(context.Background(), &Transaction{ID: "txn_1", Amount: NewMoney(100, "USD"), Currency: "USD"})
+	if err != nil || result.FailureCode != "payment_method_required" {
+		t.Errorf("Authorize = %+v, %v, want payment_method_required", result, err)
+	}
+}
+
+// TestStripeMock runs the payment flow against stripe-mock when
+// STRIPE_MOCK_URL is set, for example http://localhost:12111
+func TestStripeMock(t *testing.T) {
+	baseURL := os.Getenv("STRIPE_MOCK_URL")
+	if baseURL == "" {
+		t.Skip("STRIPE_MOCK_URL is not set")
+	}
+	sc := newTestStripeClient(t, baseURL)
+	ctx := context.Background()
+
+	if err := sc.HealthCheck(ctx); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	txn := &Transaction{ID: "txn_mock", UserID: "user_001", Amount: NewMoney(1999, "USD"), Currency: "USD", PaymentMethod: "pm_card_visa"}
+	result, err := sc.Authorize(ctx, txn)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if result.ProviderTxnID == "" {
+		t.Fatalf("Authorize = %+v, want a PaymentIntent ID", result)
+	}
+	txn.ProviderTxnID = result.ProviderTxnID
+	if _, err := sc.Capture(ctx, txn, txn.Amount); err != nil {
+		t.Errorf("Capture: %v", err)
+	}
+	if _, err := sc.Refund(ctx, txn, NewMoney(500, "USD"), "refund_mock"); err != nil {
+		t.Errorf("Refund: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"math/big"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// transactionColumns is the column list read by scanTransaction. Nullable text
+// columns are coalesced so they scan cleanly into strings.
+const transactionColumns = `id, user_id, amount, currency, status, risk_score, fraud_detected, COALESCE(provider, ''), COALESCE(provider_txn_id, ''), COALESCE(payment_method, ''), COALESCE(failure_code, ''), COALESCE(failure_message, ''), COALESCE(merchant_category, ''), COALESCE(routing_reason, ''), retry_plan, capture_method, authorization_expires_at, captured_amount, refunded_amount, settlement_amount, settlement_currency, fx_rate, COALESCE(description, ''), created_at, updated_at`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(row rowScanner, txn *Transaction) error {
+	var authExpiresAt sql.NullTime
+	var amount, captured, refunded, settlement moneyColumn
+	var fxRate string
+	err := row.Scan(&txn.ID, &txn.UserID, &amount, &txn.Currency, &txn.Status, &txn.RiskScore, &txn.FraudDetected, &txn.Provider, &txn.ProviderTxnID, &txn.PaymentMethod, &txn.FailureCode, &txn.FailureMessage, &txn.MerchantCategory, &txn.RoutingReason, pq.Array(&txn.RetryPlan), &txn.CaptureMethod, &authExpiresAt, &captured, &refunded, &settlement, &txn.SettlementCurrency, &fxRate, &txn.Description, &txn.CreatedAt, &txn.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if authExpiresAt.Valid {
+		txn.AuthorizationExpiresAt = &authExpiresAt.Time
+	}
+	if txn.Amount, err = amount.money(txn.Currency); err != nil {
+		return err
+	}
+	if txn.CapturedAmount, err = captured.money(txn.Currency); err != nil {
+		return err
+	}
+	if txn.RefundedAmount, err = refunded.money(txn.Currency); err != nil {
+		return err
+	}
+	if txn.SettlementAmount, err = settlement.money(txn.SettlementCurrency); err != nil {
+		return err
+	}
+	if rate, err := parseFXRate(fxRate); err == nil {
+		txn.FXRate = formatFXRate(rate)
+	}
+	return nil
+}
+
+// getTransactionForUpdate loads a transaction and locks its row until tx ends
+func getTransactionForUpdate(tx *sql.Tx, txnID string) (*Transaction, error) {
+	var txn Transaction
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1 FOR UPDATE`
+	if err := scanTransaction(tx.QueryRow(query, txnID), &txn); err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+func insertTransaction(tx *sql.Tx, txn *Transaction) error {
+	query := `
+		INSERT INTO transactions (id, user_id, amount, currency, status, risk_score, fraud_detected, provider, payment_method, failure_code, failure_message,
+			merchant_category, routing_reason, retry_plan, capture_method, settlement_amount, settlement_currency, fx_rate, description, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, ''), NULLIF($13, ''), $14, $15, $16, $17, $18, $19, $20, $21)
+	`
+	if txn.CaptureMethod == "" {
+		txn.CaptureMethod = CaptureAutomatic
+	}
+	_, err := tx.Exec(query, txn.ID, txn.UserID, txn.Amount, txn.Currency, txn.Status, txn.RiskScore, txn.FraudDetected, txn.Provider, txn.PaymentMethod, txn.FailureCode, txn.FailureMessage,
+		txn.MerchantCategory, txn.RoutingReason, pq.Array(txn.RetryPlan), txn.CaptureMethod, txn.SettlementAmount, txn.SettlementCurrency, string(txn.FXRate), txn.Description, txn.CreatedAt, txn.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return insertStatusHistory(tx, txn.ID, "", txn.Status, "api", txn.FailureCode, txn.CreatedAt)
+}
+
+// setTransactionStatus changes a transaction's status inside tx, rejecting
+// moves the state machine does not allow and treating the current status as
+// a no-op. Each change is recorded in transaction_status_history, posted to
+// the ledger and applied to the paying user's transaction_count and total_spent.
+func setTransactionStatus(tx *sql.Tx, txnID, status, source, reason string) (*Transaction, error) {
+	txn, err := getTransactionForUpdate(tx, txnID)
+	if err != nil {
+		return nil, err
+	}
+	previous := txn.Status
+	if previous == status {
+		return txn, nil
+	}
+	if err := checkTransition(previous, status); err != nil {
+		return nil, err
+	}
+
+	spentBefore, err := userSpend(tx, txn, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	txn.Status = status
+	txn.UpdatedAt = time.Now()
+	if (status == StatusCaptured || status == StatusCompleted) && txn.CapturedAmount.IsZero() {
+		// Charges capture in full unless a partial capture already set this
+		txn.CapturedAmount = txn.Amount
+	}
+	query := `UPDATE transactions SET status = $1, captured_amount = $2, updated_at = $3 WHERE id = $4`
+	if _, err := tx.Exec(query, txn.Status, txn.CapturedAmount, txn.UpdatedAt, txn.ID); err != nil {
+		return nil, err
+	}
+
+	if err := insertStatusHistory(tx, txn.ID, previous, status, source, reason, txn.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := postStatusChange(tx, txn, previous); err != nil {
+		return nil, err
+	}
+
+	spentAfter, err := userSpend(tx, txn, status)
+	if err != nil {
+		return nil, err
+	}
+	countDelta := 0
+	switch {
+	case !countsTowardSpend(previous) && countsTowardSpend(status):
+		countDelta = 1
+	case countsTowardSpend(previous) && !countsTowardSpend(status):
+		countDelta = -1
+	}
+	if err := applyUserSpend(tx, txn.UserID, countDelta, spentAfter.Sub(spentBefore)); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// settled converts an amount in the transaction's currency into its
+// settlement currency at the rate the payment was settled at
+func (t *Transaction) settled(m Money) Money {
+	if m.Cmp(t.Amount) == 0 {
+		return t.SettlementAmount
+	}
+	rate, err := parseFXRate(string(t.FXRate))
+	if err != nil {
+		rate = big.NewRat(1, 1)
+	}
+	return m.Convert(rate, t.SettlementCurrency)
+}
+
+// userSpend returns what txn adds to its user's total_spent while in status:
+// the captured amount still held after refunds and lost disputes, in the
+// settlement currency. Only completed and disputed transactions count.
+func userSpend(tx *sql.Tx, txn *Transaction, status string) (Money, error) {
+	if !countsTowardSpend(status) {
+		return NewMoney(0, txn.SettlementCurrency), nil
+	}
+	outstanding, err := outstandingRevenue(tx, txn)
+	if err != nil {
+		return Money{}, err
+	}
+	return txn.settled(outstanding), nil
+}
+
+// postUserPayback posts a refund or lost dispute with postPayback and takes
+// what it gave back off the user's total_spent
+func postUserPayback(tx *sql.Tx, txn *Transaction, account, referenceType, referenceID string, amount Money) error {
+	before, err := userSpend(tx, txn, txn.Status)
+	if err != nil {
+		return err
+	}
+	if err := postPayback(tx, txn, account, referenceType, referenceID, amount); err != nil {
+		return err
+	}
+	after, err := userSpend(tx, txn, txn.Status)
+	if err != nil {
+		return err
+	}
+	return applyUserSpend(tx, txn.UserID, 0, after.Sub(before))
+}
+
+// applyUserSpend adjusts a user's running totals. total_spent is kept in the
+// settlement currency so payments in different currencies add up.
+func applyUserSpend(tx *sql.Tx, userID string, countDelta int, amountDelta Money) error {
+	if countDelta == 0 && amountDelta.IsZero() {
+		return nil
+	}
+	query := `
+		UPDATE users
+		SET transaction_count = GREATEST(transaction_count + $1, 0),
+			total_spent = GREATEST(total_spent + $2, 0),
+			total_spent_currency = $3,
+			updated_at = $4
+		WHERE id = $5
+	`
+	_, err := tx.Exec(query, countDelta, amountDelta, amountDelta.Currency, time.Now(), userID)
+	return err
+}
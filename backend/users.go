@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// User audit actions
+const (
+	UserActionBlacklisted   = "blacklisted"
+	UserActionUnblacklisted = "unblacklisted"
+)
+
+// queryRower is satisfied by *DatabaseConnection, *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const userColumns = `id, email, name, COALESCE(status, 'active'), COALESCE(transaction_count, 0), COALESCE(total_spent, 0), total_spent_currency, COALESCE(is_blacklisted, FALSE), created_at, updated_at`
+
+func scanUser(row rowScanner, user *User) error {
+	var totalSpent moneyColumn
+	if err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Status, &user.TransactionCount, &totalSpent, &user.TotalSpentCurrency, &user.IsBlacklisted, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		return err
+	}
+	var err error
+	user.TotalSpent, err = totalSpent.money(user.TotalSpentCurrency)
+	return err
+}
+
+func getUser(q queryRower, userID string) (*User, error) {
+	var user User
+	err := scanUser(q.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = $1`, userID), &user)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+type UserHandler struct {
+	db *DatabaseConnection
+}
+
+func NewUserHandler(db *DatabaseConnection) *UserHandler {
+	return &UserHandler{db: db}
+}
+
+// GetUserProfile returns a user's profile including running payment totals.
+// Users may only read their own profile.
+func (uh *UserHandler) GetUserProfile(c *gin.Context) {
+	userID := c.Param("id")
+	if c.GetString("user_id") != userID {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Error:   "Unauthorized access",
+		})
+		return
+	}
+
+	user, err := getUser(uh.db, userID)
+	if err == errUserNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "User not found",
+			Code:    "user_not_found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    UserProfile{User: *user, AccountAgeDays: user.AccountAgeDays()},
+	})
+}
+
+// userRejection returns an error code and risk factor when a user may not pay
+func userRejection(user *User) (string, string) {
+	switch {
+	case user.IsBlacklisted:
+		return "user_blacklisted", "User is blacklisted"
+	case user.Status == "suspended":
+		return "user_suspended", "User account is suspended"
+	case user.Status != "active":
+		return "user_inactive", "User account is not active"
+	default:
+		return "", ""
+	}
+}
+
+// rejectUser records the attempt as a blocked transaction with a fraud log
+// and responds with 403 and the rejection code
+func (th *TransactionHandler) rejectUser(c *gin.Context, txnID string, req PaymentRequest, settlement Settlement, code, reason string, now time.Time) {
+	txn := Transaction{
+		ID:                 txnID,
+		UserID:             req.UserID,
+		Amount:             req.Amount,
+		Currency:           req.Currency,
+		Status:             StatusBlocked,
+		RiskScore:          1,
+		FraudDetected:      true,
+		RiskFactors:        []string{reason},
+		SettlementAmount:   settlement.Amount,
+		SettlementCurrency: settlement.Amount.Currency,
+		FXRate:             settlement.Rate,
+		Description:        req.Description,
+		Metadata:           req.Metadata,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+
+	err := th.db.WithTransaction(func(tx *sql.Tx) error {
+		if err := insertTransaction(tx, &txn); err != nil {
+			return err
+		}
+		return insertFraudLog(tx, &FraudLog{
+			TransactionID: txn.ID,
+			UserID:        txn.UserID,
+			RiskFactors:   txn.RiskFactors,
+			RiskScore:     txn.RiskScore,
+			Action:        FraudActionBlocked,
+			Reason:        code,
+			DetectedAt:    now,
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to record rejected transaction %s: %v", txnID, err)
+	} else {
+		th.broker.PublishEvent("payment.blocked", txn)
+	}
+
+	c.JSON(http.StatusForbidden, APIResponse{
+		Success: false,
+		Error:   reason,
+		Code:    code,
+	})
+}
+
+func (ah *AdminHandler) BlacklistUser(c *gin.Context) {
+	ah.setUserBlacklisted(c, true)
+}
+
+func (ah *AdminHandler) UnblacklistUser(c *gin.Context) {
+	ah.setUserBlacklisted(c, false)
+}
+
+// setUserBlacklisted flips users.is_blacklisted and writes an audit entry in
+// the same database transaction
+func (ah *AdminHandler) setUserBlacklisted(c *gin.Context, blacklisted bool) {
+	actor, ok := analystFromContext(c)
+	if !ok {
+		return
+	}
+
+	var req UserStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	userID := c.Param("id")
+	action := UserActionUnblacklisted
+	if blacklisted {
+		action = UserActionBlacklisted
+	}
+
+	entry := UserAuditEntry{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Action:    action,
+		Reason:    req.Reason,
+		Actor:     actor,
+		CreatedAt: time.Now(),
+	}
+
+	var unchanged bool
+	err := ah.db.WithTransaction(func(tx *sql.Tx) error {
+		query := `UPDATE users SET is_blacklisted = $1, updated_at = $2 WHERE id = $3 AND is_blacklisted IS DISTINCT FROM $1`
+		result, err := tx.Exec(query, blacklisted, entry.CreatedAt, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// Either the user does not exist or is already in the requested state
+			if _, err := getUser(tx, userID); err != nil {
+				return err
+			}
+			unchanged = true
+			return nil
+		}
+
+		query = `INSERT INTO user_audit_log (id, user_id, action, reason, actor, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+		_, err = tx.Exec(query, entry.ID, entry.UserID, entry.Action, entry.Reason, entry.Actor, entry.CreatedAt)
+		return err
+	})
+	if err == errUserNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "User not found",
+			Code:    "user_not_found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update blacklist for user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to update user",
+		})
+		return
+	}
+	if unchanged {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Error:   "User is already " + action,
+		})
+		return
+	}
+
+	ah.broker.PublishEvent("user."+action, entry)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    entry,
+		Message: "User " + action,
+	})
+}
+
+func (ah *AdminHandler) GetUserAuditLog(c *gin.Context) {
+	query := `SELECT id, user_id, action, reason, actor, created_at FROM user_audit_log WHERE user_id = $1 ORDER BY created_at DESC LIMIT 100`
+	rows, err := ah.db.Query(query, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch audit log",
+		})
+		return
+	}
+	defer rows.Close()
+
+	var entries []UserAuditEntry
+	for rows.Next() {
+		var e UserAuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.Reason, &e.Actor, &e.CreatedAt); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    entries,
+	})
+}
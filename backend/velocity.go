@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VelocityStore keeps sliding-window event counters. Amounts are minor units
+// of the settlement currency, so sums are exact. Implementations must be
+// safe for concurrent use; shared implementations let replicas see each
+// other's traffic.
+type VelocityStore interface {
+	// Record adds an event of the given amount for key at time at
+	Record(ctx context.Context, key string, amount int64, at time.Time) error
+	// Window returns the number of events and their summed amount for key
+	// within (at-window, at]
+	Window(ctx context.Context, key string, window time.Duration, at time.Time) (int, int64, error)
+}
+
+// NewVelocityStore returns the store selected by VELOCITY_STORE (memory or redis)
+func NewVelocityStore() VelocityStore {
+	switch getEnv("VELOCITY_STORE", "memory") {
+	case "redis":
+		store, err := NewRedisVelocityStore(getEnv("REDIS_URL", "redis://localhost:6379/0"), velocityRetention)
+		if err != nil {
+			log.Printf("Redis velocity store unavailable (using in-memory fallback): %v", err)
+			return NewMemoryVelocityStore(velocityRetention)
+		}
+		return store
+	default:
+		return NewMemoryVelocityStore(velocityRetention)
+	}
+}
+
+// velocityRetention bounds how long events are kept; it must cover the largest window
+const velocityRetention = 24 * time.Hour
+
+type velocityEvent struct {
+	at     time.Time
+	amount int64
+}
+
+// MemoryVelocityStore is an in-process VelocityStore for single-replica deployments
+type MemoryVelocityStore struct {
+	events    map[string][]velocityEvent
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+func NewMemoryVelocityStore(retention time.Duration) *MemoryVelocityStore {
+	ms := &MemoryVelocityStore{
+		events:    make(map[string][]velocityEvent),
+		retention: retention,
+	}
+
+	go ms.cleanupExpired()
+	return ms
+}
+
+func (ms *MemoryVelocityStore) Record(ctx context.Context, key string, amount int64, at time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.events[key] = append(ms.events[key], velocityEvent{at: at, amount: amount})
+	return nil
+}
+
+func (ms *MemoryVelocityStore) Window(ctx context.Context, key string, window time.Duration, at time.Time) (int, int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	since := at.Add(-window)
+	count, sum := 0, int64(0)
+	for _, e := range ms.events[key] {
+		if e.at.After(since) && !e.at.After(at) {
+			count++
+			sum += e.amount
+		}
+	}
+	return count, sum, nil
+}
+
+func (ms *MemoryVelocityStore) cleanupExpired() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ms.mu.Lock()
+		cutoff := time.Now().Add(-ms.retention)
+		for key, events := range ms.events {
+			kept := events[:0]
+			for _, e := range events {
+				if e.at.After(cutoff) {
+					kept = append(kept, e)
+				}
+			}
+			if len(kept) == 0 {
+				delete(ms.events, key)
+			} else {
+				ms.events[key] = kept
+			}
+		}
+		ms.mu.Unlock()
+	}
+}
+
+// VelocityLimit caps the count and summed amount within a window. MaxAmount
+// is in the settlement currency. A zero limit is not enforced.
+type VelocityLimit struct {
+	Window    time.Duration
+	Label     string
+	MaxCount  int
+	MaxAmount Money
+}
+
+// defaultVelocityLimits apply to every dimension unless VELOCITY_LIMITS is set
+const defaultVelocityLimits = "1m:5:2000,1h:20:10000,24h:50:25000"
+
+// parseVelocityLimits parses "window:max_count:max_amount" entries separated
+// by commas. Amounts are decimals in currency, the settlement currency.
+func parseVelocityLimits(spec, currency string) ([]VelocityLimit, error) {
+	var limits []VelocityLimit
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid velocity limit %q", entry)
+		}
+		window, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid velocity window %q: %w", parts[0], err)
+		}
+		if window > velocityRetention {
+			return nil, fmt.Errorf("velocity window %s exceeds retention %s", window, velocityRetention)
+		}
+		maxCount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid velocity count %q: %w", parts[1], err)
+		}
+		maxAmount, err := ParseMoney(parts[2], currency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid velocity amount %q: %w", parts[2], err)
+		}
+		limits = append(limits, VelocityLimit{Window: window, Label: parts[0], MaxCount: maxCount, MaxAmount: maxAmount})
+	}
+	return limits, nil
+}
+
+// VelocityChecker counts payments per user, device fingerprint and IP and
+// reports the windows that exceed their limits
+type VelocityChecker struct {
+	store       VelocityStore
+	limits      []VelocityLimit
+	scoreWeight float64
+}
+
+func NewVelocityChecker(store VelocityStore, settlementCurrency string) *VelocityChecker {
+	limits, err := parseVelocityLimits(getEnv("VELOCITY_LIMITS", defaultVelocityLimits), settlementCurrency)
+	if err != nil {
+		log.Printf("Invalid VELOCITY_LIMITS, using defaults: %v", err)
+		limits, _ = parseVelocityLimits(defaultVelocityLimits, settlementCurrency)
+	}
+
+	return &VelocityChecker{
+		store:       store,
+		limits:      limits,
+		scoreWeight: getEnvFloat("VELOCITY_SCORE_WEIGHT", 0.1),
+	}
+}
+
+type velocityDimension struct {
+	name  string
+	value string
+}
+
+// velocityDimensions returns the dimensions a payment is counted under
+func velocityDimensions(req PaymentRequest) []velocityDimension {
+	dims := []velocityDimension{{"user", req.UserID}}
+	if req.DeviceFingerprint != "" {
+		dims = append(dims, velocityDimension{"device", req.DeviceFingerprint})
+	}
+	if req.IPAddress != "" {
+		dims = append(dims, velocityDimension{"ip", req.IPAddress})
+	}
+	return dims
+}
+
+// Check records the payment and returns a risk factor for every triggered
+// window, together with the score adjustment they add up to. settled is the
+// payment in the settlement currency, which is the currency of the amount
+// limits. Every attempt is counted, including ones that are later blocked, so
+// card-testing bursts show up even when they fail.
+func (vc *VelocityChecker) Check(ctx context.Context, req PaymentRequest, settled Money, at time.Time) ([]string, float64) {
+	factors := []string{}
+	for _, dim := range velocityDimensions(req) {
+		key := "velocity:" + dim.name + ":" + dim.value
+		if err := vc.store.Record(ctx, key, settled.Minor, at); err != nil {
+			log.Printf("Failed to record velocity for %s: %v", dim.name, err)
+			continue
+		}
+
+		for _, limit := range vc.limits {
+			count, sum, err := vc.store.Window(ctx, key, limit.Window, at)
+			if err != nil {
+				log.Printf("Failed to read velocity window %s for %s: %v", limit.Label, dim.name, err)
+				continue
+			}
+			if limit.MaxCount > 0 && count > limit.MaxCount {
+				factors = append(factors, fmt.Sprintf("velocity_%s_count_%s", dim.name, limit.Label))
+			}
+			if limit.MaxAmount.IsPositive() && NewMoney(sum, settled.Currency).Cmp(limit.MaxAmount) > 0 {
+				factors = append(factors, fmt.Sprintf("velocity_%s_amount_%s", dim.name, limit.Label))
+			}
+		}
+	}
+
+	return factors, float64(len(factors)) * vc.scoreWeight
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseVelocityLimits(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []VelocityLimit
+		wantErr bool
+	}{
+		{
+			spec: "1m:5:2000, 1h:20:10000.50",
+			want: []VelocityLimit{
+				{Window: time.Minute, Label: "1m", MaxCount: 5, MaxAmount: NewMoney(200000, "USD")},
+				{Window: time.Hour, Label: "1h", MaxCount: 20, MaxAmount: NewMoney(1000050, "USD")},
+			},
+		},
+		{spec: "24h:0:0", want: []VelocityLimit{{Window: 24 * time.Hour, Label: "24h", MaxAmount: NewMoney(0, "USD")}}},
+		{spec: "1m:5", wantErr: true},
+		{spec: "soon:5:2000", wantErr: true},
+		{spec: "48h:5:2000", wantErr: true},
+		{spec: "1m:five:2000", wantErr: true},
+		{spec: "1m:5:lots", wantErr: true},
+		{spec: "1m:5:0.001", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseVelocityLimits(tt.spec, "USD")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseVelocityLimits(%q) = %v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVelocityLimits(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseVelocityLimits(%q) = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseVelocityLimits(%q)[%d] = %+v, want %+v", tt.spec, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestMemoryVelocityStoreWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryVelocityStore(velocityRetention)
+	for _, e := range []struct {
+		ago    time.Duration
+		amount int64
+	}{
+		{0, 10},
+		{30 * time.Second, 20},
+		{time.Minute, 40}, // on the boundary, outside (at-window, at]
+		{30 * time.Minute, 80},
+		{2 * time.Hour, 160},
+	} {
+		if err := store.Record(ctx, "k", e.amount, now.Add(-e.ago)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A later event is not part of a window ending now
+	store.Record(ctx, "k", 1000, now.Add(time.Second))
+
+	tests := []struct {
+		window    time.Duration
+		wantCount int
+		wantSum   int64
+	}{
+		{time.Minute, 2, 30},
+		{time.Hour, 4, 150},
+		{24 * time.Hour, 5, 310},
+	}
+	for _, tt := range tests {
+		count, sum, err := store.Window(ctx, "k", tt.window, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.wantCount || sum != tt.wantSum {
+			t.Errorf("Window(%s) = %d, %v, want %d, %v", tt.window, count, sum, tt.wantCount, tt.wantSum)
+		}
+	}
+	if count, _, _ := store.Window(ctx, "other", time.Hour, now); count != 0 {
+		t.Errorf("Window for an unknown key = %d, want 0", count)
+	}
+}
+
+func TestVelocityCheck(t *testing.T) {
+	limits, err := parseVelocityLimits("1m:2:2000", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		req     PaymentRequest
+		settled []Money
+		want    []string
+	}{
+		{
+			name:    "under limits",
+			req:     PaymentRequest{UserID: "u1"},
+			settled: []Money{NewMoney(150000, "USD")},
+			want:    []string{},
+		},
+		{
+			// ¥2,001 settles to about $13 and must not trip a $2,000 limit
+			name:    "large amount in a zero-decimal currency",
+			req:     PaymentRequest{UserID: "u1", Currency: "JPY"},
+			settled: []Money{NewMoney(1334, "USD")},
+			want:    []string{},
+		},
+		{
+			name:    "amount window",
+			req:     PaymentRequest{UserID: "u1"},
+			settled: []Money{NewMoney(150000, "USD"), NewMoney(60000, "USD")},
+			want:    []string{"velocity_user_amount_1m"},
+		},
+		{
+			// 0.1 + 0.2 style sums drift in floating point; minor units do not
+			name:    "sum exactly at the limit",
+			req:     PaymentRequest{UserID: "u1"},
+			settled: []Money{NewMoney(199990, "USD"), NewMoney(10, "USD")},
+			want:    []string{},
+		},
+		{
+			name:    "count window on every dimension",
+			req:     PaymentRequest{UserID: "u1", DeviceFingerprint: "d1", IPAddress: "10.0.0.1"},
+			settled: []Money{NewMoney(100, "USD"), NewMoney(100, "USD"), NewMoney(100, "USD")},
+			want:    []string{"velocity_user_count_1m", "velocity_device_count_1m", "velocity_ip_count_1m"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := &VelocityChecker{store: NewMemoryVelocityStore(velocityRetention), limits: limits, scoreWeight: 0.1}
+			var factors []string
+			var adjustment float64
+			for i, amount := range tt.settled {
+				factors, adjustment = vc.Check(context.Background(), tt.req, amount, now.Add(time.Duration(i)*time.Second))
+			}
+			if len(factors) != len(tt.want) {
+				t.Fatalf("factors = %v, want %v", factors, tt.want)
+			}
+			for i := range factors {
+				if factors[i] != tt.want[i] {
+					t.Errorf("factors = %v, want %v", factors, tt.want)
+					break
+				}
+			}
+			if want := float64(len(tt.want)) * 0.1; adjustment != want {
+				t.Errorf("adjustment = %v, want %v", adjustment, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v75"
+)
+
+// Webhook event statuses
+const (
+	WebhookReceived   = "received"
+	WebhookProcessing = "processing"
+	WebhookProcessed  = "processed"
+	WebhookIgnored    = "ignored"
+	WebhookFailed     = "failed"
+)
+
+// insertWebhookEvent stores an event unless one with the same provider
+// event ID is already held, and reports whether it was inserted
+func insertWebhookEvent(db *DatabaseConnection, event *WebhookEvent) (bool, error) {
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	query := `
+		INSERT INTO webhook_events (id, provider, event_id, event_type, payload, status, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (provider, event_id) DO NOTHING
+	`
+	result, err := db.ExecuteQuery(query, event.ID, event.Provider, event.EventID, event.EventType,
+		[]byte(event.Payload), WebhookReceived, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// WebhookProcessor applies stored webhook events in the order they were
+// received. Failed events are retried on later passes until maxAttempts,
+// and events claimed by a replica that died are picked up again after
+// claimTimeout.
+type WebhookProcessor struct {
+	db           *DatabaseConnection
+	payments     *PaymentProcessor
+	batchSize    int
+	maxAttempts  int
+	claimTimeout time.Duration
+	wake         chan struct{}
+}
+
+func NewWebhookProcessor(db *DatabaseConnection, payments *PaymentProcessor) *WebhookProcessor {
+	wp := &WebhookProcessor{
+		db:           db,
+		payments:     payments,
+		batchSize:    getEnvInt("WEBHOOK_BATCH_SIZE", 50),
+		maxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		claimTimeout: getEnvDuration("WEBHOOK_CLAIM_TIMEOUT", 5*time.Minute),
+		wake:         make(chan struct{}, 1),
+	}
+
+	go wp.run(getEnvDuration("WEBHOOK_POLL_INTERVAL", 5*time.Second))
+	return wp
+}
+
+// Wake asks the processor to run a pass without waiting for the next tick
+func (wp *WebhookProcessor) Wake() {
+	select {
+	case wp.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (wp *WebhookProcessor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-wp.wake:
+		}
+		wp.ProcessPending()
+	}
+}
+
+// ProcessPending applies claimed events until none are left
+func (wp *WebhookProcessor) ProcessPending() {
+	for {
+		events, err := wp.claim()
+		if err != nil {
+			log.Printf("Failed to claim webhook events: %v", err)
+			return
+		}
+		for i := range events {
+			wp.process(&events[i])
+		}
+		if len(events) < wp.batchSize {
+			return
+		}
+	}
+}
+
+// claim marks a batch of due events as processing. SKIP LOCKED lets
+// several replicas work through the queue without taking the same event.
+func (wp *WebhookProcessor) claim() ([]WebhookEvent, error) {
+	query := `
+		UPDATE webhook_events SET status = $1, claimed_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_events
+			WHERE (status IN ($3, $4) AND attempts < $5)
+			   OR (status = $1 AND claimed_at < $6)
+			ORDER BY received_at ASC
+			LIMIT $7
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, provider, event_id, event_type, payload, attempts, received_at
+	`
+	now := time.Now()
+	rows, err := wp.db.Query(query, WebhookProcessing, now, WebhookReceived, WebhookFailed, wp.maxAttempts,
+		now.Add(-wp.claimTimeout), wp.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		var e WebhookEvent
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Provider, &e.EventID, &e.EventType, &payload, &e.Attempts, &e.ReceivedAt); err != nil {
+			return nil, err
+		}
+		e.Payload = payload
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// process applies one event and records the outcome on its row
+func (wp *WebhookProcessor) process(event *WebhookEvent) {
+	status := WebhookProcessed
+	lastError := ""
+
+	update, err := decodeWebhookEvent(event)
+	if err == nil {
+		var applied bool
+		applied, err = wp.apply(update)
+		if err == nil && !applied {
+			status = WebhookIgnored
+		}
+	}
+	if err == errUnknownWebhookTransaction || err == errStaleWebhook || errors.Is(err, errIllegalTransition) {
+		// Late or out-of-order events are kept for inspection but not retried
+		status, lastError, err = WebhookIgnored, err.Error(), nil
+	}
+	if err != nil {
+		status = WebhookFailed
+		lastError = err.Error()
+		log.Printf("Failed to process %s webhook %s: %v", event.Provider, event.EventID, err)
+	}
+
+	query := `
+		UPDATE webhook_events
+		SET status = $1, attempts = attempts + 1, last_error = NULLIF($2, ''), processed_at = $3, claimed_at = NULL
+		WHERE id = $4
+	`
+	if _, err := wp.db.ExecuteQuery(query, status, lastError, time.Now(), event.ID); err != nil {
+		log.Printf("Failed to record outcome of webhook %s: %v", event.ID, err)
+	}
+}
+
+// apply settles the refund and moves the transaction an update refers to,
+// and reports whether the update did anything
+func (wp *WebhookProcessor) apply(update *webhookUpdate) (bool, error) {
+	if update.RefundID != "" {
+		_, err := wp.payments.completeRefund(update.RefundID, update.RefundStatus, update.ProviderRefundID, "", "")
+		if err == sql.ErrNoRows {
+			return false, errUnknownWebhookTransaction
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if update.Dispute != nil {
+		return true, wp.payments.RecordDispute(update)
+	}
+	if update.Status == "" {
+		return update.RefundID != "", nil
+	}
+	return true, applyWebhookUpdate(wp.db, update)
+}
+
+// decodeWebhookEvent turns a stored payload back into a webhookUpdate. The
+// signature was checked when the event was received, so it is not checked again.
+func decodeWebhookEvent(event *WebhookEvent) (*webhookUpdate, error) {
+	switch event.Provider {
+	case "stripe":
+		var se stripe.Event
+		if err := json.Unmarshal(event.Payload, &se); err != nil {
+			return nil, fmt.Errorf("decoding stripe event: %w", err)
+		}
+		return parseStripeEvent(se)
+	case "paypal":
+		return parsePayPalEvent(event.Payload)
+	}
+	return nil, fmt.Errorf("unknown webhook provider %q", event.Provider)
+}
+
+// Replay queues stored events to be applied again, either one event by ID
+// or every event for a provider received in [from, to). It returns the
+// number of events queued.
+func (wp *WebhookProcessor) Replay(id, provider string, from, to time.Time) (int64, error) {
+	query := `
+		UPDATE webhook_events
+		SET status = $1, attempts = 0, last_error = NULL, claimed_at = NULL
+		WHERE status <> $2 AND (
+			id = $3 OR
+			($3::text = '' AND ($4::text = '' OR provider = $4) AND received_at >= $5 AND received_at < $6)
+		)
+	`
+	result, err := wp.db.ExecuteQuery(query, WebhookReceived, WebhookProcessing, id, provider, from, to)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n > 0 {
+		wp.Wake()
+	}
+	return n, err
+}
+
+// ListWebhookEvents lists stored webhooks, newest first, filtered by
+// ?provider=, ?status= and ?event_type=
+func (ah *AdminHandler) ListWebhookEvents(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	query := `
+		SELECT id, provider, event_id, event_type, status, attempts, COALESCE(last_error, ''), received_at, processed_at
+		FROM webhook_events
+		WHERE ($1::text = '' OR provider = $1) AND ($2::text = '' OR status = $2) AND ($3::text = '' OR event_type = $3)
+		ORDER BY received_at DESC
+		LIMIT $4
+	`
+	rows, err := ah.db.Query(query, c.Query("provider"), c.Query("status"), c.Query("event_type"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to fetch webhook events",
+		})
+		return
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		var e WebhookEvent
+		var processedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Provider, &e.EventID, &e.EventType, &e.Status, &e.Attempts, &e.LastError, &e.ReceivedAt, &processedAt); err != nil {
+			continue
+		}
+		if processedAt.Valid {
+			e.ProcessedAt = &processedAt.Time
+		}
+		events = append(events, e)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    events,
+	})
+}
+
+// ReplayWebhookEvents queues one event, or a time range of events, to be
+// applied again
+func (ah *AdminHandler) ReplayWebhookEvents(c *gin.Context) {
+	var req struct {
+		ID       string    `json:"id"`
+		Provider string    `json:"provider"`
+		From     time.Time `json:"from"`
+		To       time.Time `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if req.ID == "" && (req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To)) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Either id or a from/to range with from before to is required",
+		})
+		return
+	}
+
+	queued, err := ah.webhooks.Replay(req.ID, req.Provider, req.From, req.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Failed to replay webhook events",
+		})
+		return
+	}
+	if req.ID != "" && queued == 0 {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Webhook event not found or already being processed",
+		})
+		return
+	}
+
+	log.Printf("Admin %s replayed %d webhook events", c.GetString("admin_user"), queued)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    gin.H{"queued": queued},
+	})
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/webhook"
+)
+
+// maxWebhookBodyBytes bounds how much of a webhook body is read
+const maxWebhookBodyBytes = 1 << 20
+
+var errWebhookNotConfigured = errors.New("webhook secret is not configured")
+
+// StripeWebhookVerifier checks the Stripe-Signature header, an HMAC of the
+// timestamped payload keyed with the endpoint's signing secret
+type StripeWebhookVerifier struct {
+	secret    string
+	tolerance time.Duration
+}
+
+func NewStripeWebhookVerifier() *StripeWebhookVerifier {
+	return &StripeWebhookVerifier{
+		secret:    getEnv("STRIPE_WEBHOOK_SECRET", ""),
+		tolerance: getEnvDuration("STRIPE_WEBHOOK_TOLERANCE", 5*time.Minute),
+	}
+}
+
+// Verify checks the signature and timestamp and decodes the event
+func (v *StripeWebhookVerifier) Verify(payload []byte, header string) (stripe.Event, error) {
+	if v.secret == "" {
+		return stripe.Event{}, errWebhookNotConfigured
+	}
+	return webhook.ConstructEventWithOptions(payload, header, v.secret, webhook.ConstructEventOptions{
+		Tolerance: v.tolerance,
+		// Events are read by field, so a newer account API version is fine
+		IgnoreAPIVersionMismatch: true,
+	})
+}
+
+// PayPalWebhookVerifier checks PayPal transmission signatures locally. The
+// signed message is transmission_id|transmission_time|webhook_id|crc32(body),
+// signed with SHA256withRSA by the certificate at PAYPAL-CERT-URL.
+type PayPalWebhookVerifier struct {
+	webhookID  string
+	tolerance  time.Duration
+	httpClient *http.Client
+	certs      map[string]*x509.Certificate
+	mu         sync.Mutex
+}
+
+func NewPayPalWebhookVerifier() *PayPalWebhookVerifier {
+	return &PayPalWebhookVerifier{
+		webhookID:  getEnv("PAYPAL_WEBHOOK_ID", ""),
+		tolerance:  getEnvDuration("PAYPAL_WEBHOOK_TOLERANCE", 5*time.Minute),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		certs:      make(map[string]*x509.Certificate),
+	}
+}
+
+// Verify checks the transmission signature and timestamp of a PayPal webhook
+func (v *PayPalWebhookVerifier) Verify(header http.Header, payload []byte) error {
+	if v.webhookID == "" {
+		return errWebhookNotConfigured
+	}
+
+	transmissionID := header.Get("PAYPAL-TRANSMISSION-ID")
+	transmissionTime := header.Get("PAYPAL-TRANSMISSION-TIME")
+	certURL := header.Get("PAYPAL-CERT-URL")
+	signature, err := base64.StdEncoding.DecodeString(header.Get("PAYPAL-TRANSMISSION-SIG"))
+	if transmissionID == "" || transmissionTime == "" || certURL == "" || err != nil || len(signature) == 0 {
+		return errors.New("missing or malformed PayPal transmission headers")
+	}
+	if algo := header.Get("PAYPAL-AUTH-ALGO"); algo != "" && algo != "SHA256withRSA" {
+		return fmt.Errorf("unsupported PayPal auth algorithm %q", algo)
+	}
+
+	sentAt, err := time.Parse(time.RFC3339, transmissionTime)
+	if err != nil {
+		return fmt.Errorf("invalid transmission time: %w", err)
+	}
+	if age := time.Since(sentAt); age > v.tolerance || age < -v.tolerance {
+		return errors.New("transmission time is outside the tolerance window")
+	}
+
+	cert, err := v.certificate(certURL)
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("PayPal certificate does not hold an RSA key")
+	}
+
+	message := fmt.Sprintf("%s|%s|%s|%d", transmissionID, transmissionTime, v.webhookID, crc32.ChecksumIEEE(payload))
+	digest := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+}
+
+// certificate fetches and caches PayPal's signing certificate. Only HTTPS
+// URLs on paypal.com are trusted so a forged header cannot supply its own key.
+func (v *PayPalWebhookVerifier) certificate(certURL string) (*x509.Certificate, error) {
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || !(u.Hostname() == "paypal.com" || strings.HasSuffix(u.Hostname(), ".paypal.com")) {
+		return nil, fmt.Errorf("untrusted PayPal certificate URL %q", certURL)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if cert, ok := v.certs[certURL]; ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	resp, err := v.httpClient.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching PayPal certificate: status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("PayPal certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("PayPal certificate is not currently valid")
+	}
+
+	v.certs[certURL] = cert
+	return cert, nil
+}
+
+// webhookUpdate is what a provider event means for one of our transactions
+type webhookUpdate struct {
+	Provider    string
+	EventID     string
+	EventType   string
+	TxnID       string // our transaction ID if the provider echoed it back
+	ProviderRef string // provider object the event is about
+	// RelatedRefs are provider objects ProviderRef belongs to, such as the
+	// authorization behind a PayPal capture
+	RelatedRefs []string
+	Status      string // empty when the event does not change the transaction
+	// RefundID and RefundStatus are set when the event settles one of our refunds
+	RefundID         string
+	RefundStatus     string
+	ProviderRefundID string
+	// Dispute is set for dispute and chargeback events
+	Dispute *disputeUpdate
+}
+
+// stripeEventStatuses maps Stripe event types onto transaction statuses
+var stripeEventStatuses = map[stripe.EventType]string{
+	"payment_intent.amount_capturable_updated": StatusAuthorized,
+	"payment_intent.processing":                StatusProcessing,
+	"payment_intent.succeeded":                 StatusCompleted,
+	"payment_intent.payment_failed":            StatusFailed,
+	"payment_intent.canceled":                  StatusVoided,
+	"charge.refunded":                          StatusRefunded,
+}
+
+func parseStripeEvent(event stripe.Event) (*webhookUpdate, error) {
+	update := &webhookUpdate{Provider: "stripe", EventID: event.ID, EventType: string(event.Type)}
+	if event.Data == nil {
+		return nil, errors.New("stripe event has no data")
+	}
+
+	var object struct {
+		ID            string            `json:"id"`
+		Object        string            `json:"object"`
+		Metadata      map[string]string `json:"metadata"`
+		PaymentIntent string            `json:"payment_intent"`
+		Refunded      bool              `json:"refunded"`
+		Status        string            `json:"status"`
+		// Dispute fields
+		Amount          int64  `json:"amount"`
+		Currency        string `json:"currency"`
+		Reason          string `json:"reason"`
+		EvidenceDetails struct {
+			DueBy int64 `json:"due_by"`
+		} `json:"evidence_details"`
+	}
+	if err := json.Unmarshal(event.Data.Raw, &object); err != nil {
+		return nil, fmt.Errorf("decoding stripe event object: %w", err)
+	}
+
+	update.TxnID = object.Metadata["txn_id"]
+	update.ProviderRef = object.ID
+	if object.Object == "charge" || object.Object == "dispute" {
+		// Charges and disputes refer back to the PaymentIntent we store as
+		// provider_txn_id
+		update.ProviderRef = object.PaymentIntent
+	}
+
+	update.Status = stripeEventStatuses[event.Type]
+	if event.Type == "charge.refunded" && !object.Refunded {
+		// Partial refunds leave the payment completed
+		update.Status = ""
+	}
+
+	if object.Object == "refund" && object.Metadata["refund_id"] != "" {
+		update.TxnID = ""
+		update.RefundID = object.Metadata["refund_id"]
+		update.ProviderRefundID = object.ID
+		switch object.Status {
+		case "succeeded":
+			update.RefundStatus = RefundSucceeded
+		case "failed", "canceled":
+			update.RefundStatus = RefundFailed
+		default:
+			update.RefundID = ""
+		}
+	}
+
+	if object.Object == "dispute" {
+		update.Dispute = &disputeUpdate{
+			ProviderDisputeID: object.ID,
+			Status:            stripeDisputeStatuses[object.Status],
+			Reason:            object.Reason,
+			Amount:            NewMoney(object.Amount, object.Currency),
+			Currency:          strings.ToUpper(object.Currency),
+		}
+		if object.EvidenceDetails.DueBy > 0 {
+			dueBy := time.Unix(object.EvidenceDetails.DueBy, 0)
+			update.Dispute.DueBy = &dueBy
+		}
+	}
+	return update, nil
+}
+
+// paypalEventStatuses maps PayPal event types onto transaction statuses
+var paypalEventStatuses = map[string]string{
+	"PAYMENT.AUTHORIZATION.CREATED": StatusAuthorized,
+	"PAYMENT.AUTHORIZATION.VOIDED":  StatusVoided,
+	"PAYMENT.CAPTURE.PENDING":       StatusProcessing,
+	"PAYMENT.CAPTURE.COMPLETED":     StatusCompleted,
+	"PAYMENT.CAPTURE.DENIED":        StatusFailed,
+	"PAYMENT.CAPTURE.DECLINED":      StatusFailed,
+	"PAYMENT.CAPTURE.REFUNDED":      StatusRefunded,
+}
+
+func parsePayPalEvent(payload []byte) (*webhookUpdate, error) {
+	var event struct {
+		ID        string `json:"id"`
+		EventType string `json:"event_type"`
+		Resource  struct {
+			ID       string       `json:"id"`
+			CustomID string       `json:"custom_id"`
+			Links    []paypalLink `json:"links"`
+			// Dispute fields
+			DisputeID             string       `json:"dispute_id"`
+			Reason                string       `json:"reason"`
+			Status                string       `json:"status"`
+			DisputeAmount         paypalAmount `json:"dispute_amount"`
+			SellerResponseDueDate string       `json:"seller_response_due_date"`
+			DisputedTransactions  []struct {
+				SellerTransactionID string `json:"seller_transaction_id"`
+				Custom              string `json:"custom"`
+			} `json:"disputed_transactions"`
+			DisputeOutcome struct {
+				OutcomeCode string `json:"outcome_code"`
+			} `json:"dispute_outcome"`
+		} `json:"resource"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("decoding paypal event: %w", err)
+	}
+	if event.ID == "" || event.EventType == "" {
+		return nil, errors.New("paypal event is missing id or event_type")
+	}
+
+	update := &webhookUpdate{
+		Provider:    "paypal",
+		EventID:     event.ID,
+		EventType:   event.EventType,
+		TxnID:       event.Resource.CustomID,
+		ProviderRef: event.Resource.ID,
+		Status:      paypalEventStatuses[event.EventType],
+	}
+	for _, l := range event.Resource.Links {
+		if l.Rel == "up" {
+			update.RelatedRefs = append(update.RelatedRefs, l.Href[strings.LastIndex(l.Href, "/")+1:])
+		}
+	}
+	if event.EventType == "PAYMENT.CAPTURE.REFUNDED" {
+		// The resource is the refund. Refunds we issued carry our refund ID
+		// as custom_id and settle through it; for others the "up" link
+		// points at the capture we store.
+		update.TxnID = ""
+		if event.Resource.CustomID != "" {
+			update.RefundID = event.Resource.CustomID
+			update.RefundStatus = RefundSucceeded
+			update.ProviderRefundID = event.Resource.ID
+			update.Status = ""
+		}
+		for _, l := range event.Resource.Links {
+			if l.Rel == "up" {
+				update.ProviderRef = l.Href[strings.LastIndex(l.Href, "/")+1:]
+			}
+		}
+	}
+
+	if strings.HasPrefix(event.EventType, "CUSTOMER.DISPUTE.") {
+		r := event.Resource
+		amount, err := ParseMoney(r.DisputeAmount.Value, r.DisputeAmount.CurrencyCode)
+		if err != nil {
+			return nil, fmt.Errorf("decoding paypal dispute amount: %w", err)
+		}
+		update.Dispute = &disputeUpdate{
+			ProviderDisputeID: r.DisputeID,
+			Status:            paypalDisputeStatus(r.Status, r.DisputeOutcome.OutcomeCode),
+			Reason:            strings.ToLower(r.Reason),
+			Amount:            amount,
+			Currency:          amount.Currency,
+		}
+		if dueBy, err := time.Parse(time.RFC3339, r.SellerResponseDueDate); err == nil {
+			update.Dispute.DueBy = &dueBy
+		}
+		// The disputed transaction is the capture we store; custom is the
+		// custom_id we sent, our transaction ID
+		update.TxnID, update.ProviderRef = "", ""
+		if len(r.DisputedTransactions) > 0 {
+			update.TxnID = r.DisputedTransactions[0].Custom
+			update.ProviderRef = r.DisputedTransactions[0].SellerTransactionID
+		}
+	}
+	return update, nil
+}
+
+// refersTo reports whether the update is about providerTxnID. Either side
+// may not know the provider object yet, which is not a mismatch.
+func (u *webhookUpdate) refersTo(providerTxnID string) bool {
+	if providerTxnID == "" || u.ProviderRef == "" || u.ProviderRef == providerTxnID {
+		return true
+	}
+	for _, ref := range u.RelatedRefs {
+		if ref == providerTxnID {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveWebhookTransaction finds the transaction an update refers to. An
+// update that names our transaction must still come from the provider the
+// transaction uses and be about its provider object: after a failover, late
+// events about the abandoned attempt are stale.
+func resolveWebhookTransaction(tx *sql.Tx, update *webhookUpdate) (string, error) {
+	if update.TxnID == "" {
+		var txnID string
+		query := `SELECT id FROM transactions WHERE provider = $1 AND provider_txn_id = $2`
+		err := tx.QueryRow(query, update.Provider, update.ProviderRef).Scan(&txnID)
+		return txnID, err
+	}
+
+	var provider, providerTxnID string
+	query := `SELECT COALESCE(provider, ''), COALESCE(provider_txn_id, '') FROM transactions WHERE id = $1`
+	if err := tx.QueryRow(query, update.TxnID).Scan(&provider, &providerTxnID); err != nil {
+		return "", err
+	}
+	if provider != update.Provider || !update.refersTo(providerTxnID) {
+		return "", errStaleWebhook
+	}
+	return update.TxnID, nil
+}
+
+var (
+	errUnknownWebhookTransaction = errors.New("webhook refers to an unknown transaction")
+	errStaleWebhook              = errors.New("webhook is from a provider attempt the transaction no longer uses")
+)
+
+// applyWebhookUpdate moves the referenced transaction to the event's status
+func applyWebhookUpdate(db *DatabaseConnection, update *webhookUpdate) error {
+	err := db.WithTransaction(func(tx *sql.Tx) error {
+		txnID, err := resolveWebhookTransaction(tx, update)
+		if err != nil {
+			return err
+		}
+		_, err = setTransactionStatus(tx, txnID, update.Status, "webhook:"+update.Provider, update.EventType+" "+update.EventID)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return errUnknownWebhookTransaction
+	}
+	return err
+}
+
+// WebhookHandler verifies inbound webhooks and stores them for the
+// WebhookProcessor; nothing is applied on the request path
+type WebhookHandler struct {
+	stripe    *StripeWebhookVerifier
+	paypal    *PayPalWebhookVerifier
+	processor *WebhookProcessor
+}
+
+func NewWebhookHandler(processor *WebhookProcessor) *WebhookHandler {
+	return &WebhookHandler{
+		stripe:    NewStripeWebhookVerifier(),
+		paypal:    NewPayPalWebhookVerifier(),
+		processor: processor,
+	}
+}
+
+func readWebhookBody(c *gin.Context) ([]byte, bool) {
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: "Failed to read webhook body"})
+		return nil, false
+	}
+	return payload, true
+}
+
+func rejectWebhook(c *gin.Context, provider string, err error) {
+	log.Printf("Rejected %s webhook: %v", provider, err)
+	c.JSON(http.StatusBadRequest, APIResponse{
+		Success: false,
+		Error:   "Invalid webhook signature",
+		Code:    "invalid_signature",
+	})
+}
+
+func (wh *WebhookHandler) HandleStripeWebhook(c *gin.Context) {
+	payload, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	event, err := wh.stripe.Verify(payload, c.GetHeader("Stripe-Signature"))
+	if err != nil {
+		rejectWebhook(c, "stripe", err)
+		return
+	}
+	if _, err := parseStripeEvent(event); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	wh.store(c, "stripe", event.ID, string(event.Type), payload)
+}
+
+func (wh *WebhookHandler) HandlePayPalWebhook(c *gin.Context) {
+	payload, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	if err := wh.paypal.Verify(c.Request.Header, payload); err != nil {
+		rejectWebhook(c, "paypal", err)
+		return
+	}
+
+	update, err := parsePayPalEvent(payload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{Success: false, Error: err.Error()})
+		return
+	}
+	wh.store(c, "paypal", update.EventID, update.EventType, payload)
+}
+
+// store persists a verified event and acknowledges it. Redeliveries of an
+// event we already hold are acknowledged without being stored again.
+func (wh *WebhookHandler) store(c *gin.Context, provider, eventID, eventType string, payload []byte) {
+	inserted, err := insertWebhookEvent(wh.processor.db, &WebhookEvent{
+		Provider:  provider,
+		EventID:   eventID,
+		EventType: eventType,
+		Payload:   payload,
+	})
+	if err != nil {
+		log.Printf("Failed to store %s webhook %s: %v", provider, eventID, err)
+		c.JSON(http.StatusInternalServerError, APIResponse{Success: false, Error: "Failed to store webhook"})
+		return
+	}
+	if !inserted {
+		c.JSON(http.StatusOK, APIResponse{Success: true, Message: "Duplicate event"})
+		return
+	}
+
+	wh.processor.Wake()
+	c.JSON(http.StatusOK, APIResponse{Success: true, Message: "Event received"})
+}
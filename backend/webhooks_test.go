@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v75/webhook"
+)
+
+const stripeTestPayload = `{"id": "evt_1", "object": "event", "type": "payment_intent.succeeded", "api_version": "2020-08-27", "data": {"object": {"id": "pi_1", "object": "payment_intent", "metadata": {"txn_id": "txn_1"}}}}`
+
+func TestStripeWebhookVerifier(t *testing.T) {
+	v := &StripeWebhookVerifier{secret: "whsec_test", tolerance: 5 * time.Minute}
+	payload := []byte(stripeTestPayload)
+	sign := func(secret string, at time.Time) string {
+		return webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret, Timestamp: at}).Header
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		header  string
+		wantErr bool
+	}{
+		{name: "valid", payload: payload, header: sign("whsec_test", time.Now())},
+		{name: "wrong secret", payload: payload, header: sign("whsec_other", time.Now()), wantErr: true},
+		{name: "tampered body", payload: []byte(stripeTestPayload + " "), header: sign("whsec_test", time.Now()), wantErr: true},
+		{name: "outside tolerance", payload: payload, header: sign("whsec_test", time.Now().Add(-10*time.Minute)), wantErr: true},
+		{name: "missing header", payload: payload, header: "", wantErr: true},
+		{name: "malformed header", payload: payload, header: "t=abc,v1=zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := v.Verify(tt.payload, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && event.ID != "evt_1" {
+				t.Errorf("event ID = %q, want evt_1", event.ID)
+			}
+		})
+	}
+
+	unconfigured := &StripeWebhookVerifier{tolerance: 5 * time.Minute}
+	if _, err := unconfigured.Verify(payload, sign("", time.Now())); err != errWebhookNotConfigured {
+		t.Errorf("Verify without a secret = %v, want errWebhookNotConfigured", err)
+	}
+}
+
+// paypalTestCert returns a key and a self-signed certificate standing in
+// for PayPal's signing certificate
+func paypalTestCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "messageverificationcerts.paypal.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func TestPayPalWebhookVerifier(t *testing.T) {
+	const certURL = "https://api.paypal.com/v1/notifications/certs/CERT-1"
+	const webhookID = "WH-1"
+	key, cert := paypalTestCert(t)
+	otherKey, _ := paypalTestCert(t)
+	payload := []byte(`{"id": "WH-EVT-1", "event_type": "PAYMENT.CAPTURE.COMPLETED", "resource": {"id": "CAP-1", "custom_id": "txn_1"}}`)
+
+	headers := func(signer *rsa.PrivateKey, id, at, url string, body []byte) http.Header {
+		message := fmt.Sprintf("%s|%s|%s|%d", id, at, webhookID, crc32.ChecksumIEEE(body))
+		digest := sha256.Sum256([]byte(message))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{}
+		h.Set("PAYPAL-TRANSMISSION-ID", id)
+		h.Set("PAYPAL-TRANSMISSION-TIME", at)
+		h.Set("PAYPAL-CERT-URL", url)
+		h.Set("PAYPAL-AUTH-ALGO", "SHA256withRSA")
+		h.Set("PAYPAL-TRANSMISSION-SIG", base64.StdEncoding.EncodeToString(sig))
+		return h
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	stale := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		body    []byte
+		wantErr bool
+	}{
+		{name: "valid", header: headers(key, "T-1", now, certURL, payload), body: payload},
+		{name: "signed by another key", header: headers(otherKey, "T-1", now, certURL, payload), body: payload, wantErr: true},
+		{name: "tampered body", header: headers(key, "T-1", now, certURL, payload), body: append([]byte(" "), payload...), wantErr: true},
+		{name: "stale transmission", header: headers(key, "T-1", stale, certURL, payload), body: payload, wantErr: true},
+		{name: "untrusted certificate host", header: headers(key, "T-1", now, "https://paypal.com.example.net/cert", payload), body: payload, wantErr: true},
+		{name: "plain http certificate", header: headers(key, "T-1", now, "http://api.paypal.com/cert", payload), body: payload, wantErr: true},
+		{name: "missing headers", header: http.Header{}, body: payload, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewPayPalWebhookVerifier()
+			v.webhookID = webhookID
+			// Seed the cache so the trusted URL resolves without a network call
+			v.certs[certURL] = cert
+			err := v.Verify(tt.header, tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	unsupported := headers(key, "T-1", now, certURL, payload)
+	unsupported.Set("PAYPAL-AUTH-ALGO", "SHA1withRSA")
+	v := NewPayPalWebhookVerifier()
+	v.webhookID = webhookID
+	v.certs[certURL] = cert
+	if err := v.Verify(unsupported, payload); err == nil {
+		t.Error("Verify accepted an unsupported auth algorithm")
+	}
+
+	v.webhookID = ""
+	if err := v.Verify(headers(key, "T-1", now, certURL, payload), payload); err != errWebhookNotConfigured {
+		t.Errorf("Verify without a webhook ID = %v, want errWebhookNotConfigured", err)
+	}
+}
+
+func TestParsePayPalDisputeAmount(t *testing.T) {
+	event := func(amount string) []byte {
+		return []byte(`{"id": "WH-EVT-2", "event_type": "CUSTOMER.DISPUTE.CREATED", "resource": {"dispute_id": "PP-D-1", "status": "OPEN",
+			"dispute_amount": ` + amount + `, "disputed_transactions": [{"seller_transaction_id": "CAP-1", "custom": "txn_1"}]}}`)
+	}
+
+	tests := []struct {
+		name    string
+		amount  string
+		want    Money
+		wantErr bool
+	}{
+		{name: "two decimals", amount: `{"currency_code": "USD", "value": "25.50"}`, want: NewMoney(2550, "USD")},
+		{name: "zero-decimal currency", amount: `{"currency_code": "JPY", "value": "3000"}`, want: NewMoney(3000, "JPY")},
+		{name: "too many decimals", amount: `{"currency_code": "USD", "value": "25.505"}`, wantErr: true},
+		{name: "not a number", amount: `{"currency_code": "USD", "value": "lots"}`, wantErr: true},
+		{name: "missing", amount: `{}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update, err := parsePayPalEvent(event(tt.amount))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePayPalEvent = %+v, want an error", update.Dispute)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePayPalEvent error: %v", err)
+			}
+			if update.Dispute.Amount != tt.want || update.Dispute.Currency != tt.want.Currency {
+				t.Errorf("dispute amount = %v %s, want %v", update.Dispute.Amount, update.Dispute.Currency, tt.want)
+			}
+			if update.TxnID != "txn_1" || update.ProviderRef != "CAP-1" {
+				t.Errorf("update refers to %s/%s, want txn_1/CAP-1", update.TxnID, update.ProviderRef)
+			}
+		})
+	}
+}
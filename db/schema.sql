@@ -7,23 +7,40 @@ CREATE TABLE IF NOT EXISTS users (
     name VARCHAR(255) NOT NULL,
     status VARCHAR(50) DEFAULT 'active',
     transaction_count INT DEFAULT 0,
-    total_spent DECIMAL(12, 2) DEFAULT 0.00,
+    total_spent DECIMAL(19, 4) DEFAULT 0,
+    total_spent_currency VARCHAR(3) NOT NULL DEFAULT 'USD',
     is_blacklisted BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Transactions table
+-- Transactions table. Money columns hold up to four decimal places so every
+-- ISO 4217 minor unit (JPY 0, USD 2, BHD 3, CLF 4) is stored exactly.
 CREATE TABLE IF NOT EXISTS transactions (
     id VARCHAR(255) PRIMARY KEY,
     user_id VARCHAR(255) NOT NULL,
-    amount DECIMAL(12, 2) NOT NULL,
+    amount DECIMAL(19, 4) NOT NULL,
     currency VARCHAR(10) NOT NULL,
     status VARCHAR(50) NOT NULL,
     risk_score DECIMAL(5, 4) DEFAULT 0.0000,
     fraud_detected BOOLEAN DEFAULT FALSE,
     provider VARCHAR(50),
     provider_txn_id VARCHAR(255),
+    payment_method VARCHAR(255),
+    failure_code VARCHAR(100),
+    failure_message TEXT,
+    merchant_category VARCHAR(100),
+    routing_reason TEXT,
+    retry_plan TEXT[],
+    capture_method VARCHAR(20) NOT NULL DEFAULT 'automatic',
+    authorization_expires_at TIMESTAMP,
+    authorization_flagged_at TIMESTAMP,
+    captured_amount DECIMAL(19, 4) NOT NULL DEFAULT 0,
+    refunded_amount DECIMAL(19, 4) NOT NULL DEFAULT 0,
+    -- amount converted into SETTLEMENT_CURRENCY when the payment was created
+    settlement_amount DECIMAL(19, 4) NOT NULL,
+    settlement_currency VARCHAR(10) NOT NULL,
+    fx_rate DECIMAL(24, 12) NOT NULL DEFAULT 1,
     description TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -35,18 +52,312 @@ CREATE TABLE IF NOT EXISTS fraud_logs (
     id VARCHAR(255) PRIMARY KEY,
     transaction_id VARCHAR(255) NOT NULL,
     user_id VARCHAR(255) NOT NULL,
+    risk_factors TEXT[] NOT NULL DEFAULT '{}',
     risk_score DECIMAL(5, 4) NOT NULL,
     action VARCHAR(50) NOT NULL,
+    reviewed_by VARCHAR(255),
+    reason TEXT,
     detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- Manual review queue for held transactions
+CREATE TABLE IF NOT EXISTS manual_reviews (
+    transaction_id VARCHAR(255) PRIMARY KEY,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    assigned_to VARCHAR(255),
+    claimed_at TIMESTAMP,
+    decided_at TIMESTAMP,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+);
+
+-- Audit trail of administrative changes to users
+CREATE TABLE IF NOT EXISTS user_audit_log (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    reason TEXT NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Fraud rules evaluated alongside the ML score
+CREATE TABLE IF NOT EXISTS fraud_rules (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    rule_type VARCHAR(50) NOT NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    risk_factor VARCHAR(255) NOT NULL,
+    score_adjustment DECIMAL(5, 4) DEFAULT 0.0000,
+    forced_action VARCHAR(50),
+    priority INT DEFAULT 100,
+    enabled BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Every provider call made while charging a transaction
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    attempt_number INT NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    error_code VARCHAR(100),
+    error_message TEXT,
+    latency_ms BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+);
+
+-- Every status a transaction has been in, written with the status change
+CREATE TABLE IF NOT EXISTS transaction_status_history (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    source VARCHAR(100) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+);
+
+-- Refunds against captured transactions. refunded_amount on the transaction
+-- is the sum of its pending and succeeded refunds.
+CREATE TABLE IF NOT EXISTS refunds (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    amount DECIMAL(19, 4) NOT NULL,
+    currency VARCHAR(10) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    provider_refund_id VARCHAR(255),
+    reason TEXT,
+    failure_code VARCHAR(100),
+    failure_message TEXT,
+    requested_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+);
+
+-- Disputes and chargebacks raised against captured transactions
+CREATE TABLE IF NOT EXISTS disputes (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    provider_dispute_id VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    reason VARCHAR(100),
+    amount DECIMAL(19, 4) NOT NULL,
+    currency VARCHAR(10) NOT NULL,
+    due_by TIMESTAMP,
+    closed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, provider_dispute_id),
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+);
+
+-- Evidence attached to a dispute. Files live in object storage; only their
+-- metadata is kept here.
+CREATE TABLE IF NOT EXISTS dispute_evidence (
+    id VARCHAR(255) PRIMARY KEY,
+    dispute_id VARCHAR(255) NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100),
+    size_bytes BIGINT,
+    storage_url TEXT,
+    description TEXT,
+    uploaded_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (dispute_id) REFERENCES disputes(id) ON DELETE CASCADE
+);
+
+-- Confirmed outcomes used as training labels for the fraud model
+CREATE TABLE IF NOT EXISTS fraud_labels (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    label VARCHAR(50) NOT NULL,
+    source VARCHAR(50) NOT NULL,
+    source_id VARCHAR(255),
+    risk_score DECIMAL(5, 4),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Double-entry ledger. Each account holds one currency; postings are signed
+-- with debits positive and credits negative, and the postings of a journal
+-- entry must sum to zero.
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    id VARCHAR(255) PRIMARY KEY,
+    code VARCHAR(100) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('asset', 'liability', 'revenue', 'expense')),
+    currency VARCHAR(10) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (code, currency)
+);
+
+-- A journal entry records one money movement. reference_type and
+-- reference_id name what caused it, so each movement is posted once.
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id VARCHAR(255) PRIMARY KEY,
+    transaction_id VARCHAR(255),
+    provider VARCHAR(50),
+    reference_type VARCHAR(50) NOT NULL,
+    reference_id VARCHAR(255) NOT NULL,
+    currency VARCHAR(10) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (reference_type, reference_id),
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE RESTRICT
+);
+
+CREATE TABLE IF NOT EXISTS ledger_postings (
+    id VARCHAR(255) PRIMARY KEY,
+    entry_id VARCHAR(255) NOT NULL,
+    account_id VARCHAR(255) NOT NULL,
+    amount DECIMAL(19, 4) NOT NULL CHECK (amount <> 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (entry_id) REFERENCES journal_entries(id) ON DELETE RESTRICT,
+    FOREIGN KEY (account_id) REFERENCES ledger_accounts(id) ON DELETE RESTRICT
+);
+
+-- Exchange rates: one unit of base_currency buys rate units of
+-- quote_currency from effective_at on. Rates are never updated; the latest
+-- one in effect for a pair is the current rate.
+CREATE TABLE IF NOT EXISTS fx_rates (
+    id VARCHAR(255) PRIMARY KEY,
+    base_currency VARCHAR(10) NOT NULL,
+    quote_currency VARCHAR(10) NOT NULL,
+    rate DECIMAL(24, 12) NOT NULL CHECK (rate > 0),
+    source VARCHAR(20) NOT NULL CHECK (source IN ('seed', 'file', 'admin')),
+    effective_at TIMESTAMP NOT NULL,
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (base_currency, quote_currency, effective_at),
+    CHECK (base_currency <> quote_currency)
+);
+
+-- Provider settlement reports imported for reconciliation. checksum stops
+-- the same file being imported twice.
+CREATE TABLE IF NOT EXISTS settlement_reports (
+    id VARCHAR(255) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    row_count INT NOT NULL DEFAULT 0,
+    skipped_rows INT NOT NULL DEFAULT 0,
+    period_start TIMESTAMP,
+    period_end TIMESTAMP,
+    imported_by VARCHAR(255),
+    reconciled_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, checksum)
+);
+
+-- One line of a settlement report. row_id is the provider's ID for the line,
+-- so a line in two overlapping reports is stored once.
+CREATE TABLE IF NOT EXISTS settlement_report_rows (
+    id VARCHAR(255) PRIMARY KEY,
+    report_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    row_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('payment', 'refund', 'other')),
+    type VARCHAR(100),
+    provider_reference VARCHAR(255),
+    gross DECIMAL(19, 4) NOT NULL,
+    fee DECIMAL(19, 4) NOT NULL DEFAULT 0,
+    net DECIMAL(19, 4) NOT NULL,
+    currency VARCHAR(10) NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    description TEXT,
+    UNIQUE (provider, row_id),
+    FOREIGN KEY (report_id) REFERENCES settlement_reports(id) ON DELETE CASCADE
+);
+
+-- Differences between our records and settlement reports
+CREATE TABLE IF NOT EXISTS reconciliation_mismatches (
+    id VARCHAR(255) PRIMARY KEY,
+    report_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    type VARCHAR(30) NOT NULL CHECK (type IN ('missing_internal', 'missing_at_provider', 'amount_mismatch')),
+    kind VARCHAR(20) NOT NULL,
+    provider_reference VARCHAR(255) NOT NULL,
+    transaction_id VARCHAR(255),
+    internal_amount DECIMAL(19, 4),
+    internal_currency VARCHAR(10),
+    provider_amount DECIMAL(19, 4),
+    provider_currency VARCHAR(10),
+    status VARCHAR(20) NOT NULL DEFAULT 'open',
+    resolved_by VARCHAR(255),
+    resolution TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP,
+    FOREIGN KEY (report_id) REFERENCES settlement_reports(id) ON DELETE CASCADE
+);
+
+-- Routing rules pin a currency and/or merchant category to a provider
+CREATE TABLE IF NOT EXISTS routing_rules (
+    id VARCHAR(255) PRIMARY KEY,
+    currency VARCHAR(10),
+    merchant_category VARCHAR(100),
+    provider VARCHAR(50) NOT NULL,
+    priority INT DEFAULT 100,
+    enabled BOOLEAN DEFAULT TRUE,
+    created_by VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (currency IS NOT NULL OR merchant_category IS NOT NULL)
+);
+
+-- Raw inbound webhooks, deduplicated by the provider's event ID and
+-- applied asynchronously so they can be replayed
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id VARCHAR(255) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'received',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    claimed_at TIMESTAMP,
+    processed_at TIMESTAMP,
+    UNIQUE (provider, event_id)
+);
+
+-- Idempotency keys for POST /api/v1/transactions
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(255) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    response_code INT,
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, idempotency_key)
+);
+
 -- Payment providers table
 CREATE TABLE IF NOT EXISTS payment_providers (
     id VARCHAR(255) PRIMARY KEY,
+    code VARCHAR(50) UNIQUE NOT NULL,
     name VARCHAR(100) NOT NULL,
     fee DECIMAL(5, 4) NOT NULL,
+    fixed_fee DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    fixed_fee_currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+    currencies TEXT[] NOT NULL DEFAULT '{}',
     status VARCHAR(50) DEFAULT 'active',
     last_checked TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -55,13 +366,91 @@ CREATE TABLE IF NOT EXISTS payment_providers (
 CREATE INDEX idx_transactions_user_id ON transactions(user_id);
 CREATE INDEX idx_transactions_status ON transactions(status);
 CREATE INDEX idx_transactions_created_at ON transactions(created_at);
+CREATE INDEX idx_transactions_provider_created_at ON transactions(provider, created_at);
+CREATE INDEX idx_transactions_authorized ON transactions(authorization_expires_at) WHERE status = 'authorized';
+CREATE INDEX idx_transactions_provider_txn_id ON transactions(provider, provider_txn_id);
+CREATE INDEX idx_transaction_status_history_transaction_id ON transaction_status_history(transaction_id, created_at);
+CREATE INDEX idx_disputes_status_due_by ON disputes(status, due_by);
+CREATE INDEX idx_disputes_transaction_id ON disputes(transaction_id);
+CREATE INDEX idx_dispute_evidence_dispute_id ON dispute_evidence(dispute_id);
+CREATE INDEX idx_fraud_labels_user_id ON fraud_labels(user_id, created_at);
+CREATE INDEX idx_refunds_transaction_id ON refunds(transaction_id, created_at);
+CREATE INDEX idx_refunds_provider_refund_id ON refunds(provider, provider_refund_id);
+CREATE INDEX idx_payment_attempts_transaction_id ON payment_attempts(transaction_id, attempt_number);
+CREATE INDEX idx_payment_attempts_created_at ON payment_attempts(created_at);
 CREATE INDEX idx_fraud_logs_transaction_id ON fraud_logs(transaction_id);
 CREATE INDEX idx_fraud_logs_user_id ON fraud_logs(user_id);
+CREATE INDEX idx_manual_reviews_status ON manual_reviews(status, created_at);
+CREATE INDEX idx_user_audit_log_user_id ON user_audit_log(user_id, created_at);
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+CREATE INDEX idx_webhook_events_status ON webhook_events(status, received_at);
+CREATE INDEX idx_webhook_events_received_at ON webhook_events(provider, received_at);
+CREATE INDEX idx_journal_entries_transaction_id ON journal_entries(transaction_id);
+CREATE INDEX idx_journal_entries_created_at ON journal_entries(created_at);
+CREATE INDEX idx_ledger_postings_entry_id ON ledger_postings(entry_id);
+CREATE INDEX idx_ledger_postings_account_id ON ledger_postings(account_id);
+CREATE INDEX idx_settlement_report_rows_report_id ON settlement_report_rows(report_id);
+CREATE INDEX idx_settlement_report_rows_reference ON settlement_report_rows(provider, kind, provider_reference);
+CREATE INDEX idx_reconciliation_mismatches_report_id ON reconciliation_mismatches(report_id, status);
+CREATE INDEX idx_reconciliation_mismatches_reference ON reconciliation_mismatches(provider, kind, provider_reference, type);
+-- At most one open mismatch per reference and type
+CREATE UNIQUE INDEX idx_reconciliation_mismatches_open ON reconciliation_mismatches(provider, kind, provider_reference, type) WHERE status = 'open';
+
+-- Journal entries must balance. The check is deferred to commit so the
+-- postings of an entry can be inserted one at a time.
+CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS TRIGGER AS $$
+BEGIN
+    IF (SELECT COALESCE(SUM(amount), 0) FROM ledger_postings WHERE entry_id = NEW.entry_id) <> 0 THEN
+        RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER ledger_postings_balanced
+    AFTER INSERT ON ledger_postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();
+
+-- The ledger is append-only; mistakes are corrected with a reversing entry
+CREATE OR REPLACE FUNCTION reject_ledger_change() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER journal_entries_append_only
+    BEFORE UPDATE OR DELETE ON journal_entries
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+CREATE TRIGGER ledger_postings_append_only
+    BEFORE UPDATE OR DELETE ON ledger_postings
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
 
 -- Insert default payment providers
-INSERT INTO payment_providers (id, name, fee, status) VALUES
-    ('stripe_001', 'Stripe', 0.0290, 'active'),
-    ('paypal_001', 'PayPal', 0.0340, 'active')
+INSERT INTO payment_providers (id, code, name, fee, fixed_fee, fixed_fee_currency, status) VALUES
+    ('stripe_001', 'stripe', 'Stripe', 0.0290, 0.30, 'USD', 'active'),
+    ('paypal_001', 'paypal', 'PayPal', 0.0340, 0.30, 'USD', 'active'),
+    ('sandbox_001', 'sandbox', 'Sandbox', 0.0000, 0.00, 'USD', 'disabled')
+ON CONFLICT DO NOTHING;
+
+-- Insert starting FX rates against USD. They are placeholders; load real
+-- rates with FX_RATES_FILE or POST /api/v1/admin/fx-rates.
+INSERT INTO fx_rates (id, base_currency, quote_currency, rate, source, effective_at) VALUES
+    ('fx_seed_usd_eur', 'USD', 'EUR', 0.92, 'seed', '2024-01-01 00:00:00'),
+    ('fx_seed_usd_gbp', 'USD', 'GBP', 0.79, 'seed', '2024-01-01 00:00:00'),
+    ('fx_seed_usd_jpy', 'USD', 'JPY', 150.00, 'seed', '2024-01-01 00:00:00'),
+    ('fx_seed_usd_cad', 'USD', 'CAD', 1.35, 'seed', '2024-01-01 00:00:00'),
+    ('fx_seed_usd_aud', 'USD', 'AUD', 1.52, 'seed', '2024-01-01 00:00:00'),
+    ('fx_seed_usd_chf', 'USD', 'CHF', 0.88, 'seed', '2024-01-01 00:00:00')
+ON CONFLICT DO NOTHING;
+
+-- Insert default fraud rules
+INSERT INTO fraud_rules (id, name, rule_type, params, risk_factor, score_adjustment, forced_action, priority) VALUES
+    ('rule_recently_blacklisted', 'Recently blacklisted user', 'user_blacklisted', '{"days": 30}', 'User was blacklisted in the last 30 days', 0.2500, NULL, 10),
+    ('rule_high_amount_usd', 'High amount (USD)', 'amount_above', '{"amount": 10000, "currency": "USD"}', 'Amount above 10000 USD', 0.2000, NULL, 50),
+    ('rule_velocity_user', 'User velocity', 'velocity', '{"count": 5, "minutes": 10}', 'More than 5 transactions in 10 minutes', 0.3000, NULL, 50),
+    ('rule_country_mismatch', 'Country mismatch', 'country_mismatch', '{}', 'IP country does not match billing country', 0.1500, NULL, 100)
 ON CONFLICT DO NOTHING;
 
 -- Insert sample users